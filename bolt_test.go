@@ -0,0 +1,53 @@
+package crowd
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltDBStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crowd.db")
+	open := func() (*bolt.DB, *Store) {
+		db, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := NewBoltDBStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, store
+	}
+
+	db, store := open()
+	if _, err := store.IDRegister("", "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.IDLogin("", "alice", "wrong"); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong, got %v", err)
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := u.Session.ID
+	store.StopSessionGC()
+	db.Close()
+
+	// users and sessions are kept in the file
+	db, store = open()
+	defer db.Close()
+	defer store.StopSessionGC()
+	u, err = store.IDGet(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.LoggedIn || u.Name != "alice" {
+		t.Errorf("expected alice to be logged in after reopening, got %+v", u)
+	}
+	if _, err = store.IDRegister("", "alice", "other"); err != ErrUserExists {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+}
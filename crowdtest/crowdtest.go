@@ -0,0 +1,969 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package crowdtest provides a conformance test suite for implementations of
+the crowd.Storer interface.
+
+Call RunStorerTests from a test in the package of your backend:
+
+	func TestMyStorer(t *testing.T) {
+		crowdtest.RunStorerTests(t, func(t *testing.T) crowd.Storer {
+			return newMyStorer(t)
+		})
+	}
+*/
+package crowdtest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mbertschler/crowd"
+)
+
+// StorerFactory returns a new and empty Storer. It is called once for
+// every test of the suite. Use t.Cleanup to release resources.
+type StorerFactory func(t *testing.T) crowd.Storer
+
+// RunStorerTests runs the conformance tests for the Storer interface as
+// subtests of t. Every subtest gets a fresh Storer from newStorer.
+func RunStorerTests(t *testing.T, newStorer StorerFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s crowd.Storer)
+	}{
+		{"NotFound", testNotFound},
+		{"Sessions", testSessions},
+		{"ForEachSession", testForEachSession},
+		{"AddUser", testAddUser},
+		{"PutUser", testPutUser},
+		{"RenameUser", testRenameUser},
+		{"DeleteUser", testDeleteUser},
+		{"ForEachUser", testForEachUser},
+		{"ConcurrentUsers", testConcurrentUsers},
+		{"ConcurrentSessions", testConcurrentSessions},
+		{"UserSessions", testUserSessions},
+		{"Groups", testGroups},
+		{"Tokens", testTokens},
+		{"UniqueTokens", testUniqueTokens},
+		{"UserTokens", testUserTokens},
+		{"Emails", testEmails},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newStorer(t))
+		})
+	}
+}
+
+func testNotFound(t *testing.T, s crowd.Storer) {
+	if _, err := s.GetSession("missing"); err != crowd.ErrSessionNotFound {
+		t.Errorf("GetSession: expected ErrSessionNotFound, got %v", err)
+	}
+	if _, err := s.GetUser(1); err != crowd.ErrUserNotFound {
+		t.Errorf("GetUser: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := s.GetUserID("missing"); err != crowd.ErrUserNotFound {
+		t.Errorf("GetUserID: expected ErrUserNotFound, got %v", err)
+	}
+	if err := s.RenameUser(1, "missing"); err != crowd.ErrUserNotFound {
+		t.Errorf("RenameUser: expected ErrUserNotFound, got %v", err)
+	}
+	if err := s.DeleteUser(1); err != crowd.ErrUserNotFound {
+		t.Errorf("DeleteUser: expected ErrUserNotFound, got %v", err)
+	}
+	if n := s.CountUsers(); n != 0 {
+		t.Errorf("CountUsers: expected 0 on an empty store, got %d", n)
+	}
+}
+
+func testSessions(t *testing.T, s crowd.Storer) {
+	sess := &crowd.StoredSession{
+		ID:         "session-1",
+		Expires:    time.Now().Add(time.Hour),
+		LastAccess: time.Now(),
+		LoggedIn:   true,
+		UserID:     42,
+	}
+	if err := s.PutSession(sess); err != nil {
+		t.Fatal("PutSession:", err)
+	}
+	got, err := s.GetSession(sess.ID)
+	if err != nil {
+		t.Fatal("GetSession:", err)
+	}
+	checkSession(t, got, sess)
+
+	// the store must not keep a reference to the passed session
+	sess.UserID = 43
+	got, err = s.GetSession(sess.ID)
+	if err != nil {
+		t.Fatal("GetSession:", err)
+	}
+	if got.UserID != 42 {
+		t.Errorf("stored session changed without PutSession")
+	}
+
+	// overwrite
+	sess.LoggedIn = false
+	sess.SecondFactorPending = true
+	sess.FixedExpiry = true
+	if err = s.PutSession(sess); err != nil {
+		t.Fatal("PutSession:", err)
+	}
+	got, err = s.GetSession(sess.ID)
+	if err != nil {
+		t.Fatal("GetSession:", err)
+	}
+	checkSession(t, got, sess)
+
+	if err = s.DeleteSession(sess.ID); err != nil {
+		t.Fatal("DeleteSession:", err)
+	}
+	if _, err = s.GetSession(sess.ID); err != crowd.ErrSessionNotFound {
+		t.Errorf("GetSession after delete: expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func testForEachSession(t *testing.T, s crowd.Storer) {
+	for i := 0; i < 10; i++ {
+		err := s.PutSession(&crowd.StoredSession{
+			ID:      fmt.Sprint("session-", i),
+			Expires: time.Now().Add(time.Hour),
+			UserID:  uint64(i),
+		})
+		if err != nil {
+			t.Fatal("PutSession:", err)
+		}
+	}
+	seen := map[string]bool{}
+	err := s.ForEachSession(func(sess *crowd.StoredSession) bool {
+		seen[sess.ID] = true
+		return sess.UserID%2 == 0
+	})
+	if err != nil {
+		t.Fatal("ForEachSession:", err)
+	}
+	if len(seen) != 10 {
+		t.Errorf("ForEachSession visited %d sessions, expected 10", len(seen))
+	}
+	for i := 0; i < 10; i++ {
+		_, err := s.GetSession(fmt.Sprint("session-", i))
+		if i%2 == 0 && err != crowd.ErrSessionNotFound {
+			t.Errorf("session %d should be deleted, got %v", i, err)
+		}
+		if i%2 == 1 && err != nil {
+			t.Errorf("session %d should still exist, got %v", i, err)
+		}
+	}
+	count := 0
+	err = s.ForEachSession(func(sess *crowd.StoredSession) bool {
+		count++
+		return false
+	})
+	if err != nil {
+		t.Fatal("ForEachSession:", err)
+	}
+	if count != 5 {
+		t.Errorf("ForEachSession visited %d sessions after deletion, expected 5", count)
+	}
+}
+
+func testAddUser(t *testing.T, s crowd.Storer) {
+	for i := 1; i <= 3; i++ {
+		id, err := s.AddUser(&crowd.StoredUser{Name: fmt.Sprint("user", i)})
+		if err != nil {
+			t.Fatal("AddUser:", err)
+		}
+		if id != uint64(i) {
+			t.Errorf("AddUser: expected ID %d, got %d", i, id)
+		}
+		uid, err := s.GetUserID(fmt.Sprint("user", i))
+		if err != nil {
+			t.Fatal("GetUserID:", err)
+		}
+		if uid != id {
+			t.Errorf("GetUserID: expected ID %d, got %d", id, uid)
+		}
+	}
+	if _, err := s.AddUser(&crowd.StoredUser{Name: "user1"}); err != crowd.ErrUserExists {
+		t.Errorf("AddUser with existing name: expected ErrUserExists, got %v", err)
+	}
+	if n := s.CountUsers(); n != 3 {
+		t.Errorf("CountUsers: expected 3, got %d", n)
+	}
+}
+
+func testPutUser(t *testing.T, s crowd.Storer) {
+	u := &crowd.StoredUser{
+		Name: "alice",
+		Pass: []byte("pass"),
+		Salt: []byte("salt"),
+		Data: "data",
+	}
+	id, err := s.AddUser(u)
+	if err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	got, err := s.GetUser(id)
+	if err != nil {
+		t.Fatal("GetUser:", err)
+	}
+	u.ID = id
+	checkUser(t, got, u)
+
+	u.Pass = []byte("other pass")
+	u.Data = "other data"
+	u.Roles = []string{"admin", "editor"}
+	u.Permissions = []string{"billing:write"}
+	u.InvitedBy = 7
+	u.TOTPSecret = []byte("totp secret")
+	u.TOTPLastStep = 12345
+	u.RecoveryCodes = [][]byte{[]byte("code 1"), []byte("code 2")}
+	if err = s.PutUser(u); err != nil {
+		t.Fatal("PutUser:", err)
+	}
+	got, err = s.GetUser(id)
+	if err != nil {
+		t.Fatal("GetUser:", err)
+	}
+	checkUser(t, got, u)
+
+	// a changed name needs to update the username index
+	u.Name = "bob"
+	if err = s.PutUser(u); err != nil {
+		t.Fatal("PutUser:", err)
+	}
+	checkName(t, s, id, "alice", "bob")
+
+	if _, err = s.AddUser(&crowd.StoredUser{Name: "carol"}); err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	u.Name = "carol"
+	if err = s.PutUser(u); err != crowd.ErrUserExists {
+		t.Errorf("PutUser with existing name: expected ErrUserExists, got %v", err)
+	}
+	checkName(t, s, id, "alice", "bob")
+}
+
+func testRenameUser(t *testing.T, s crowd.Storer) {
+	id, err := s.AddUser(&crowd.StoredUser{Name: "alice", Data: "data"})
+	if err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	otherID, err := s.AddUser(&crowd.StoredUser{Name: "carol"})
+	if err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	if err = s.RenameUser(id, "bob"); err != nil {
+		t.Fatal("RenameUser:", err)
+	}
+	checkName(t, s, id, "alice", "bob")
+	u, err := s.GetUser(id)
+	if err != nil {
+		t.Fatal("GetUser:", err)
+	}
+	if u.Data != "data" {
+		t.Errorf("RenameUser lost the user data, got %v", u.Data)
+	}
+
+	if err = s.RenameUser(id, "carol"); err != crowd.ErrUserExists {
+		t.Errorf("RenameUser to existing name: expected ErrUserExists, got %v", err)
+	}
+	checkName(t, s, id, "alice", "bob")
+	uid, err := s.GetUserID("carol")
+	if err != nil || uid != otherID {
+		t.Errorf("GetUserID(carol): expected %d, got %d %v", otherID, uid, err)
+	}
+
+	// the old name can be used again
+	if _, err = s.AddUser(&crowd.StoredUser{Name: "alice"}); err != nil {
+		t.Error("AddUser with the old name of a renamed user:", err)
+	}
+	if n := s.CountUsers(); n != 3 {
+		t.Errorf("CountUsers: expected 3, got %d", n)
+	}
+}
+
+func testDeleteUser(t *testing.T, s crowd.Storer) {
+	id, err := s.AddUser(&crowd.StoredUser{Name: "alice"})
+	if err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	if err = s.DeleteUser(id); err != nil {
+		t.Fatal("DeleteUser:", err)
+	}
+	if _, err = s.GetUser(id); err != crowd.ErrUserNotFound {
+		t.Errorf("GetUser after delete: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err = s.GetUserID("alice"); err != crowd.ErrUserNotFound {
+		t.Errorf("GetUserID after delete: expected ErrUserNotFound, got %v", err)
+	}
+	if err = s.DeleteUser(id); err != crowd.ErrUserNotFound {
+		t.Errorf("DeleteUser twice: expected ErrUserNotFound, got %v", err)
+	}
+	if n := s.CountUsers(); n != 0 {
+		t.Errorf("CountUsers: expected 0, got %d", n)
+	}
+	newID, err := s.AddUser(&crowd.StoredUser{Name: "alice"})
+	if err != nil {
+		t.Fatal("AddUser with the name of a deleted user:", err)
+	}
+	if newID == id {
+		t.Errorf("AddUser reused the ID %d of a deleted user", id)
+	}
+}
+
+func testForEachUser(t *testing.T, s crowd.Storer) {
+	for i := 1; i <= 10; i++ {
+		_, err := s.AddUser(&crowd.StoredUser{Name: fmt.Sprint("user", i)})
+		if err != nil {
+			t.Fatal("AddUser:", err)
+		}
+	}
+	seen := map[uint64]bool{}
+	err := s.ForEachUser(func(u *crowd.StoredUser) bool {
+		seen[u.ID] = true
+		return u.ID%2 == 0
+	})
+	if err != nil {
+		t.Fatal("ForEachUser:", err)
+	}
+	if len(seen) != 10 {
+		t.Errorf("ForEachUser visited %d users, expected 10", len(seen))
+	}
+	for i := 1; i <= 10; i++ {
+		name := fmt.Sprint("user", i)
+		_, err := s.GetUser(uint64(i))
+		_, nameErr := s.GetUserID(name)
+		if i%2 == 0 && (err != crowd.ErrUserNotFound || nameErr != crowd.ErrUserNotFound) {
+			t.Errorf("user %d should be deleted, got %v and %v", i, err, nameErr)
+		}
+		if i%2 == 1 && (err != nil || nameErr != nil) {
+			t.Errorf("user %d should still exist, got %v and %v", i, err, nameErr)
+		}
+	}
+	if n := s.CountUsers(); n != 5 {
+		t.Errorf("CountUsers: expected 5, got %d", n)
+	}
+}
+
+func testConcurrentUsers(t *testing.T, s crowd.Storer) {
+	const n = 20
+	ids := make([]uint64, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = s.AddUser(&crowd.StoredUser{Name: fmt.Sprint("user", i)})
+			if errs[i] != nil {
+				return
+			}
+			_, errs[i] = s.GetUser(ids[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("user %d: %v", i, err)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		if id != uint64(i+1) {
+			t.Fatalf("concurrent AddUser returned IDs %v, expected 1 to %d", ids, n)
+		}
+	}
+	if c := s.CountUsers(); c != n {
+		t.Errorf("CountUsers: expected %d, got %d", n, c)
+	}
+}
+
+func testConcurrentSessions(t *testing.T, s crowd.Storer) {
+	const n = 20
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprint("session-", i)
+			errs[i] = s.PutSession(&crowd.StoredSession{ID: id, UserID: uint64(i)})
+			if errs[i] != nil {
+				return
+			}
+			sess, err := s.GetSession(id)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if sess.UserID != uint64(i) {
+				errs[i] = fmt.Errorf("got UserID %d", sess.UserID)
+				return
+			}
+			errs[i] = s.DeleteSession(id)
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.ForEachSession(func(*crowd.StoredSession) bool { return false })
+	}()
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("session %d: %v", i, err)
+		}
+	}
+}
+
+// testUserSessions checks the index of an optional UserSessionStorer.
+func testUserSessions(t *testing.T, s crowd.Storer) {
+	us, ok := s.(crowd.UserSessionStorer)
+	if !ok {
+		t.Skip("Storer doesn't implement UserSessionStorer")
+	}
+	put := func(id string, userID uint64) {
+		err := s.PutSession(&crowd.StoredSession{ID: id, UserID: userID})
+		if err != nil {
+			t.Fatal("PutSession:", err)
+		}
+	}
+	put("a1", 1)
+	put("a2", 1)
+	put("a3", 1)
+	put("b1", 2)
+	put("anon", 0)
+	checkUserSessions(t, us, 1, "a1", "a2", "a3")
+	checkUserSessions(t, us, 2, "b1")
+	checkUserSessions(t, us, 3)
+
+	// moving a session to another user
+	put("a3", 2)
+	checkUserSessions(t, us, 1, "a1", "a2")
+	checkUserSessions(t, us, 2, "a3", "b1")
+
+	if err := s.DeleteSession("a1"); err != nil {
+		t.Fatal("DeleteSession:", err)
+	}
+	checkUserSessions(t, us, 1, "a2")
+
+	err := s.ForEachSession(func(sess *crowd.StoredSession) bool {
+		return sess.ID == "b1"
+	})
+	if err != nil {
+		t.Fatal("ForEachSession:", err)
+	}
+	checkUserSessions(t, us, 2, "a3")
+}
+
+func checkUserSessions(t *testing.T, us crowd.UserSessionStorer, userID uint64, want ...string) {
+	t.Helper()
+	sessions, err := us.GetUserSessions(userID)
+	if err != nil {
+		t.Fatal("GetUserSessions:", err)
+	}
+	var got []string
+	for _, sess := range sessions {
+		if sess.UserID != userID {
+			t.Errorf("GetUserSessions(%d) returned session %q of user %d", userID, sess.ID, sess.UserID)
+		}
+		got = append(got, sess.ID)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetUserSessions(%d): expected %v, got %v", userID, want, got)
+	}
+}
+
+func testGroups(t *testing.T, s crowd.Storer) {
+	gs, ok := s.(crowd.GroupStorer)
+	if !ok {
+		t.Skip("Storer doesn't implement GroupStorer")
+	}
+	if _, err := gs.GetGroup(1); err != crowd.ErrGroupNotFound {
+		t.Errorf("GetGroup: expected ErrGroupNotFound, got %v", err)
+	}
+	if _, err := gs.GetGroupID("missing"); err != crowd.ErrGroupNotFound {
+		t.Errorf("GetGroupID: expected ErrGroupNotFound, got %v", err)
+	}
+	if err := gs.DeleteGroup(1); err != crowd.ErrGroupNotFound {
+		t.Errorf("DeleteGroup: expected ErrGroupNotFound, got %v", err)
+	}
+
+	a := &crowd.Group{Name: "a", Members: []crowd.GroupMember{
+		{UserID: 1, Owner: true},
+		{UserID: 2, Roles: []string{"editor"}},
+	}}
+	id, err := gs.AddGroup(a)
+	if err != nil {
+		t.Fatal("AddGroup:", err)
+	}
+	if id != 1 || a.ID != 1 {
+		t.Errorf("AddGroup: expected ID 1, got %d and %d", id, a.ID)
+	}
+	if _, err = gs.AddGroup(&crowd.Group{Name: "a"}); err != crowd.ErrGroupExists {
+		t.Errorf("AddGroup with existing name: expected ErrGroupExists, got %v", err)
+	}
+	b := &crowd.Group{Name: "b", Members: []crowd.GroupMember{{UserID: 2, Owner: true}}}
+	if _, err = gs.AddGroup(b); err != nil {
+		t.Fatal("AddGroup:", err)
+	}
+	got, err := gs.GetGroup(a.ID)
+	if err != nil {
+		t.Fatal("GetGroup:", err)
+	}
+	checkGroup(t, got, a)
+	checkUserGroups(t, gs, 1, "a")
+	checkUserGroups(t, gs, 2, "a", "b")
+
+	// members and names are updated by PutGroup
+	a.Name = "c"
+	a.Members = []crowd.GroupMember{{UserID: 1, Owner: true, Roles: []string{"admin"}}}
+	if err = gs.PutGroup(a); err != nil {
+		t.Fatal("PutGroup:", err)
+	}
+	got, err = gs.GetGroup(a.ID)
+	if err != nil {
+		t.Fatal("GetGroup:", err)
+	}
+	checkGroup(t, got, a)
+	if id, err = gs.GetGroupID("c"); err != nil || id != a.ID {
+		t.Errorf("GetGroupID: expected %d, got %d %v", a.ID, id, err)
+	}
+	if _, err = gs.GetGroupID("a"); err != crowd.ErrGroupNotFound {
+		t.Errorf("GetGroupID of old name: expected ErrGroupNotFound, got %v", err)
+	}
+	checkUserGroups(t, gs, 2, "b")
+	a.Name = "b"
+	if err = gs.PutGroup(a); err != crowd.ErrGroupExists {
+		t.Errorf("PutGroup with existing name: expected ErrGroupExists, got %v", err)
+	}
+
+	if err = gs.DeleteGroup(b.ID); err != nil {
+		t.Fatal("DeleteGroup:", err)
+	}
+	checkUserGroups(t, gs, 2)
+	if _, err = gs.GetGroupID("b"); err != crowd.ErrGroupNotFound {
+		t.Errorf("GetGroupID of deleted group: expected ErrGroupNotFound, got %v", err)
+	}
+}
+
+func testTokens(t *testing.T, s crowd.Storer) {
+	ts, ok := s.(crowd.TokenStorer)
+	if !ok {
+		t.Skip("Storer doesn't implement TokenStorer")
+	}
+	if _, err := ts.GetToken("missing"); err != crowd.ErrTokenNotFound {
+		t.Errorf("GetToken: expected ErrTokenNotFound, got %v", err)
+	}
+	if _, err := ts.TakeToken("missing"); err != crowd.ErrTokenNotFound {
+		t.Errorf("TakeToken: expected ErrTokenNotFound, got %v", err)
+	}
+	if err := ts.DeleteToken("missing"); err != nil {
+		t.Errorf("DeleteToken of missing token: %v", err)
+	}
+
+	now := time.Now().Round(0)
+	a := &crowd.StoredToken{ID: "a", Kind: "invite", UserID: 1,
+		Expires: now.Add(time.Hour), Data: []byte(`{"x":1}`)}
+	b := &crowd.StoredToken{ID: "b", Kind: "reset", UserID: 2, Expires: now.Add(-time.Hour)}
+	for _, tok := range []*crowd.StoredToken{a, b} {
+		if err := ts.PutToken(tok); err != nil {
+			t.Fatal("PutToken:", err)
+		}
+	}
+	got, err := ts.GetToken("a")
+	if err != nil {
+		t.Fatal("GetToken:", err)
+	}
+	checkToken(t, got, a)
+
+	got, err = ts.TakeToken("a")
+	if err != nil {
+		t.Fatal("TakeToken:", err)
+	}
+	checkToken(t, got, a)
+	if _, err = ts.TakeToken("a"); err != crowd.ErrTokenNotFound {
+		t.Errorf("TakeToken twice: expected ErrTokenNotFound, got %v", err)
+	}
+
+	if err = ts.PutToken(a); err != nil {
+		t.Fatal("PutToken:", err)
+	}
+	var seen []string
+	err = ts.ForEachToken(func(tok *crowd.StoredToken) bool {
+		seen = append(seen, tok.ID)
+		return tok.ID == "b"
+	})
+	if err != nil {
+		t.Fatal("ForEachToken:", err)
+	}
+	sort.Strings(seen)
+	if fmt.Sprint(seen) != "[a b]" {
+		t.Errorf("ForEachToken: expected [a b], got %v", seen)
+	}
+	if _, err = ts.GetToken("b"); err != crowd.ErrTokenNotFound {
+		t.Errorf("GetToken of deleted token: expected ErrTokenNotFound, got %v", err)
+	}
+	if err = ts.DeleteToken("a"); err != nil {
+		t.Fatal("DeleteToken:", err)
+	}
+	if _, err = ts.GetToken("a"); err != crowd.ErrTokenNotFound {
+		t.Errorf("GetToken of deleted token: expected ErrTokenNotFound, got %v", err)
+	}
+
+	// only one of many concurrent callers may take a token
+	if err = ts.PutToken(a); err != nil {
+		t.Fatal("PutToken:", err)
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	taken := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ts.TakeToken("a"); err == nil {
+				mutex.Lock()
+				taken++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 1 {
+		t.Errorf("TakeToken: token was taken %d times", taken)
+	}
+
+}
+
+func testUniqueTokens(t *testing.T, s crowd.Storer) {
+	ts, ok := s.(crowd.TokenStorer)
+	us, unique := s.(crowd.UniqueTokenStorer)
+	if !ok || !unique {
+		t.Skip("Storer doesn't implement UniqueTokenStorer")
+	}
+	a := &crowd.StoredToken{ID: "a", Kind: "invite", UserID: 1,
+		Expires: time.Now().Round(0).Add(time.Hour), Data: []byte(`{"x":1}`)}
+	if err := us.AddToken(a); err != nil {
+		t.Fatal("AddToken:", err)
+	}
+	if err := us.AddToken(a); err != crowd.ErrTokenExists {
+		t.Errorf("AddToken twice: expected ErrTokenExists, got %v", err)
+	}
+	if err := ts.DeleteToken("a"); err != nil {
+		t.Fatal("DeleteToken:", err)
+	}
+
+	// only one of many concurrent callers may add a token
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	added := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := us.AddToken(a)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				added++
+			} else if err != crowd.ErrTokenExists {
+				t.Errorf("AddToken: expected ErrTokenExists, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Errorf("AddToken: token was added %d times", added)
+	}
+	got, err := ts.GetToken("a")
+	if err != nil {
+		t.Fatal("GetToken:", err)
+	}
+	checkToken(t, got, a)
+}
+
+func testUserTokens(t *testing.T, s crowd.Storer) {
+	ts, ok := s.(crowd.TokenStorer)
+	us, indexed := s.(crowd.UserTokenStorer)
+	if !ok || !indexed {
+		t.Skip("Storer doesn't implement UserTokenStorer")
+	}
+	put := func(id string, userID uint64) {
+		err := ts.PutToken(&crowd.StoredToken{ID: id, Kind: "refresh", UserID: userID,
+			Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal("PutToken:", err)
+		}
+	}
+	put("a1", 1)
+	put("a2", 1)
+	put("a3", 1)
+	put("a4", 1)
+	put("b1", 2)
+	put("anon", 0)
+	checkUserTokens(t, us, 1, "a1", "a2", "a3", "a4")
+	checkUserTokens(t, us, 2, "b1")
+	checkUserTokens(t, us, 3)
+
+	// moving a token to another user
+	put("a3", 2)
+	checkUserTokens(t, us, 1, "a1", "a2", "a4")
+	checkUserTokens(t, us, 2, "a3", "b1")
+
+	if err := ts.DeleteToken("a1"); err != nil {
+		t.Fatal("DeleteToken:", err)
+	}
+	if _, err := ts.TakeToken("a2"); err != nil {
+		t.Fatal("TakeToken:", err)
+	}
+	checkUserTokens(t, us, 1, "a4")
+
+	if u, ok := s.(crowd.UniqueTokenStorer); ok {
+		err := u.AddToken(&crowd.StoredToken{ID: "a5", Kind: "refresh", UserID: 1,
+			Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal("AddToken:", err)
+		}
+		checkUserTokens(t, us, 1, "a4", "a5")
+		if err = ts.DeleteToken("a5"); err != nil {
+			t.Fatal("DeleteToken:", err)
+		}
+	}
+
+	err := ts.ForEachToken(func(tok *crowd.StoredToken) bool {
+		return tok.ID == "b1"
+	})
+	if err != nil {
+		t.Fatal("ForEachToken:", err)
+	}
+	checkUserTokens(t, us, 2, "a3")
+}
+
+func checkUserTokens(t *testing.T, us crowd.UserTokenStorer, userID uint64, want ...string) {
+	t.Helper()
+	tokens, err := us.GetUserTokens(userID)
+	if err != nil {
+		t.Fatal("GetUserTokens:", err)
+	}
+	var got []string
+	for _, tok := range tokens {
+		if tok.UserID != userID {
+			t.Errorf("GetUserTokens(%d) returned token %q of user %d", userID, tok.ID, tok.UserID)
+		}
+		got = append(got, tok.ID)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetUserTokens(%d): expected %v, got %v", userID, want, got)
+	}
+}
+
+func testEmails(t *testing.T, s crowd.Storer) {
+	es, ok := s.(crowd.EmailStorer)
+	if !ok {
+		t.Skip("Storer doesn't implement EmailStorer")
+	}
+	if _, err := es.GetUserIDByEmail("a@example.com"); err != crowd.ErrUserNotFound {
+		t.Errorf("GetUserIDByEmail: expected ErrUserNotFound, got %v", err)
+	}
+
+	a := &crowd.StoredUser{Name: "a", Email: "a@example.com", Verified: true}
+	aid, err := s.AddUser(a)
+	if err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	b := &crowd.StoredUser{Name: "b"}
+	bid, err := s.AddUser(b)
+	if err != nil {
+		t.Fatal("AddUser:", err)
+	}
+	// users without an email don't conflict
+	if _, err = s.AddUser(&crowd.StoredUser{Name: "c"}); err != nil {
+		t.Fatal("AddUser without email:", err)
+	}
+	got, err := s.GetUser(aid)
+	if err != nil {
+		t.Fatal("GetUser:", err)
+	}
+	checkUser(t, got, a)
+	checkEmail(t, es, "a@example.com", aid)
+
+	if _, err = s.AddUser(&crowd.StoredUser{Name: "d", Email: "a@example.com", Verified: true}); err != crowd.ErrEmailExists {
+		t.Errorf("AddUser with existing email: expected ErrEmailExists, got %v", err)
+	}
+	b.Email = "a@example.com"
+	b.Verified = true
+	if err = s.PutUser(b); err != crowd.ErrEmailExists {
+		t.Errorf("PutUser with existing email: expected ErrEmailExists, got %v", err)
+	}
+	// unverified addresses are not indexed and don't conflict
+	b.Verified = false
+	if err = s.PutUser(b); err != nil {
+		t.Fatal("PutUser with unverified email:", err)
+	}
+	checkEmail(t, es, "a@example.com", aid)
+	b.Email = "b@example.com"
+	if err = s.PutUser(b); err != nil {
+		t.Fatal("PutUser:", err)
+	}
+	checkEmail(t, es, "b@example.com", 0)
+	b.Verified = true
+	if err = s.PutUser(b); err != nil {
+		t.Fatal("PutUser:", err)
+	}
+	checkEmail(t, es, "b@example.com", bid)
+	got, err = s.GetUser(bid)
+	if err != nil {
+		t.Fatal("GetUser:", err)
+	}
+	checkUser(t, got, b)
+
+	// changing the email frees the old one
+	a.Email = "new@example.com"
+	if err = s.PutUser(a); err != nil {
+		t.Fatal("PutUser:", err)
+	}
+	checkEmail(t, es, "new@example.com", aid)
+	checkEmail(t, es, "a@example.com", 0)
+
+	// the email survives a rename
+	if err = s.RenameUser(aid, "renamed"); err != nil {
+		t.Fatal("RenameUser:", err)
+	}
+	checkEmail(t, es, "new@example.com", aid)
+
+	if err = s.DeleteUser(aid); err != nil {
+		t.Fatal("DeleteUser:", err)
+	}
+	checkEmail(t, es, "new@example.com", 0)
+	err = s.ForEachUser(func(u *crowd.StoredUser) bool {
+		return u.ID == bid
+	})
+	if err != nil {
+		t.Fatal("ForEachUser:", err)
+	}
+	checkEmail(t, es, "b@example.com", 0)
+	if _, err = s.AddUser(&crowd.StoredUser{Name: "e", Email: "b@example.com"}); err != nil {
+		t.Errorf("AddUser with email of a deleted user: %v", err)
+	}
+}
+
+// checkEmail checks that email belongs to the user with id, or to no user
+// if id is 0.
+func checkEmail(t *testing.T, es crowd.EmailStorer, email string, id uint64) {
+	t.Helper()
+	uid, err := es.GetUserIDByEmail(email)
+	if id == 0 {
+		if err != crowd.ErrUserNotFound {
+			t.Errorf("GetUserIDByEmail(%q): expected ErrUserNotFound, got %d %v", email, uid, err)
+		}
+		return
+	}
+	if err != nil || uid != id {
+		t.Errorf("GetUserIDByEmail(%q): expected %d, got %d %v", email, id, uid, err)
+	}
+}
+
+func checkToken(t *testing.T, got, want *crowd.StoredToken) {
+	t.Helper()
+	if got.ID != want.ID || got.Kind != want.Kind || got.UserID != want.UserID ||
+		!got.Expires.Equal(want.Expires) || string(got.Data) != string(want.Data) {
+		t.Errorf("got token %+v, expected %+v", got, want)
+	}
+}
+
+func checkGroup(t *testing.T, got, want *crowd.Group) {
+	t.Helper()
+	if got.ID != want.ID || got.Name != want.Name ||
+		fmt.Sprint(got.Members) != fmt.Sprint(want.Members) {
+		t.Errorf("got group %+v, expected %+v", got, want)
+	}
+}
+
+func checkUserGroups(t *testing.T, gs crowd.GroupStorer, userID uint64, want ...string) {
+	t.Helper()
+	groups, err := gs.GetUserGroups(userID)
+	if err != nil {
+		t.Fatal("GetUserGroups:", err)
+	}
+	var got []string
+	for _, g := range groups {
+		got = append(got, g.Name)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetUserGroups(%d): expected %v, got %v", userID, want, got)
+	}
+}
+
+func checkSession(t *testing.T, got, want *crowd.StoredSession) {
+	t.Helper()
+	if got.ID != want.ID ||
+		got.LoggedIn != want.LoggedIn ||
+		got.UserID != want.UserID ||
+		got.SecondFactorPending != want.SecondFactorPending ||
+		got.FixedExpiry != want.FixedExpiry ||
+		!got.Expires.Equal(want.Expires) ||
+		!got.LastAccess.Equal(want.LastAccess) {
+		t.Errorf("got session %+v, expected %+v", got, want)
+	}
+}
+
+func checkUser(t *testing.T, got, want *crowd.StoredUser) {
+	t.Helper()
+	if got.ID != want.ID ||
+		got.Name != want.Name ||
+		got.Email != want.Email ||
+		got.Verified != want.Verified ||
+		string(got.Pass) != string(want.Pass) ||
+		string(got.Salt) != string(want.Salt) ||
+		got.Data != want.Data ||
+		fmt.Sprint(got.Roles) != fmt.Sprint(want.Roles) ||
+		fmt.Sprint(got.Permissions) != fmt.Sprint(want.Permissions) ||
+		got.InvitedBy != want.InvitedBy ||
+		string(got.TOTPSecret) != string(want.TOTPSecret) ||
+		string(got.TOTPPending) != string(want.TOTPPending) ||
+		got.TOTPLastStep != want.TOTPLastStep ||
+		fmt.Sprintf("%x", got.RecoveryCodes) != fmt.Sprintf("%x", want.RecoveryCodes) {
+		t.Errorf("got user %+v, expected %+v", got, want)
+	}
+}
+
+// checkName checks that the user with id is only found by newname.
+func checkName(t *testing.T, s crowd.Storer, id uint64, oldname, newname string) {
+	t.Helper()
+	u, err := s.GetUser(id)
+	if err != nil {
+		t.Fatal("GetUser:", err)
+	}
+	if u.Name != newname {
+		t.Errorf("GetUser: expected name %q, got %q", newname, u.Name)
+	}
+	uid, err := s.GetUserID(newname)
+	if err != nil || uid != id {
+		t.Errorf("GetUserID(%q): expected %d, got %d %v", newname, id, uid, err)
+	}
+	if _, err = s.GetUserID(oldname); err != crowd.ErrUserNotFound {
+		t.Errorf("GetUserID(%q): expected ErrUserNotFound, got %v", oldname, err)
+	}
+}
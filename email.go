@@ -0,0 +1,302 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	tokenKindEmailVerification  = "email_verification"
+	defaultEmailVerificationTTL = time.Hour * 24
+)
+
+var (
+	// ErrEmailsNotSupported is returned by the email methods of a Store
+	// whose backend doesn't implement EmailStorer.
+	ErrEmailsNotSupported = errors.New("Emails not supported by the store backend")
+
+	// ErrEmailExists is returned when an email address is set that
+	// already belongs to another user.
+	ErrEmailExists = errors.New("Email already exists")
+
+	// ErrEmailInvalid is returned for malformed email addresses.
+	ErrEmailInvalid = errors.New("Email is invalid")
+
+	// ErrEmailNotSet is returned when an email address is expected, but
+	// the user has none.
+	ErrEmailNotSet = errors.New("Email not set")
+
+	// ErrVerifyTokenInvalid is returned when an email verification token
+	// doesn't exist, was already used or belongs to a previous address.
+	ErrVerifyTokenInvalid = errors.New("Email verification token is invalid")
+
+	// ErrVerifyTokenExpired is returned when an email verification token
+	// is expired.
+	ErrVerifyTokenExpired = errors.New("Email verification token is expired")
+)
+
+// EmailStorer is an optional interface for Storer backends that keep an
+// index of the verified StoredUser.Email addresses. Like names, verified
+// email addresses are unique: PutUser and AddUser need to return
+// ErrEmailExists if the Email of a Verified user belongs to another
+// verified user. Unverified addresses are not indexed, so that nobody can
+// block an address by claiming it without owning it.
+type EmailStorer interface {
+	// If no user has the verified email, error needs to be ErrUserNotFound
+	GetUserIDByEmail(email string) (uint64, error)
+}
+
+// UserEmailGet gets the User by its verified email address. If no user
+// has verified the address ErrUserNotFound is returned.
+func (s *Store) UserEmailGet(email string) (*User, error) {
+	es, err := s.emailStorer()
+	if err != nil {
+		return nil, err
+	}
+	email, err = normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.emailUserID(es, email)
+	if err != nil {
+		return nil, err
+	}
+	return s.UserIDGet(id)
+}
+
+// CookieSetEmail sets the email address of the current user. If there is
+// no current user logged in ErrNotLoggedIn is returned. See UserIDSetEmail.
+func (s *Store) CookieSetEmail(w http.ResponseWriter, r *http.Request, email string) (*User, error) {
+	u, changed, err := s.setEmailID(s.getCookieID(r), email)
+	if changed {
+		s.saveCookie(w, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// IDSetEmail sets the email address of the current user. If there is
+// no current user logged in ErrNotLoggedIn is returned. See UserIDSetEmail.
+//
+// It is the callers responsibility to pass the session token (User.ID) back
+// to the client.
+func (s *Store) IDSetEmail(id string, email string) (*User, error) {
+	u, _, err := s.setEmailID(id, email)
+	return makeUser(u), err
+}
+
+// UserIDSetEmail sets the email address of the user with the given ID.
+// The address is stored in lower case and an empty address removes it.
+// If the address changes, it is not verified anymore. ErrEmailExists is
+// returned if another user has verified the address and ErrEmailInvalid if
+// it can't be parsed. Other users can set the same address until one of
+// them verifies it.
+func (s *Store) UserIDSetEmail(id uint64, email string) (*User, error) {
+	u, err := s.setEmail(id, email)
+	if err != nil {
+		return nil, err
+	}
+	return makeUser(u), nil
+}
+
+func (s *Store) setEmailID(id string, email string) (*StoredUser, bool, error) {
+	sess, changed, err := s.getSessionID(id)
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	if !sess.LoggedIn {
+		return &StoredUser{StoredSession: sess}, changed, ErrNotLoggedIn
+	}
+	u, err := s.setEmail(sess.UserID, email)
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	u.StoredSession = sess
+	return u, changed, nil
+}
+
+func (s *Store) setEmail(id uint64, email string) (*StoredUser, error) {
+	es, err := s.emailStorer()
+	if err != nil {
+		return nil, err
+	}
+	if email != "" {
+		email, err = normalizeEmail(email)
+		if err != nil {
+			return nil, err
+		}
+		other, err := s.emailUserID(es, email)
+		if err == nil && other != id {
+			return nil, ErrEmailExists
+		}
+		if err != nil && err != ErrUserNotFound {
+			return nil, err
+		}
+	}
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Email == email {
+		return u, nil
+	}
+	next := *u
+	next.Email = email
+	next.Verified = false
+	err = s.store.PutUser(&next)
+	if err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// RequestEmailVerification sends a single use token to the email address
+// of the user with the given ID through the Notifier of the Store. The
+// token expires after the TTL that is set with WithEmailVerificationTTL
+// and is only valid as long as the address doesn't change. It returns
+// ErrEmailNotSet if the user has no address.
+func (s *Store) RequestEmailVerification(id uint64) error {
+	if s.notifier == nil {
+		return ErrNoNotifier
+	}
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if u.Email == "" {
+		return ErrEmailNotSet
+	}
+	return s.notify(NotifyEmailVerification, tokenKindEmailVerification, u, s.verifyTTL, u.Email)
+}
+
+// VerifyEmail marks the email address of the user as verified with a token
+// that was sent by RequestEmailVerification. The token is used up. It
+// returns ErrVerifyTokenInvalid or ErrVerifyTokenExpired for invalid
+// tokens and ErrEmailExists if another user verified the address first.
+func (s *Store) VerifyEmail(token string) (*User, error) {
+	t, err := s.takeToken(tokenKindEmailVerification, token)
+	switch err {
+	case ErrTokenNotFound:
+		return nil, ErrVerifyTokenInvalid
+	case errTokenExpired:
+		return nil, ErrVerifyTokenExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	var email string
+	err = json.Unmarshal(t.Data, &email)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.store.GetUser(t.UserID)
+	if err == ErrUserNotFound {
+		return nil, ErrVerifyTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Email != email {
+		return nil, ErrVerifyTokenInvalid
+	}
+	if !u.Verified {
+		u.Verified = true
+		err = s.store.PutUser(u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.emit(Event{
+		Type:   EventEmailVerified,
+		UserID: u.ID,
+		Detail: email,
+	})
+	return makeUser(u), nil
+}
+
+// RequireVerifiedEmail only passes requests of logged in users with a
+// verified email address to next. It works like RequireRole.
+func (s *Store) RequireVerifiedEmail(next http.Handler) http.Handler {
+	return s.requireUser(func(u *User) bool {
+		return u.Verified
+	})(next)
+}
+
+// loginUserID returns the ID of the user with the login, which is looked
+// up as a verified email address first if it contains an @ and the backend
+// implements EmailStorer. Usernames that contain an @ still work, unless
+// another user has verified them as email address.
+func (s *Store) loginUserID(login string) (uint64, error) {
+	if es, ok := s.store.(EmailStorer); ok && strings.Contains(login, "@") {
+		email, err := normalizeEmail(login)
+		if err == nil {
+			id, err := s.emailUserID(es, email)
+			if err != ErrUserNotFound {
+				return id, err
+			}
+		}
+	}
+	return s.store.GetUserID(login)
+}
+
+// emailUserID returns the ID of the user who verified the email. The user
+// is checked, so that an outdated index entry of a backend can't resolve
+// an unverified address.
+func (s *Store) emailUserID(es EmailStorer, email string) (uint64, error) {
+	id, err := es.GetUserIDByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		return 0, err
+	}
+	if indexedEmail(u) != email {
+		return 0, ErrUserNotFound
+	}
+	return id, nil
+}
+
+// indexedEmail returns the email of u if it is verified, which is the
+// address that EmailStorer backends index.
+func indexedEmail(u *StoredUser) string {
+	if !u.Verified {
+		return ""
+	}
+	return u.Email
+}
+
+func (s *Store) emailStorer() (EmailStorer, error) {
+	es, ok := s.store.(EmailStorer)
+	if !ok {
+		return nil, ErrEmailsNotSupported
+	}
+	return es, nil
+}
+
+// normalizeEmail returns the plain address in lower case. Addresses with
+// a display name like "Alice <alice@example.com>" are invalid.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", ErrEmailInvalid
+	}
+	return strings.ToLower(email), nil
+}
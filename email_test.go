@@ -0,0 +1,189 @@
+package crowd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEmail(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UserNameRegister("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"alice", "Alice <alice@example.com>", "alice@"} {
+		if _, err = store.UserIDSetEmail(1, email); err != ErrEmailInvalid {
+			t.Errorf("expected ErrEmailInvalid for %q, got %v", email, err)
+		}
+	}
+	u, err := store.UserIDSetEmail(1, " Alice@Example.com ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "alice@example.com" || u.Verified {
+		t.Errorf("unexpected user %+v", u)
+	}
+	// unverified addresses don't block other users and don't resolve logins
+	if _, err = store.UserIDSetEmail(2, "alice@example.com"); err != nil {
+		t.Errorf("unverified email blocks other users: %v", err)
+	}
+	if _, err = store.UserEmailGet("alice@example.com"); err != ErrUserNotFound {
+		t.Errorf("UserEmailGet: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err = store.IDLogin("", "alice@example.com", "secret"); err != ErrLoginWrong {
+		t.Errorf("login with unverified email: expected ErrLoginWrong, got %v", err)
+	}
+	if _, err = store.UserIDSetEmail(2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	setVerifiedEmail(t, store, 1, "alice@example.com")
+	if _, err = store.UserIDSetEmail(2, "ALICE@example.com"); err != ErrEmailExists {
+		t.Errorf("expected ErrEmailExists, got %v", err)
+	}
+	u, err = store.UserEmailGet("alice@EXAMPLE.com")
+	if err != nil || u.Name != "alice" {
+		t.Errorf("UserEmailGet: got %+v %v", u, err)
+	}
+	if _, err = store.UserEmailGet("bob@example.com"); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// login works with the username and the email
+	for _, login := range []string{"alice", "Alice@example.com"} {
+		u, err = store.IDLogin("", login, "secret")
+		if err != nil || u.Session.UserID != 1 {
+			t.Errorf("login as %q: got %+v %v", login, u, err)
+		}
+	}
+	if _, err = store.IDLogin("", "alice@example.com", "wrong"); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong, got %v", err)
+	}
+	if _, err = store.IDLogin("", "bob@example.com", "secret"); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong, got %v", err)
+	}
+
+	u, err = store.IDSetEmail(u.Session.ID, "")
+	if err != nil || u.Email != "" {
+		t.Errorf("removing the email: got %+v %v", u, err)
+	}
+	if _, err = store.UserIDSetEmail(2, "alice@example.com"); err != nil {
+		t.Errorf("email of alice is still taken: %v", err)
+	}
+	if _, err = store.IDSetEmail("", "alice@example.com"); err != ErrNotLoggedIn {
+		t.Errorf("expected ErrNotLoggedIn, got %v", err)
+	}
+}
+
+// setVerifiedEmail sets the email of the user with the ID and marks it as
+// verified, like VerifyEmail does.
+func setVerifiedEmail(t *testing.T, store *Store, id uint64, email string) {
+	t.Helper()
+	u, err := store.store.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Email = email
+	u.Verified = true
+	err = store.store.PutUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmailsNotSupported(t *testing.T) {
+	store := NewStore(&userOnlyStorer{NewMemoryStore(WithGCInterval(0)).store}, WithGCInterval(0))
+	if _, err := store.UserEmailGet("alice@example.com"); err != ErrEmailsNotSupported {
+		t.Errorf("expected ErrEmailsNotSupported, got %v", err)
+	}
+	if _, err := store.UserIDSetEmail(1, "alice@example.com"); err != ErrEmailsNotSupported {
+		t.Errorf("expected ErrEmailsNotSupported, got %v", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	var events []Event
+	store := NewMemoryStore(WithNotifier(notifier), WithEventHandler(func(e Event) {
+		events = append(events, e)
+	}))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RequestEmailVerification(1); err != ErrEmailNotSet {
+		t.Errorf("expected ErrEmailNotSet, got %v", err)
+	}
+	if _, err = store.UserIDSetEmail(1, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RequestEmailVerification(1); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := notifier.Last()
+	if !ok || n.Type != NotifyEmailVerification || n.Email != "alice@example.com" {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	guarded := store.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: u.Session.ID})
+	w := httptest.NewRecorder()
+	guarded.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 before verification, got %d", w.Code)
+	}
+
+	u, err = store.VerifyEmail(n.Token)
+	if err != nil || !u.Verified {
+		t.Fatalf("VerifyEmail: got %+v %v", u, err)
+	}
+	if len(events) != 1 || events[0].Type != EventEmailVerified || events[0].Detail != "alice@example.com" {
+		t.Errorf("unexpected events %v", events)
+	}
+	if _, err = store.VerifyEmail(n.Token); err != ErrVerifyTokenInvalid {
+		t.Errorf("expected ErrVerifyTokenInvalid for a used token, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	guarded.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 after verification, got %d", w.Code)
+	}
+
+	// a token for a previous address is invalid and a new address is
+	// not verified
+	if err = store.RequestEmailVerification(1); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = notifier.Last()
+	u, err = store.UserIDSetEmail(1, "alice@example.org")
+	if err != nil || u.Verified {
+		t.Errorf("changed email: got %+v %v", u, err)
+	}
+	if _, err = store.VerifyEmail(n.Token); err != ErrVerifyTokenInvalid {
+		t.Errorf("expected ErrVerifyTokenInvalid for a previous address, got %v", err)
+	}
+
+	expired := NewStore(store.store, WithNotifier(notifier), WithEmailVerificationTTL(-time.Second))
+	defer expired.StopSessionGC()
+	if err = expired.RequestEmailVerification(1); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = notifier.Last()
+	if _, err = store.VerifyEmail(n.Token); err != ErrVerifyTokenExpired {
+		t.Errorf("expected ErrVerifyTokenExpired, got %v", err)
+	}
+}
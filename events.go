@@ -0,0 +1,82 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+// EventType describes what happened in an Event.
+type EventType int
+
+const (
+	// EventPasswordUpgraded is emitted when the password hash of a user was
+	// replaced during login, because it didn't match the current
+	// PasswordHasher. Detail holds the old and new algorithm.
+	EventPasswordUpgraded EventType = iota + 1
+
+	// EventUserDeleted is emitted after a user and their sessions were
+	// deleted. Detail holds the number of revoked sessions.
+	EventUserDeleted
+
+	// EventRecoveryCodeUsed is emitted after a user logged in with a
+	// recovery code. Detail holds the number of remaining codes.
+	EventRecoveryCodeUsed
+
+	// EventPasswordReset is emitted after a password was reset with a
+	// token. Detail holds the number of revoked sessions.
+	EventPasswordReset
+
+	// EventEmailVerified is emitted after a user confirmed their email
+	// address. Detail holds the address.
+	EventEmailVerified
+
+	// EventUserLockedOut is emitted when failed logins of a user reached
+	// the lockout limit of the LoginThrottle. Detail holds the number of
+	// failed logins.
+	EventUserLockedOut
+
+	// EventRefreshTokenReused is emitted when a refresh token was presented
+	// that was already rotated, which revokes its whole family. Detail
+	// holds the number of revoked sessions.
+	EventRefreshTokenReused
+)
+
+var eventTypeNames = map[EventType]string{
+	EventPasswordUpgraded:   "PasswordUpgraded",
+	EventUserDeleted:        "UserDeleted",
+	EventRecoveryCodeUsed:   "RecoveryCodeUsed",
+	EventPasswordReset:      "PasswordReset",
+	EventEmailVerified:      "EmailVerified",
+	EventUserLockedOut:      "UserLockedOut",
+	EventRefreshTokenReused: "RefreshTokenReused",
+}
+
+func (t EventType) String() string {
+	name, ok := eventTypeNames[t]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// Event is passed to the event handler of a Store to report things that
+// happened as a side effect of other calls.
+type Event struct {
+	Type   EventType
+	UserID uint64
+	Detail string
+}
+
+func (s *Store) emit(e Event) {
+	if s.onEvent != nil {
+		s.onEvent(e)
+	}
+}
@@ -19,8 +19,8 @@ import (
 	"log"
 	"net/http"
 
-	"github.com/boltdb/bolt"
 	"github.com/mbertschler/crowd"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
@@ -34,13 +34,13 @@ type stringStore struct {
 	*crowd.Store
 }
 
-func (s stringStore) CookieGetData(w http.ResponseWriter, r *http.Request) (*crowd.User, string, error) {
-	u, err := s.CookieGet(w, r)
+func (s stringStore) RequestData(r *http.Request) (*crowd.User, string) {
+	u, _ := crowd.UserFromContext(r.Context())
 	data, ok := u.Data.(string)
 	if !ok {
 		data = "&nbsp;"
 	}
-	return u, data, err
+	return u, data
 }
 
 func main() {
@@ -53,16 +53,17 @@ func main() {
 	if path == "" {
 		userStore = stringStore{crowd.NewMemoryStore()}
 	} else {
-		// var err error
-		// db, err = bolt.Open(path, 0644, nil)
-		// if err != nil {
-		// 	log.Fatal("bolt.Open error:", err)
-		// }
-		// store, err := crowd.NewBoltDBStore(db)
-		// if err != nil {
-		// 	log.Fatal("crowd.NewBoltDBStore error:", err)
-		// }
-		// userStore = stringStore{store}
+		var err error
+		db, err = bolt.Open(path, 0644, nil)
+		if err != nil {
+			log.Fatal("bolt.Open error:", err)
+		}
+		defer db.Close()
+		store, err := crowd.NewBoltDBStore(db)
+		if err != nil {
+			log.Fatal("crowd.NewBoltDBStore error:", err)
+		}
+		userStore = stringStore{store}
 	}
 
 	http.HandleFunc("/", index)
@@ -80,7 +81,7 @@ func main() {
 		log.Println("Saving crowd DB at " + path)
 	}
 	log.Println("------------------------------------------")
-	log.Fatal(http.ListenAndServe(port, nil))
+	log.Fatal(http.ListenAndServe(port, userStore.Middleware(http.DefaultServeMux)))
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
@@ -187,12 +188,7 @@ func save(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 func index(w http.ResponseWriter, r *http.Request) {
-	user, data, err := userStore.CookieGetData(w, r)
-	if err != nil {
-		log.Println("Index error:", err)
-		w.Write(errorPage(fmt.Sprintln("Index error:", err)))
-		return
-	}
+	user, data := userStore.RequestData(r)
 
 	w.Write([]byte(header + `
 		<h1>Testapp for package <a href="https://github.com/mbertschler/crowd">"github.com/mbertschler/crowd"</a></h1>
@@ -0,0 +1,22 @@
+package crowd
+
+import (
+	"database/sql"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The following functions give the tests in package crowd_test access
+// to the unexported Storer implementations.
+
+func NewMemoryStorer() Storer {
+	return NewMemoryStore(WithGCInterval(0)).store
+}
+
+func NewBoltDBStorer(db *bolt.DB) (Storer, error) {
+	return newBoltDBStore(db)
+}
+
+func NewSQLStorer(db *sql.DB) (Storer, error) {
+	return newSQLStore(db)
+}
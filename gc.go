@@ -0,0 +1,165 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Logger is used by the Store to report errors and results of background
+// work like the session GC. *log.Logger implements it. The default is the
+// standard logger of the log package.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// GCStats is the result of a session collection.
+type GCStats struct {
+	// Scanned is the number of sessions that were checked.
+	Scanned int
+	// Deleted is the number of expired sessions that were deleted.
+	Deleted int
+	// Tokens is the number of expired tokens that were deleted, if the
+	// backend implements TokenStorer.
+	Tokens int
+}
+
+// CollectSessions deletes all expired sessions and tokens and returns how
+// many sessions were checked and deleted. It is called regularly by the
+// session GC, but can also be called manually, for example when the
+// automatic GC is disabled. If ctx is canceled the remaining sessions
+// are skipped and ctx.Err() is returned.
+func (s *Store) CollectSessions(ctx context.Context) (GCStats, error) {
+	var stats GCStats
+	now := time.Now()
+	err := s.store.ForEachSession(func(sess *StoredSession) (del bool) {
+		if ctx.Err() != nil {
+			return false
+		}
+		stats.Scanned++
+		if now.After(sess.Expires) {
+			stats.Deleted++
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return stats, err
+	}
+	if ctx.Err() != nil {
+		return stats, ctx.Err()
+	}
+	stats.Tokens, err = s.collectTokens(now)
+	if err != nil {
+		return stats, err
+	}
+	return stats, ctx.Err()
+}
+
+// StartSessionGC starts the session GC that regularly deletes expired
+// sessions. It returns ErrSessionGCRunning if the GC is already running.
+// When a new Store is created the sessionGC is automatically started. If
+// a collection of a previous GC is still running, for example after Close
+// returned early, StartSessionGC waits until it is finished, so that only
+// one collector runs at a time.
+func (s *Store) StartSessionGC() error {
+	s.gcMutex.Lock()
+	defer s.gcMutex.Unlock()
+	if s.gcCancel != nil {
+		return ErrSessionGCRunning
+	}
+	if s.gcDone != nil {
+		<-s.gcDone
+	}
+	interval := s.gcInterval
+	if interval <= 0 {
+		interval = defaultSessionGCInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.gcCancel = cancel
+	s.gcDone = done
+	go s.sessionGC(ctx, done, interval)
+	return nil
+}
+
+// StopSessionGC stops the session GC that regularly deletes expired
+// sessions. It returns ErrSessionGCStopped if the GC is already stopped.
+// It cancels a running collection and waits until the GC has finished,
+// use Close to wait only until a deadline.
+func (s *Store) StopSessionGC() error {
+	s.gcMutex.Lock()
+	defer s.gcMutex.Unlock()
+	if s.gcCancel == nil {
+		return ErrSessionGCStopped
+	}
+	s.gcCancel()
+	s.gcCancel = nil
+	<-s.gcDone
+	return nil
+}
+
+// Close stops the session GC and waits until it has finished or ctx is
+// done. The Store can still be used afterwards, but expired sessions are
+// only deleted by calls to CollectSessions. Close doesn't close the
+// backend of the Store.
+func (s *Store) Close(ctx context.Context) error {
+	s.gcMutex.Lock()
+	if s.gcCancel != nil {
+		s.gcCancel()
+		s.gcCancel = nil
+	}
+	done := s.gcDone
+	s.gcMutex.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Store) sessionGC(ctx context.Context, done chan struct{}, interval time.Duration) {
+	defer close(done)
+	timer := time.NewTimer(s.gcDelay(interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			stats, err := s.CollectSessions(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Printf("Session GC error: %v", err)
+			} else if stats.Deleted > 0 || stats.Tokens > 0 {
+				s.logger.Printf("GCed %d sessions and %d tokens.", stats.Deleted, stats.Tokens)
+			}
+			timer.Reset(s.gcDelay(interval))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// gcDelay returns the interval plus a random jitter, so that the GCs of
+// multiple instances that share a backend don't run at the same time.
+func (s *Store) gcDelay(interval time.Duration) time.Duration {
+	if s.gcJitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(s.gcJitter)))
+}
@@ -0,0 +1,133 @@
+package crowd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollectSessions(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0))
+	now := time.Now()
+	for i, exp := range []time.Duration{-time.Hour, -time.Second, time.Hour} {
+		sess := &StoredSession{ID: string(rune('a' + i)), Expires: now.Add(exp)}
+		if err := store.store.PutSession(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.store.(TokenStorer).PutToken(&StoredToken{ID: "t", Expires: now.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.CollectSessions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 3 || stats.Deleted != 2 || stats.Tokens != 1 {
+		t.Errorf("expected 3 scanned and 2 deleted sessions and 1 token, got %+v", stats)
+	}
+	if _, err = store.store.GetSession("c"); err != nil {
+		t.Error("unexpired session was deleted:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats, err = store.CollectSessions(ctx)
+	if err != context.Canceled || stats.Scanned != 0 {
+		t.Errorf("expected context.Canceled without scanning, got %+v, %v", stats, err)
+	}
+}
+
+func TestSessionGCStartStop(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0))
+	if err := store.StopSessionGC(); err != ErrSessionGCStopped {
+		t.Errorf("expected ErrSessionGCStopped, got %v", err)
+	}
+	if err := store.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				store.StartSessionGC()
+				store.StopSessionGC()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Stop returns after the GC, so that a following Start can't run a
+	// second collector
+	if err := store.StartSessionGC(); err != nil {
+		t.Fatal(err)
+	}
+	done := store.gcDone
+	if err := store.StopSessionGC(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("StopSessionGC returned while the GC was running")
+	}
+
+	if err := store.StartSessionGC(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StartSessionGC(); err != ErrSessionGCRunning {
+		t.Errorf("expected ErrSessionGCRunning, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := store.Close(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := store.StopSessionGC(); err != ErrSessionGCStopped {
+		t.Errorf("expected ErrSessionGCStopped after Close, got %v", err)
+	}
+}
+
+type testLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	l.lines = append(l.lines, format)
+	l.mutex.Unlock()
+}
+
+func TestSessionGCInterval(t *testing.T) {
+	logger := &testLogger{}
+	store := NewMemoryStore(WithGCInterval(time.Millisecond),
+		WithGCJitter(time.Millisecond), WithLogger(logger))
+	err := store.store.PutSession(&StoredSession{ID: "a", Expires: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err = store.store.GetSession("a")
+		if err == ErrSessionNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session was not collected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err = store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if len(logger.lines) != 1 {
+		t.Errorf("expected one log line, got %q", logger.lines)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrGroupsNotSupported is returned by the group methods of a Store
+	// whose backend doesn't implement GroupStorer.
+	ErrGroupsNotSupported = errors.New("Groups not supported by the store backend")
+
+	// ErrGroupNotFound is returned when a store can't find the given group.
+	ErrGroupNotFound = errors.New("Group not found")
+
+	// ErrGroupExists is returned when a new group with a name
+	// that already exists is created.
+	ErrGroupExists = errors.New("Group already exists")
+
+	// ErrNotGroupMember is returned when a user is expected to be
+	// a member of a group.
+	ErrNotGroupMember = errors.New("Not a group member")
+)
+
+// GroupStorer is an optional interface for Storer backends that can store
+// groups. Group IDs need to start at index 1, like user IDs.
+type GroupStorer interface {
+	// Get a Group from the store
+	// If Group is not found, error needs to be ErrGroupNotFound
+	GetGroup(id uint64) (*Group, error)
+	// If Group is not found, error needs to be ErrGroupNotFound
+	GetGroupID(name string) (uint64, error)
+	// Put a Group into the store, including its members
+	// If the name belongs to another group, error needs to be ErrGroupExists
+	PutGroup(g *Group) error
+	// Add a Group to the store and return the new group ID
+	// If the name already exists, error needs to be ErrGroupExists
+	AddGroup(g *Group) (uint64, error)
+	// Delete a Group from the store
+	DeleteGroup(id uint64) error
+	// Get all groups that have the user as a member
+	GetUserGroups(userID uint64) ([]*Group, error)
+}
+
+// Group is a named set of users. Every member can be an owner of the group
+// and can have roles that only apply within the group. Members are sorted
+// by their UserID.
+type Group struct {
+	ID      uint64
+	Name    string
+	Members []GroupMember
+}
+
+// GroupMember is the membership of a user in a Group.
+type GroupMember struct {
+	UserID uint64
+	Owner  bool
+	Roles  []string
+}
+
+// Member returns the membership of the user with the given ID.
+func (g *Group) Member(userID uint64) (*GroupMember, bool) {
+	i := g.memberIndex(userID)
+	if i < 0 {
+		return nil, false
+	}
+	return &g.Members[i], true
+}
+
+// IsMember reports whether the user with the given ID is a member of g.
+func (g *Group) IsMember(userID uint64) bool {
+	return g.memberIndex(userID) >= 0
+}
+
+// IsOwner reports whether the user with the given ID is an owner of g.
+func (g *Group) IsOwner(userID uint64) bool {
+	m, ok := g.Member(userID)
+	return ok && m.Owner
+}
+
+// HasRole reports whether the user with the given ID is a member of g
+// with the role.
+func (g *Group) HasRole(userID uint64, role string) bool {
+	m, ok := g.Member(userID)
+	return ok && hasName(m.Roles, role)
+}
+
+func (g *Group) memberIndex(userID uint64) int {
+	i := sort.Search(len(g.Members), func(i int) bool {
+		return g.Members[i].UserID >= userID
+	})
+	if i < len(g.Members) && g.Members[i].UserID == userID {
+		return i
+	}
+	return -1
+}
+
+// copyGroup returns a copy of g that doesn't share the Members slice.
+func copyGroup(g *Group) *Group {
+	c := *g
+	c.Members = append([]GroupMember(nil), g.Members...)
+	return &c
+}
+
+// CreateGroup creates a new group with the user with the given ID
+// as its owner. If the name already exists ErrGroupExists is returned.
+func (s *Store) CreateGroup(name string, ownerID uint64) (*Group, error) {
+	gs, err := s.groupStorer()
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.store.GetUser(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	g := &Group{
+		Name:    name,
+		Members: []GroupMember{{UserID: ownerID, Owner: true}},
+	}
+	id, err := gs.AddGroup(g)
+	if err != nil {
+		return nil, err
+	}
+	g.ID = id
+	return g, nil
+}
+
+// GroupGet gets the Group by its ID. If the group does not exist
+// ErrGroupNotFound is returned.
+func (s *Store) GroupGet(id uint64) (*Group, error) {
+	gs, err := s.groupStorer()
+	if err != nil {
+		return nil, err
+	}
+	return gs.GetGroup(id)
+}
+
+// GroupNameGet gets the Group by its name. If the group does not exist
+// ErrGroupNotFound is returned.
+func (s *Store) GroupNameGet(name string) (*Group, error) {
+	gs, err := s.groupStorer()
+	if err != nil {
+		return nil, err
+	}
+	id, err := gs.GetGroupID(name)
+	if err != nil {
+		return nil, err
+	}
+	return gs.GetGroup(id)
+}
+
+// DeleteGroup deletes the group with the given ID.
+func (s *Store) DeleteGroup(id uint64) error {
+	gs, err := s.groupStorer()
+	if err != nil {
+		return err
+	}
+	return gs.DeleteGroup(id)
+}
+
+// GroupAddMember adds the user with the given ID to the group. If the user
+// already is a member, the roles are added to the existing membership.
+func (s *Store) GroupAddMember(groupID, userID uint64, roles ...string) (*Group, error) {
+	_, err := s.store.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateGroup(groupID, func(g *Group) error {
+		i := g.memberIndex(userID)
+		if i < 0 {
+			i = sort.Search(len(g.Members), func(i int) bool {
+				return g.Members[i].UserID > userID
+			})
+			g.Members = append(g.Members, GroupMember{})
+			copy(g.Members[i+1:], g.Members[i:])
+			g.Members[i] = GroupMember{UserID: userID}
+		}
+		for _, r := range roles {
+			g.Members[i].Roles, _ = addName(g.Members[i].Roles, r)
+		}
+		return nil
+	})
+}
+
+// GroupRemoveMember removes the user with the given ID from the group.
+// If the user is not a member ErrNotGroupMember is returned.
+func (s *Store) GroupRemoveMember(groupID, userID uint64) (*Group, error) {
+	return s.updateGroup(groupID, func(g *Group) error {
+		i := g.memberIndex(userID)
+		if i < 0 {
+			return ErrNotGroupMember
+		}
+		g.Members = append(g.Members[:i], g.Members[i+1:]...)
+		return nil
+	})
+}
+
+// GroupSetOwner makes the member with the given user ID an owner of the
+// group or revokes the ownership.
+func (s *Store) GroupSetOwner(groupID, userID uint64, owner bool) (*Group, error) {
+	return s.updateMember(groupID, userID, func(m *GroupMember) {
+		m.Owner = owner
+	})
+}
+
+// GroupAddMemberRole assigns a role within the group to the member with
+// the given user ID.
+func (s *Store) GroupAddMemberRole(groupID, userID uint64, role string) (*Group, error) {
+	return s.updateMember(groupID, userID, func(m *GroupMember) {
+		m.Roles, _ = addName(m.Roles, role)
+	})
+}
+
+// GroupRemoveMemberRole revokes a role within the group from the member
+// with the given user ID.
+func (s *Store) GroupRemoveMemberRole(groupID, userID uint64, role string) (*Group, error) {
+	return s.updateMember(groupID, userID, func(m *GroupMember) {
+		m.Roles, _ = removeName(m.Roles, role)
+	})
+}
+
+// IsGroupMember reports whether the user with the given ID is a member
+// of the group.
+func (s *Store) IsGroupMember(groupID, userID uint64) (bool, error) {
+	g, err := s.GroupGet(groupID)
+	if err != nil {
+		return false, err
+	}
+	return g.IsMember(userID), nil
+}
+
+// UserGroups returns all groups that the user with the given ID
+// is a member of.
+func (s *Store) UserGroups(userID uint64) ([]*Group, error) {
+	gs, err := s.groupStorer()
+	if err != nil {
+		return nil, err
+	}
+	return gs.GetUserGroups(userID)
+}
+
+// removeUserFromGroups removes the user from all of its groups. Groups
+// without members are deleted. It does nothing if the backend doesn't
+// support groups.
+func (s *Store) removeUserFromGroups(userID uint64) error {
+	gs, ok := s.store.(GroupStorer)
+	if !ok {
+		return nil
+	}
+	groups, err := gs.GetUserGroups(userID)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		i := g.memberIndex(userID)
+		if i < 0 {
+			continue
+		}
+		g.Members = append(g.Members[:i], g.Members[i+1:]...)
+		if len(g.Members) == 0 {
+			err = gs.DeleteGroup(g.ID)
+		} else {
+			err = gs.PutGroup(g)
+		}
+		if err != nil && err != ErrGroupNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) updateMember(groupID, userID uint64, fn func(m *GroupMember)) (*Group, error) {
+	return s.updateGroup(groupID, func(g *Group) error {
+		m, ok := g.Member(userID)
+		if !ok {
+			return ErrNotGroupMember
+		}
+		fn(m)
+		return nil
+	})
+}
+
+// updateGroup loads the group, calls fn and saves the group if fn
+// returns no error.
+func (s *Store) updateGroup(id uint64, fn func(g *Group) error) (*Group, error) {
+	gs, err := s.groupStorer()
+	if err != nil {
+		return nil, err
+	}
+	g, err := gs.GetGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	err = fn(g)
+	if err != nil {
+		return nil, err
+	}
+	err = gs.PutGroup(g)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (s *Store) groupStorer() (GroupStorer, error) {
+	gs, ok := s.store.(GroupStorer)
+	if !ok {
+		return nil, ErrGroupsNotSupported
+	}
+	return gs, nil
+}
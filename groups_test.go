@@ -0,0 +1,141 @@
+package crowd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	for _, name := range []string{"alice", "bob", "carol"} {
+		_, err := store.UserNameRegister(name, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := store.CreateGroup("team", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CreateGroup("team", 2); err != ErrGroupExists {
+		t.Errorf("expected ErrGroupExists, got %v", err)
+	}
+	if _, err = store.CreateGroup("other", 4); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err = store.GroupAddMember(g.ID, 3, "editor"); err != nil {
+		t.Fatal(err)
+	}
+	g, err = store.GroupAddMember(g.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(g.Members) != "[{1 true []} {2 false []} {3 false [editor]}]" {
+		t.Errorf("unexpected members %v", g.Members)
+	}
+	g, err = store.GroupSetOwner(g.ID, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = store.GroupAddMemberRole(g.ID, 2, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.IsOwner(2) || !g.HasRole(2, "admin") || g.HasRole(3, "admin") {
+		t.Errorf("unexpected members %v", g.Members)
+	}
+	g, err = store.GroupRemoveMemberRole(g.ID, 2, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.HasRole(2, "admin") {
+		t.Errorf("role was not removed: %v", g.Members)
+	}
+
+	_, err = store.GroupRemoveMember(g.ID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GroupRemoveMember(g.ID, 3); err != ErrNotGroupMember {
+		t.Errorf("expected ErrNotGroupMember, got %v", err)
+	}
+	ok, err := store.IsGroupMember(g.ID, 3)
+	if err != nil || ok {
+		t.Errorf("expected carol to be removed, got %v %v", ok, err)
+	}
+	solo, err := store.CreateGroup("solo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := store.UserGroups(1)
+	if err != nil || len(groups) != 2 {
+		t.Errorf("expected 2 groups, got %v %v", groups, err)
+	}
+
+	// deleting a user removes the memberships and empty groups
+	_, err = store.UserIDDelete(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = store.GroupNameGet("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.IsMember(1) || !g.IsMember(2) {
+		t.Errorf("unexpected members after delete %v", g.Members)
+	}
+	if _, err = store.GroupGet(solo.ID); err != ErrGroupNotFound {
+		t.Errorf("expected empty group to be deleted, got %v", err)
+	}
+	if err = store.DeleteGroup(g.ID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGroupsNotSupported(t *testing.T) {
+	store := NewStore(&userOnlyStorer{NewMemoryStore(WithGCInterval(0)).store}, WithGCInterval(0))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CreateGroup("team", 1); err != ErrGroupsNotSupported {
+		t.Errorf("expected ErrGroupsNotSupported, got %v", err)
+	}
+	if _, err = store.UserIDDelete(1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateGroupID(t *testing.T) {
+	mem := NewMemoryStore(WithGCInterval(0)).store.(*memoryStore)
+	store := NewStore(copyingGroupStorer{mem}, WithGCInterval(0))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := store.CreateGroup("team", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID != 1 {
+		t.Errorf("expected the group ID from AddGroup, got %d", g.ID)
+	}
+}
+
+// copyingGroupStorer only returns the new group ID from AddGroup, without
+// setting the ID of the passed group.
+type copyingGroupStorer struct {
+	*memoryStore
+}
+
+func (s copyingGroupStorer) AddGroup(g *Group) (uint64, error) {
+	c := *g
+	return s.memoryStore.AddGroup(&c)
+}
+
+// userOnlyStorer hides the optional interfaces of a Storer.
+type userOnlyStorer struct {
+	Storer
+}
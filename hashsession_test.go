@@ -0,0 +1,101 @@
+package crowd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashedSessions(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0))
+
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.store.GetSession(u.Session.ID); err != ErrSessionNotFound {
+		t.Errorf("session is stored with its token: %v", err)
+	}
+	stored, err := store.store.GetSession(hashSessionID(u.Session.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.IDGet(u.Session.ID)
+	if err != nil || !got.LoggedIn || got.Session.ID != u.Session.ID {
+		t.Errorf("expected the logged in session, got %+v, %v", got, err)
+	}
+
+	// a leaked stored ID is not a valid token
+	got, err = store.IDGet(stored.ID)
+	if err != nil || got.LoggedIn || got.Session.ID == stored.ID {
+		t.Errorf("stored ID was accepted as token: %+v, %v", got, err)
+	}
+
+	err = store.RevokeSession(stored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.IDGet(u.Session.ID); got.LoggedIn {
+		t.Errorf("session revoked by its stored ID is still valid")
+	}
+}
+
+func TestLegacySessions(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0))
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putLegacy := func(id string) {
+		t.Helper()
+		err := store.store.PutSession(&StoredSession{
+			ID:       id,
+			Expires:  time.Now().Add(time.Hour),
+			LoggedIn: true,
+			UserID:   u.Session.UserID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	putLegacy("legacy1")
+	got, err := store.IDGet("legacy1")
+	if err != nil || !got.LoggedIn || got.Session.ID != "legacy1" {
+		t.Fatalf("expected the legacy session, got %+v, %v", got, err)
+	}
+	if _, err = store.store.GetSession("legacy1"); err != ErrSessionNotFound {
+		t.Errorf("legacy session was not migrated: %v", err)
+	}
+	if _, err = store.store.GetSession(hashSessionID("legacy1")); err != nil {
+		t.Errorf("migrated session not found: %v", err)
+	}
+
+	putLegacy("legacy2")
+	putLegacy("legacy3")
+	n, err := store.MigrateSessionIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 migrated sessions, got %d", n)
+	}
+	err = store.store.ForEachSession(func(sess *StoredSession) bool {
+		if !strings.HasPrefix(sess.ID, hashedSessionPrefix) {
+			t.Errorf("session %q was not migrated", sess.ID)
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strict := NewStore(store.store, WithGCInterval(0), WithLegacySessionIDs(false))
+	if got, _ = strict.IDGet("legacy2"); !got.LoggedIn {
+		t.Errorf("migrated session is not valid")
+	}
+	putLegacy("legacy4")
+	if got, _ = strict.IDGet("legacy4"); got.LoggedIn {
+		t.Errorf("legacy session was found with legacy IDs disabled")
+	}
+}
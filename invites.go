@@ -0,0 +1,222 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const tokenKindInvite = "invite"
+
+var (
+	// ErrInviteInvalid is returned when an invite token doesn't exist
+	// or was already used.
+	ErrInviteInvalid = errors.New("Invite is invalid")
+
+	// ErrInviteExpired is returned when an invite token is expired.
+	ErrInviteExpired = errors.New("Invite is expired")
+)
+
+// InviteTarget describes what an invite is for. Both fields are optional.
+type InviteTarget struct {
+	// Username is pre-filled for the registration if no other
+	// username is passed.
+	Username string
+	// GroupID is the group that the invited user joins.
+	GroupID uint64
+}
+
+// Invite is a single use token that allows to register or to join a group.
+// Send the Token to the invited person, for example as part of a link.
+type Invite struct {
+	Token     string
+	InviterID uint64
+	Target    InviteTarget
+	Expires   time.Time
+}
+
+// CreateInvite creates an invite from the user with the ID inviterID that
+// expires after ttl. If the target has a GroupID, the inviter has to be a
+// member of that group, otherwise ErrNotGroupMember is returned. The backend
+// of the Store needs to implement TokenStorer.
+func (s *Store) CreateInvite(inviterID uint64, target InviteTarget, ttl time.Duration) (*Invite, error) {
+	_, err := s.store.GetUser(inviterID)
+	if err != nil {
+		return nil, err
+	}
+	if target.GroupID != 0 {
+		member, err := s.IsGroupMember(target.GroupID, inviterID)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return nil, ErrNotGroupMember
+		}
+	}
+	token, t, err := s.issueToken(tokenKindInvite, inviterID, ttl, target)
+	if err != nil {
+		return nil, err
+	}
+	return makeInvite(token, t)
+}
+
+// InviteGet returns the invite with the given token without using it up,
+// for example to pre-fill a registration form.
+func (s *Store) InviteGet(token string) (*Invite, error) {
+	t, err := s.getToken(tokenKindInvite, token)
+	if err != nil {
+		return nil, inviteError(err)
+	}
+	return makeInvite(token, t)
+}
+
+// CookieRegisterWithInvite registers a new user like CookieRegister, but
+// only with a valid invite token which is used up. If username is empty,
+// the username of the invite is used. The new user joins the group of the
+// invite and InvitedBy is set to the inviter. ErrInviteInvalid or
+// ErrInviteExpired are returned for invalid tokens.
+func (s *Store) CookieRegisterWithInvite(w http.ResponseWriter, r *http.Request, token, username, pass string) (*User, error) {
+	u, changed, err := s.registerInviteID(s.getCookieID(r), token, username, pass)
+	if changed {
+		s.saveCookie(w, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// IDRegisterWithInvite registers a new user like IDRegister, but only with
+// a valid invite token. It works like CookieRegisterWithInvite.
+//
+// It is the callers responsibility to pass the session token (User.ID) back
+// to the client.
+func (s *Store) IDRegisterWithInvite(id, token, username, pass string) (*User, error) {
+	u, _, err := s.registerInviteID(id, token, username, pass)
+	return makeUser(u), err
+}
+
+// UserIDAcceptInvite uses up the invite token and adds the existing user
+// with the given ID to the group of the invite. It returns ErrInviteInvalid
+// if the invite has no group.
+func (s *Store) UserIDAcceptInvite(userID uint64, token string) (*Group, error) {
+	inv, err := s.InviteGet(token)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Target.GroupID == 0 {
+		return nil, ErrInviteInvalid
+	}
+	_, err = s.store.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	inv, err = s.takeInvite(token)
+	if err != nil {
+		return nil, err
+	}
+	return s.GroupAddMember(inv.Target.GroupID, userID)
+}
+
+func (s *Store) registerInviteID(id, token, username, pass string) (*StoredUser, bool, error) {
+	inv, err := s.takeInvite(token)
+	if err != nil {
+		sess, changed, _ := s.getSessionID(id)
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	if username == "" {
+		username = inv.Target.Username
+	}
+	sess, changed, err := s.getSessionID(id)
+	if err != nil {
+		s.restoreInvite(inv)
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	u, err := s.register(sess, &StoredUser{
+		Name:      username,
+		InvitedBy: inv.InviterID,
+	}, pass)
+	if err != nil {
+		// the user wasn't added, so the invite can still be used
+		s.restoreInvite(inv)
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	if inv.Target.GroupID != 0 {
+		_, err = s.GroupAddMember(inv.Target.GroupID, u.ID)
+		if err != nil {
+			s.logger.Printf("Adding user %d to invite group %d failed: %v",
+				u.ID, inv.Target.GroupID, err)
+		}
+	}
+	next, err := s.rotateSession(sess)
+	changed = true
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	u.StoredSession = next
+	return u, changed, nil
+}
+
+func (s *Store) takeInvite(token string) (*Invite, error) {
+	t, err := s.takeToken(tokenKindInvite, token)
+	if err != nil {
+		return nil, inviteError(err)
+	}
+	return makeInvite(token, t)
+}
+
+func (s *Store) restoreInvite(inv *Invite) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(inv.Target)
+	if err == nil {
+		err = ts.PutToken(&StoredToken{
+			ID:      tokenID(tokenKindInvite, inv.Token),
+			Kind:    tokenKindInvite,
+			UserID:  inv.InviterID,
+			Expires: inv.Expires,
+			Data:    data,
+		})
+	}
+	if err != nil {
+		s.logger.Printf("Restoring invite failed: %v", err)
+	}
+}
+
+func inviteError(err error) error {
+	switch err {
+	case ErrTokenNotFound:
+		return ErrInviteInvalid
+	case errTokenExpired:
+		return ErrInviteExpired
+	}
+	return err
+}
+
+func makeInvite(token string, t *StoredToken) (*Invite, error) {
+	inv := &Invite{
+		Token:     token,
+		InviterID: t.UserID,
+		Expires:   t.Expires,
+	}
+	if len(t.Data) > 0 {
+		err := json.Unmarshal(t.Data, &inv.Target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inv, nil
+}
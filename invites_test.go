@@ -0,0 +1,143 @@
+package crowd
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInvites(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := store.CreateGroup("team", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := store.CreateInvite(1, InviteTarget{Username: "bob", GroupID: g.ID}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.InviteGet(inv.Token)
+	if err != nil || got.Target.Username != "bob" || got.InviterID != 1 {
+		t.Errorf("unexpected invite %+v %v", got, err)
+	}
+	if _, err = store.store.(TokenStorer).GetToken(inv.Token); err != ErrTokenNotFound {
+		t.Errorf("invite token is stored in plain text: %v", err)
+	}
+	if got.Token != inv.Token {
+		t.Errorf("InviteGet returned token %q instead of %q", got.Token, inv.Token)
+	}
+
+	// a failed registration doesn't use up the invite
+	_, err = store.IDRegisterWithInvite("", inv.Token, "alice", "secret")
+	if err != ErrUserExists {
+		t.Fatalf("expected ErrUserExists, got %v", err)
+	}
+	u, err := store.IDRegisterWithInvite("", inv.Token, "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.LoggedIn || u.Name != "bob" || u.InvitedBy != 1 {
+		t.Errorf("unexpected user %+v", u)
+	}
+	ok, err := store.IsGroupMember(g.ID, u.Session.UserID)
+	if err != nil || !ok {
+		t.Errorf("bob didn't join the group: %v %v", ok, err)
+	}
+	_, err = store.IDRegisterWithInvite("", inv.Token, "carol", "secret")
+	if err != ErrInviteInvalid {
+		t.Errorf("expected ErrInviteInvalid for a used invite, got %v", err)
+	}
+
+	expired, err := store.CreateInvite(1, InviteTarget{}, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	_, err = store.CookieRegisterWithInvite(w, httptest.NewRequest("POST", "/", nil),
+		expired.Token, "carol", "secret")
+	if err != ErrInviteExpired {
+		t.Errorf("expected ErrInviteExpired, got %v", err)
+	}
+	open, err := store.CreateInvite(1, InviteTarget{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	u, err = store.CookieRegisterWithInvite(w, httptest.NewRequest("POST", "/", nil),
+		open.Token, "carol", "secret")
+	if err != nil || !u.LoggedIn || len(w.Result().Cookies()) != 1 {
+		t.Errorf("expected carol to be registered with a cookie, got %+v %v", u, err)
+	}
+	noGroup, err := store.CreateInvite(1, InviteTarget{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.UserIDAcceptInvite(3, noGroup.Token); err != ErrInviteInvalid {
+		t.Errorf("expected ErrInviteInvalid for an invite without group, got %v", err)
+	}
+
+	// existing users can join groups
+	if _, err = store.CreateInvite(3, InviteTarget{GroupID: g.ID}, time.Hour); err != ErrNotGroupMember {
+		t.Errorf("expected ErrNotGroupMember, got %v", err)
+	}
+	join, err := store.CreateInvite(2, InviteTarget{GroupID: g.ID}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = store.UserIDAcceptInvite(3, join.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.IsMember(3) {
+		t.Errorf("carol didn't join the group: %v", g.Members)
+	}
+	if _, err = store.UserIDAcceptInvite(3, join.Token); err != ErrInviteInvalid {
+		t.Errorf("expected ErrInviteInvalid for a used invite, got %v", err)
+	}
+}
+
+func TestInviteUsedAfterRegistration(t *testing.T) {
+	mem := NewMemoryStore(WithGCInterval(0)).store
+	store := NewStore(failingLoginStorer{mem, mem.(TokenStorer)}, WithGCInterval(0))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := store.CreateInvite(1, InviteTarget{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user is added before the session can't be saved, so the invite
+	// is used up
+	if _, err = store.IDRegisterWithInvite("", inv.Token, "bob", "secret"); err != errPutFailed {
+		t.Fatalf("expected errPutFailed, got %v", err)
+	}
+	if _, err = mem.GetUserID("bob"); err != nil {
+		t.Fatalf("bob wasn't added: %v", err)
+	}
+	if _, err = store.IDRegisterWithInvite("", inv.Token, "carol", "secret"); err != ErrInviteInvalid {
+		t.Errorf("expected ErrInviteInvalid, got %v", err)
+	}
+}
+
+var errPutFailed = errors.New("put failed")
+
+// failingLoginStorer can't save logged in sessions.
+type failingLoginStorer struct {
+	Storer
+	TokenStorer
+}
+
+func (s failingLoginStorer) PutSession(sess *StoredSession) error {
+	if sess.LoggedIn {
+		return errPutFailed
+	}
+	return s.Storer.PutSession(sess)
+}
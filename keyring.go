@@ -0,0 +1,138 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// minKeyLen is the minimum length of keys in a Keyring.
+const minKeyLen = 32
+
+var (
+	// ErrKeyTooShort is returned for keys with less than 32 bytes.
+	ErrKeyTooShort = errors.New("Key is shorter than 32 bytes")
+
+	// ErrNoKeys is returned when a Keyring is created without keys.
+	ErrNoKeys = errors.New("Keyring has no keys")
+)
+
+// cookieSigningPurpose separates the HMAC of session cookies from other
+// uses of the same keys.
+const cookieSigningPurpose = "crowd session cookie"
+
+// Keyring holds the secret keys that protect session cookies. The first
+// key is the primary key, which is used for new cookies. All keys are
+// accepted for existing cookies, so that keys can be rotated without
+// logging out every user: add a new primary key with Rotate and drop the
+// old key after the longest session lifetime. A Keyring is safe for use
+// by multiple goroutines simultaneously.
+type Keyring struct {
+	mutex sync.RWMutex
+	keys  [][]byte
+}
+
+// NewKeyring returns a Keyring with the keys, the first one is the primary
+// key. Every key needs to have at least 32 random bytes.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	k := &Keyring{}
+	for _, key := range keys {
+		if len(key) < minKeyLen {
+			return nil, ErrKeyTooShort
+		}
+		k.keys = append(k.keys, append([]byte(nil), key...))
+	}
+	return k, nil
+}
+
+// Rotate makes key the new primary key and keeps at most keep of the
+// previous keys, the most recent ones first.
+func (k *Keyring) Rotate(key []byte, keep int) error {
+	if len(key) < minKeyLen {
+		return ErrKeyTooShort
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	old := k.keys
+	if len(old) > keep {
+		old = old[:keep]
+	}
+	k.keys = append([][]byte{append([]byte(nil), key...)}, old...)
+	return nil
+}
+
+// Len returns the number of keys.
+func (k *Keyring) Len() int {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return len(k.keys)
+}
+
+// sign returns value with an appended HMAC-SHA256 of the primary key,
+// separated by a dot.
+func (k *Keyring) sign(purpose, value string) string {
+	k.mutex.RLock()
+	mac := keyringMAC(k.keys[0], purpose, value)
+	k.mutex.RUnlock()
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// verify returns the value of a signed string if the HMAC of one of the
+// keys matches.
+func (k *Keyring) verify(purpose, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil || len(mac) != sha256.Size {
+		return "", false
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.keys {
+		if hmac.Equal(mac, keyringMAC(key, purpose, value)) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// derive returns a key for the purpose for each key, the primary first.
+func (k *Keyring) derive(purpose string) [][]byte {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	keys := make([][]byte, len(k.keys))
+	for i, key := range k.keys {
+		keys[i] = keyringMAC(key, purpose, "")
+	}
+	return keys
+}
+
+func keyringMAC(key []byte, purpose, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
@@ -0,0 +1,109 @@
+package crowd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, minKeyLen)
+}
+
+func TestKeyring(t *testing.T) {
+	if _, err := NewKeyring(); err != ErrNoKeys {
+		t.Errorf("expected ErrNoKeys, got %v", err)
+	}
+	if _, err := NewKeyring(testKey(1), []byte("short")); err != ErrKeyTooShort {
+		t.Errorf("expected ErrKeyTooShort, got %v", err)
+	}
+	k, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := k.sign("test", "abc.def")
+	if v, ok := k.verify("test", signed); !ok || v != "abc.def" {
+		t.Errorf("verify: got %q %v", v, ok)
+	}
+	for _, bad := range []string{"abc.def", signed + "x", "x" + signed, ""} {
+		if _, ok := k.verify("test", bad); ok {
+			t.Errorf("verify accepted %q", bad)
+		}
+	}
+	if _, ok := k.verify("other", signed); ok {
+		t.Errorf("verify accepted a signature for another purpose")
+	}
+
+	if err = k.Rotate(testKey(2), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k.verify("test", signed); !ok {
+		t.Errorf("old key isn't accepted after rotation")
+	}
+	if k.sign("test", "abc") == (&Keyring{keys: [][]byte{testKey(1)}}).sign("test", "abc") {
+		t.Errorf("new key isn't the primary key")
+	}
+	if err = k.Rotate(testKey(3), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k.verify("test", signed); ok || k.Len() != 2 {
+		t.Errorf("dropped key is still accepted, %d keys", k.Len())
+	}
+	if err = k.Rotate([]byte("short"), 1); err != ErrKeyTooShort {
+		t.Errorf("expected ErrKeyTooShort, got %v", err)
+	}
+}
+
+// countingStorer counts the GetSession calls of the backend.
+type countingStorer struct {
+	Storer
+	gets int
+}
+
+func (s *countingStorer) GetSession(id string) (*StoredSession, error) {
+	s.gets++
+	return s.Storer.GetSession(id)
+}
+
+func TestSignedCookies(t *testing.T) {
+	k, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingStorer{Storer: NewMemoryStore(WithGCInterval(0)).store}
+	store := NewStore(backend, WithCookieKeyring(k), WithGCInterval(0))
+	u, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(store.cookie(&StoredSession{ID: u.Session.ID}))
+	got, err := store.CookieGet(w, r)
+	if err != nil || !got.LoggedIn || got.Session.ID != u.Session.ID {
+		t.Fatalf("signed cookie: got %+v %v", got, err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value == u.Session.ID {
+		t.Errorf("expected a signed cookie, got %v", cookies)
+	}
+
+	for _, value := range []string{u.Session.ID, u.Session.ID + ".forged"} {
+		backend.gets = 0
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: value})
+		got, err = store.CookieGet(httptest.NewRecorder(), r)
+		if err != nil || got.LoggedIn || got.Session.ID == u.Session.ID {
+			t.Errorf("cookie %q: got %+v %v", value, got, err)
+		}
+		if backend.gets != 0 {
+			t.Errorf("cookie %q was looked up in the backend", value)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	tokenKindMagicLink  = "magic_link"
+	defaultMagicLinkTTL = time.Minute * 15
+)
+
+var (
+	// ErrMagicLinkInvalid is returned when a magic link token doesn't
+	// exist or was already used.
+	ErrMagicLinkInvalid = errors.New("Magic link is invalid")
+
+	// ErrMagicLinkExpired is returned when a magic link token is expired.
+	ErrMagicLinkExpired = errors.New("Magic link is expired")
+)
+
+// RequestMagicLink sends a single use login token to the user with the
+// given username or email address through the Notifier of the Store. The
+// token expires after the TTL that is set with WithMagicLinkTTL. To not
+// reveal which users exist, nil is also returned if there is no such user.
+// The backend of the Store needs to implement TokenStorer.
+func (s *Store) RequestMagicLink(identifier string) error {
+	if s.notifier == nil {
+		return ErrNoNotifier
+	}
+	uid, err := s.loginUserID(identifier)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	u, err := s.store.GetUser(uid)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.notify(NotifyMagicLink, tokenKindMagicLink, u, s.magicLinkTTL, nil)
+}
+
+// CookieRedeemMagicLink logs the user of a token that was sent by
+// RequestMagicLink in, like CookieLogin does with a password. The token is
+// used up, even if the login needs a second factor. It returns
+// ErrMagicLinkInvalid or ErrMagicLinkExpired for invalid tokens. With
+// WithLoginThrottle invalid tokens are counted for the client like failed
+// logins.
+func (s *Store) CookieRedeemMagicLink(w http.ResponseWriter, r *http.Request, token string) (*User, error) {
+	u, changed, err := s.redeemMagicLinkClientID(s.getCookieID(r), s.clientKey(r), token)
+	if changed {
+		s.saveCookie(w, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// IDRedeemMagicLink logs the user of a token that was sent by
+// RequestMagicLink in, like IDLogin does with a password. The token is
+// used up, even if the login needs a second factor. It returns
+// ErrMagicLinkInvalid or ErrMagicLinkExpired for invalid tokens.
+//
+// It is the callers responsibility to pass the session token (User.ID) back
+// to the client.
+func (s *Store) IDRedeemMagicLink(id string, token string) (*User, error) {
+	u, _, err := s.redeemMagicLinkID(id, token)
+	return makeUser(u), err
+}
+
+// redeemMagicLinkID redeems the token without counting invalid tokens for
+// a client.
+func (s *Store) redeemMagicLinkID(id, token string) (*StoredUser, bool, error) {
+	return s.redeemMagicLinkClientID(id, "", token)
+}
+
+func (s *Store) redeemMagicLinkClientID(id, clientKey, token string) (*StoredUser, bool, error) {
+	return s.loginWithID(id, func(sess *StoredSession) (*StoredUser, error) {
+		return s.redeemMagicLink(sess, clientKey, token)
+	})
+}
+
+// redeemMagicLink counts invalid tokens like login. The user of a token is
+// unknown before it is found, so they are only counted for the clientKey.
+func (s *Store) redeemMagicLink(sess *StoredSession, clientKey, token string) (*StoredUser, error) {
+	var keys []string
+	if clientKey != "" {
+		keys = append(keys, clientAttemptsKey(clientKey))
+	}
+	err := s.checkAttempts(s.throttle, keys)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.takeToken(tokenKindMagicLink, token)
+	switch err {
+	case ErrTokenNotFound:
+		return nil, s.magicLinkFailed(keys, ErrMagicLinkInvalid)
+	case errTokenExpired:
+		return nil, s.magicLinkFailed(keys, ErrMagicLinkExpired)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.store.GetUser(t.UserID)
+	if err == ErrUserNotFound {
+		return nil, ErrMagicLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	// like a password, the link only resets the counter without TOTP
+	if u.TOTPSecret == nil {
+		err = s.resetAttempts(s.throttle, userAttemptsKey(u.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return u, s.loginSession(sess, u)
+}
+
+// magicLinkFailed counts a failed redemption and returns err.
+func (s *Store) magicLinkFailed(keys []string, err error) error {
+	ferr := s.failAttempt(s.throttle, keys, 0)
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package crowd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMagicLink(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	store := NewMemoryStore(WithNotifier(notifier))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVerifiedEmail(t, store, 1, "alice@example.com")
+
+	for _, identifier := range []string{"bob", "bob@example.com"} {
+		if err = store.RequestMagicLink(identifier); err != nil {
+			t.Errorf("expected no error for an unknown user, got %v", err)
+		}
+	}
+	if len(notifier.Notifications()) != 0 {
+		t.Errorf("unexpected notification for an unknown user")
+	}
+	if err = store.RequestMagicLink("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := notifier.Last()
+	if !ok || n.Type != NotifyMagicLink || n.UserID != 1 || n.Email != "alice@example.com" {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	anon, err := store.IDGet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: anon.Session.ID})
+	w := httptest.NewRecorder()
+	u, err := store.CookieRedeemMagicLink(w, r, n.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.LoggedIn || u.Name != "alice" || u.Session.ID == anon.Session.ID {
+		t.Errorf("unexpected user %+v", u)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != u.Session.ID {
+		t.Errorf("expected the cookie of the new session, got %v", cookies)
+	}
+	if _, err = store.IDRedeemMagicLink("", n.Token); err != ErrMagicLinkInvalid {
+		t.Errorf("expected ErrMagicLinkInvalid for a used token, got %v", err)
+	}
+	if _, err = store.IDRedeemMagicLink("", "wrong"); err != ErrMagicLinkInvalid {
+		t.Errorf("expected ErrMagicLinkInvalid, got %v", err)
+	}
+
+	// other kinds of tokens can't be used to log in
+	if err = store.RequestPasswordReset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = notifier.Last()
+	if _, err = store.IDRedeemMagicLink("", n.Token); err != ErrMagicLinkInvalid {
+		t.Errorf("expected ErrMagicLinkInvalid for a reset token, got %v", err)
+	}
+
+	expired := NewStore(store.store, WithNotifier(notifier), WithMagicLinkTTL(-time.Second))
+	defer expired.StopSessionGC()
+	if err = expired.RequestMagicLink("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = notifier.Last()
+	if _, err = store.IDRedeemMagicLink("", n.Token); err != ErrMagicLinkExpired {
+		t.Errorf("expected ErrMagicLinkExpired, got %v", err)
+	}
+}
+
+func TestMagicLinkSecondFactor(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	store := NewMemoryStore(WithNotifier(notifier))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.UserIDEnrollTOTP(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := totpEncoding.DecodeString(key.Secret)
+	step := time.Now().Unix() / totpPeriod
+	err = store.UserIDConfirmTOTP(1, totpCode(secret, step))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.RequestMagicLink("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := notifier.Last()
+	u, err := store.IDRedeemMagicLink("", n.Token)
+	if err != ErrSecondFactorRequired {
+		t.Fatalf("expected ErrSecondFactorRequired, got %v", err)
+	}
+	if u.LoggedIn || !u.SecondFactorPending {
+		t.Errorf("unexpected user %+v", u)
+	}
+	u, err = store.IDVerifyTOTP(u.Session.ID, totpCode(secret, step+1))
+	if err != nil || !u.LoggedIn {
+		t.Errorf("IDVerifyTOTP: got %+v %v", u, err)
+	}
+}
+
+func TestMagicLinkThrottle(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	store := NewMemoryStore(WithNotifier(notifier), WithLoginThrottle(testLoginThrottle))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RequestMagicLink("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := notifier.Last()
+	redeem := func(token, remoteAddr string) error {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		_, err := store.CookieRedeemMagicLink(httptest.NewRecorder(), r, token)
+		return err
+	}
+	for i := 0; i <= testLoginThrottle.FreeAttempts; i++ {
+		if err = redeem("wrong", "192.0.2.1:1234"); err != ErrMagicLinkInvalid {
+			t.Fatalf("attempt %d: expected ErrMagicLinkInvalid, got %v", i, err)
+		}
+	}
+	if err = redeem(n.Token, "192.0.2.1:1234"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+	// the token wasn't used up by the throttled client
+	if err = redeem(n.Token, "192.0.2.2:1234"); err != nil {
+		t.Errorf("expected a login from another client, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// ContextWithUser returns a copy of ctx that carries u.
+func ContextWithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userContextKey, u)
+}
+
+// UserFromContext returns the User that was stored in ctx by the
+// Middleware. ok is false if ctx doesn't carry a User.
+func UserFromContext(ctx context.Context) (u *User, ok bool) {
+	u, ok = ctx.Value(userContextKey).(*User)
+	return u, ok && u != nil
+}
+
+// Middleware resolves the session of every request once from the token
+// sources that are set with WithTokenSources, passes the refreshed token
+// back and stores the User in the request context.
+// Handlers get it with UserFromContext(r.Context()). If the session
+// can't be loaded from the backend, the error is logged and the request
+// fails with 500 Internal Server Error.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.RequestGet(w, r)
+		if err != nil {
+			s.logger.Printf("Session error: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ContextWithUser(r.Context(), u)))
+	})
+}
+
+// RequireLogin only passes requests of logged in users to next. Other
+// requests are redirected to the login URL that is set with WithLoginURL,
+// or fail with 401 Unauthorized if there is none. If the request wasn't
+// handled by the Middleware before, RequireLogin resolves the session
+// itself.
+func (s *Store) RequireLogin(next http.Handler) http.Handler {
+	return s.withUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		if !u.LoggedIn {
+			s.unauthorized(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withUser calls fn with the User of the request. It runs the request
+// through the Middleware first, if that didn't happen yet.
+func (s *Store) withUser(fn func(w http.ResponseWriter, r *http.Request, u *User)) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := UserFromContext(r.Context())
+		fn(w, r, u)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserFromContext(r.Context()); ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.Middleware(h).ServeHTTP(w, r)
+	})
+}
+
+func (s *Store) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if s.loginURL == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, s.loginURL, http.StatusSeeOther)
+}
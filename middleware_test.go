@@ -0,0 +1,90 @@
+package crowd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+
+	var got *User
+	h := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = UserFromContext(r.Context())
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got == nil || got.LoggedIn || got.Session.ID == "" {
+		t.Fatalf("expected an anonymous user, got %+v", got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != got.Session.ID {
+		t.Fatalf("expected the session cookie, got %v", cookies)
+	}
+
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(store.cookie(&StoredSession{ID: u.Session.ID}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !got.LoggedIn || got.Name != "alice" {
+		t.Errorf("expected alice to be logged in, got %+v", got)
+	}
+
+	if _, ok := UserFromContext(r.Context()); ok {
+		t.Error("unexpected user in a plain context")
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	serve := func(s *Store, h http.Handler, id string) *http.Response {
+		r := httptest.NewRequest("GET", "/private", nil)
+		if id != "" {
+			r.AddCookie(s.cookie(&StoredSession{ID: id}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	for _, h := range []http.Handler{
+		store.RequireLogin(ok),
+		store.Middleware(store.RequireLogin(ok)),
+	} {
+		if res := serve(store, h, ""); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", res.StatusCode)
+		}
+		if res := serve(store, h, u.Session.ID); res.StatusCode != http.StatusTeapot {
+			t.Errorf("expected the handler to be called, got %d", res.StatusCode)
+		}
+	}
+
+	redirect := NewStore(store.store, WithLoginURL("/login"))
+	defer redirect.StopSessionGC()
+	res := serve(redirect, redirect.RequireLogin(ok), "")
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+		t.Errorf("expected a redirect to /login, got %d %q", res.StatusCode, res.Header.Get("Location"))
+	}
+}
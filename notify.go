@@ -0,0 +1,136 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoNotifier is returned by Store methods that need to send a token
+// to a user, if no Notifier was set with WithNotifier.
+var ErrNoNotifier = errors.New("No notifier configured")
+
+// NotificationType describes why a Notification is sent.
+type NotificationType int
+
+const (
+	// NotifyPasswordReset carries a token for ResetPassword.
+	NotifyPasswordReset NotificationType = iota + 1
+
+	// NotifyEmailVerification carries a token for VerifyEmail. It has to
+	// be delivered to the Email of the Notification.
+	NotifyEmailVerification
+
+	// NotifyMagicLink carries a login token for IDRedeemMagicLink or
+	// CookieRedeemMagicLink.
+	NotifyMagicLink
+)
+
+var notificationTypeNames = map[NotificationType]string{
+	NotifyPasswordReset:     "PasswordReset",
+	NotifyEmailVerification: "EmailVerification",
+	NotifyMagicLink:         "MagicLink",
+}
+
+func (t NotificationType) String() string {
+	name, ok := notificationTypeNames[t]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// Notification is a message with a secret token for a user. The Notifier
+// is responsible for delivering it, for example as an email with a link
+// that contains the token. Email is the address of the user, it is empty
+// if the user has none.
+type Notification struct {
+	Type     NotificationType
+	UserID   uint64
+	Username string
+	Email    string
+	Token    string
+	Expires  time.Time
+}
+
+// Notifier delivers notifications to users. Notify is called synchronously
+// by the Store, an error is returned to the caller of the Store method.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// MemoryNotifier is a Notifier that keeps all notifications in memory.
+// It is meant for tests and development.
+type MemoryNotifier struct {
+	mutex         sync.Mutex
+	notifications []Notification
+}
+
+// NewMemoryNotifier returns an empty MemoryNotifier.
+func NewMemoryNotifier() *MemoryNotifier {
+	return &MemoryNotifier{}
+}
+
+// Notify saves the notification.
+func (m *MemoryNotifier) Notify(n Notification) error {
+	m.mutex.Lock()
+	m.notifications = append(m.notifications, n)
+	m.mutex.Unlock()
+	return nil
+}
+
+// Notifications returns all saved notifications in the order they were sent.
+func (m *MemoryNotifier) Notifications() []Notification {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Notification(nil), m.notifications...)
+}
+
+// Last returns the last saved notification. ok is false if there is none.
+func (m *MemoryNotifier) Last() (n Notification, ok bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.notifications) == 0 {
+		return n, false
+	}
+	return m.notifications[len(m.notifications)-1], true
+}
+
+// notify issues a token of the kind with data for the user and hands it to
+// the Notifier. The token is deleted again if the notification fails.
+func (s *Store) notify(typ NotificationType, kind string, u *StoredUser, ttl time.Duration, data interface{}) error {
+	if s.notifier == nil {
+		return ErrNoNotifier
+	}
+	token, t, err := s.issueToken(kind, u.ID, ttl, data)
+	if err != nil {
+		return err
+	}
+	err = s.notifier.Notify(Notification{
+		Type:     typ,
+		UserID:   u.ID,
+		Username: u.Name,
+		Email:    u.Email,
+		Token:    token,
+		Expires:  t.Expires,
+	})
+	if err != nil {
+		ts, _ := s.tokenStorer()
+		ts.DeleteToken(t.ID)
+		return err
+	}
+	return nil
+}
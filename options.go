@@ -0,0 +1,288 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a Store. Options are passed to NewStore or one of the
+// New[...]Store() functions such as NewMemoryStore().
+type Option func(*Store)
+
+// WithCookieName sets the name of the session cookie. The default is "id".
+func WithCookieName(name string) Option {
+	return func(s *Store) {
+		s.cookieName = name
+	}
+}
+
+// WithSecure sets the Secure attribute of the session cookie, so that
+// browsers only send it over HTTPS.
+func WithSecure(secure bool) Option {
+	return func(s *Store) {
+		s.cookieSecure = secure
+	}
+}
+
+// WithSameSite sets the SameSite attribute of the session cookie.
+func WithSameSite(mode http.SameSite) Option {
+	return func(s *Store) {
+		s.cookieSameSite = mode
+	}
+}
+
+// WithDomain sets the Domain attribute of the session cookie. Use it to
+// share the session between subdomains.
+func WithDomain(domain string) Option {
+	return func(s *Store) {
+		s.cookieDomain = domain
+	}
+}
+
+// WithPath sets the Path attribute of the session cookie. The default is "/".
+func WithPath(path string) Option {
+	return func(s *Store) {
+		s.cookiePath = path
+	}
+}
+
+// WithLoggedInTTL sets how long a session with a logged in user is valid
+// after its last access. The default is 90 days.
+func WithLoggedInTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.loggedInTTL = d
+	}
+}
+
+// WithAnonymousTTL sets how long a session without a logged in user is
+// valid after its last access. The default is 1 minute.
+func WithAnonymousTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.anonymousTTL = d
+	}
+}
+
+// WithPasswordHasher sets the hasher for new passwords. Existing hashes
+// can still be verified, as long as their algorithm is one of scrypt,
+// bcrypt, argon2id or the one of the new hasher. Outdated hashes are
+// replaced on the next login. The default is scrypt with n=16384, r=8
+// and p=1.
+func WithPasswordHasher(h PasswordHasher) Option {
+	return func(s *Store) {
+		s.hasher = h
+	}
+}
+
+// WithEventHandler sets a function that is called synchronously for every
+// Event of the Store.
+func WithEventHandler(fn func(Event)) Option {
+	return func(s *Store) {
+		s.onEvent = fn
+	}
+}
+
+// WithGCInterval sets how often the session GC deletes expired sessions.
+// The default is 1 minute. A zero or negative interval disables the
+// automatic start of the GC in NewStore.
+func WithGCInterval(d time.Duration) Option {
+	return func(s *Store) {
+		s.gcInterval = d
+	}
+}
+
+// WithGCJitter adds a random delay between 0 and d to every GC interval.
+func WithGCJitter(d time.Duration) Option {
+	return func(s *Store) {
+		s.gcJitter = d
+	}
+}
+
+// WithLogger sets the Logger that the Store uses to report errors and
+// results of the session GC.
+func WithLogger(l Logger) Option {
+	return func(s *Store) {
+		s.logger = l
+	}
+}
+
+// WithLoginURL sets the URL that RequireLogin redirects to if the user
+// is not logged in. Without a login URL such requests fail with
+// 401 Unauthorized.
+func WithLoginURL(url string) Option {
+	return func(s *Store) {
+		s.loginURL = url
+	}
+}
+
+// WithRolePermissions grants the permissions to all users with the role.
+// It can be passed multiple times for different roles.
+func WithRolePermissions(role string, permissions ...string) Option {
+	return func(s *Store) {
+		if s.rolePermissions == nil {
+			s.rolePermissions = map[string][]string{}
+		}
+		s.rolePermissions[role] = append(s.rolePermissions[role], permissions...)
+	}
+}
+
+// WithTOTPIssuer sets the issuer name that authenticator apps show for
+// TOTP keys. The default is "crowd".
+func WithTOTPIssuer(issuer string) Option {
+	return func(s *Store) {
+		s.totpIssuer = issuer
+	}
+}
+
+// WithNotifier sets the Notifier that delivers tokens to users, for
+// example for password resets.
+func WithNotifier(n Notifier) Option {
+	return func(s *Store) {
+		s.notifier = n
+	}
+}
+
+// WithPasswordResetTTL sets how long a password reset token is valid.
+// The default is 1 hour.
+func WithPasswordResetTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.resetTTL = d
+	}
+}
+
+// WithEmailVerificationTTL sets how long an email verification token is
+// valid. The default is 24 hours.
+func WithEmailVerificationTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.verifyTTL = d
+	}
+}
+
+// WithMagicLinkTTL sets how long a magic link login token is valid.
+// The default is 15 minutes.
+func WithMagicLinkTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.magicLinkTTL = d
+	}
+}
+
+// WithLoginThrottle enables the brute-force protection of password logins
+// with the given limits, for example DefaultLoginThrottle. The counters
+// are saved as tokens, so the backend needs to implement TokenStorer.
+// TOTP and recovery codes are throttled with DefaultLoginThrottle if this
+// option isn't used. Zero durations of t are replaced by the ones of
+// DefaultLoginThrottle.
+func WithLoginThrottle(t LoginThrottle) Option {
+	return func(s *Store) {
+		t = t.withDefaults()
+		s.throttle = &t
+	}
+}
+
+// WithClientKey sets the function that returns the client key for the
+// login throttling of CookieLogin. The default is the IP address of
+// r.RemoteAddr. Behind a proxy, use the address that the proxy forwards.
+// Return an empty string to only throttle per username.
+func WithClientKey(fn func(r *http.Request) string) Option {
+	return func(s *Store) {
+		s.clientKey = fn
+	}
+}
+
+// WithCookieKeyring signs the session cookies with HMAC-SHA256 using the
+// keys of k. Cookies with a missing or wrong signature are treated like
+// missing cookies, without looking up the session in the backend. Existing
+// unsigned cookies stop working when the option is enabled.
+func WithCookieKeyring(k *Keyring) Option {
+	return func(s *Store) {
+		s.cookieKeys = k
+	}
+}
+
+// WithStatelessSessions stores the sessions encrypted with AES-GCM in the
+// session cookie instead of the backend, using the keys of k. CookieGet
+// then only needs the backend to load logged in users. The ID methods
+// don't work with stateless sessions, because the session IDs can't be
+// resolved. Sessions that are revoked before they expire are kept in the
+// RevocationList, which is set with WithRevocationList.
+func WithStatelessSessions(k *Keyring) Option {
+	return func(s *Store) {
+		s.sessionKeys = k
+	}
+}
+
+// WithRevocationList sets the RevocationList of stateless sessions.
+// The default is a MemoryRevocationList.
+func WithRevocationList(l RevocationList) Option {
+	return func(s *Store) {
+		s.revocations = l
+	}
+}
+
+// WithLegacySessionIDs sets whether sessions that were stored with their
+// token as ID, before the Store saved hashes of the tokens, are still
+// found. They are migrated when they are used. The default is true,
+// disable it once MigrateSessionIDs ran or the old sessions expired.
+func WithLegacySessionIDs(enabled bool) Option {
+	return func(s *Store) {
+		s.noLegacyIDs = !enabled
+	}
+}
+
+// WithTokenSources sets where the Request methods and the Middleware look
+// for the session token, in order of precedence. The default is only
+// TokenCookie. Tokens in query parameters end up in logs and browser
+// histories, so TokenQuery should only be used where headers can't be
+// set, for example for WebSockets.
+func WithTokenSources(sources ...TokenSource) Option {
+	return func(s *Store) {
+		s.tokenSources = sources
+	}
+}
+
+// WithTokenHeader sets the header of the TokenHeader source, which is also
+// the response header that carries refreshed tokens of all sources except
+// TokenCookie. The default is "X-Session-Token".
+func WithTokenHeader(name string) Option {
+	return func(s *Store) {
+		s.tokenHeader = name
+	}
+}
+
+// WithTokenQuery sets the query parameter of the TokenQuery source. The
+// default is "token".
+func WithTokenQuery(param string) Option {
+	return func(s *Store) {
+		s.tokenQuery = param
+	}
+}
+
+// WithRefreshTokenTTL sets how long a refresh token is valid. Every
+// rotation with IDRefresh issues a token with the full TTL. The default
+// is 90 days.
+func WithRefreshTokenTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.refreshTTL = d
+	}
+}
+
+// WithAccessTokenTTL sets how long the sessions of refresh tokens are
+// valid. Their expiry is not extended on access, the client gets a new
+// session with IDRefresh. The default is 15 minutes.
+func WithAccessTokenTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.accessTTL = d
+	}
+}
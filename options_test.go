@@ -0,0 +1,55 @@
+package crowd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCookieOptions(t *testing.T) {
+	store := NewMemoryStore(
+		WithCookieName("session"),
+		WithSecure(true),
+		WithSameSite(http.SameSiteStrictMode),
+		WithDomain("example.com"),
+		WithPath("/app"),
+		WithAnonymousTTL(time.Hour),
+		WithLoggedInTTL(48*time.Hour),
+	)
+	defer store.StopSessionGC()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/app", nil)
+	_, err := store.CookieGet(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %v", cookies)
+	}
+	c := cookies[0]
+	if c.Name != "session" || !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode ||
+		c.Domain != "example.com" || c.Path != "/app" {
+		t.Errorf("unexpected cookie attributes %+v", c)
+	}
+	if d := time.Until(c.Expires); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("anonymous cookie expires in %v, expected 1h", d)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/app", nil)
+	r.AddCookie(c)
+	_, err = store.CookieRegister(w, r, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies = w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %v", cookies)
+	}
+	if d := time.Until(cookies[0].Expires); d < 47*time.Hour || d > 48*time.Hour {
+		t.Errorf("logged in cookie expires in %v, expected 48h", d)
+	}
+}
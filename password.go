@@ -0,0 +1,387 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrUnknownPasswordHash is returned when a stored password hash
+// can't be parsed or uses an unknown algorithm.
+var ErrUnknownPasswordHash = errors.New("Unknown password hash")
+
+// scrypt parameters that were used before hashes were encoded.
+// Those hashes are stored without a prefix and the salt in StoredUser.Salt.
+const (
+	legacyScryptN      = 16384
+	legacyScryptR      = 8
+	legacyScryptP      = 1
+	legacyScryptKeyLen = 32
+)
+
+const passwordSaltLen = 32
+
+// PasswordHasher hashes and verifies passwords. The hashes are encoded
+// strings in the PHC string format ($id$params$salt$hash), so all the
+// parameters that are needed to verify a password are stored with the hash.
+type PasswordHasher interface {
+	// ID returns the algorithm identifier that is used in the encoded hash.
+	ID() string
+	// Hash returns the encoded hash of the password with a new random salt.
+	Hash(password []byte) ([]byte, error)
+	// Verify reports whether the password matches the encoded hash.
+	Verify(password, hash []byte) (bool, error)
+	// NeedsRehash reports whether the encoded hash was created with another
+	// algorithm or with weaker parameters than the ones of this hasher.
+	NeedsRehash(hash []byte) bool
+}
+
+// defaultPasswordHasher uses the same parameters as the legacy hashes.
+var defaultPasswordHasher = NewScryptHasher(legacyScryptN, legacyScryptR, legacyScryptP)
+
+// passwordHashers are used to verify hashes that were created with
+// a different algorithm than the one currently used by the Store.
+var passwordHashers = map[string]PasswordHasher{
+	"scrypt":   defaultPasswordHasher,
+	"bcrypt":   NewBcryptHasher(bcrypt.DefaultCost),
+	"argon2id": NewArgon2idHasher(1, 64*1024, 4),
+}
+
+// setUserPassword hashes the password and stores it in u.
+// It does not save u.
+func (s *Store) setUserPassword(u *StoredUser, pass string) error {
+	hash, err := s.hasher.Hash([]byte(pass))
+	if err != nil {
+		return err
+	}
+	u.Pass = hash
+	u.Salt = nil
+	return nil
+}
+
+// checkPassword reports whether pass is the password of u.
+func (s *Store) checkPassword(u *StoredUser, pass string) (bool, error) {
+	id := passwordHashID(u.Pass)
+	if id == "" {
+		// legacy hash without encoding
+		dk, err := scrypt.Key([]byte(pass), u.Salt, legacyScryptN, legacyScryptR,
+			legacyScryptP, legacyScryptKeyLen)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(dk, u.Pass) == 1, nil
+	}
+	h := s.hasher
+	if h.ID() != id {
+		h = passwordHashers[id]
+		if h == nil {
+			return false, ErrUnknownPasswordHash
+		}
+	}
+	return h.Verify([]byte(pass), u.Pass)
+}
+
+// checkDummyPassword verifies pass against a fixed hash of the current
+// PasswordHasher, so that logins of unknown users take as long as the ones
+// of existing users and don't reveal which usernames exist.
+func (s *Store) checkDummyPassword(pass string) {
+	s.dummyOnce.Do(func() {
+		hash, err := s.hasher.Hash([]byte("dummy password"))
+		if err != nil {
+			s.logger.Printf("Hashing the dummy password failed: %v", err)
+			return
+		}
+		s.dummyHash = hash
+	})
+	if s.dummyHash != nil {
+		s.hasher.Verify([]byte(pass), s.dummyHash)
+	}
+}
+
+// upgradePassword replaces the password hash of u if it doesn't match the
+// current PasswordHasher. It must only be called with the correct password.
+// Errors are only logged, because the login already succeeded.
+func (s *Store) upgradePassword(u *StoredUser, pass string) {
+	from := passwordHashID(u.Pass)
+	if from != "" && !s.hasher.NeedsRehash(u.Pass) {
+		return
+	}
+	if from == "" {
+		from = "legacy scrypt"
+	}
+	next := *u
+	next.StoredSession = nil
+	err := s.setUserPassword(&next, pass)
+	if err == nil {
+		err = s.store.PutUser(&next)
+	}
+	if err != nil {
+		s.logger.Printf("Password upgrade of user %d failed: %v", u.ID, err)
+		return
+	}
+	u.Pass, u.Salt = next.Pass, next.Salt
+	s.emit(Event{
+		Type:   EventPasswordUpgraded,
+		UserID: u.ID,
+		Detail: from + " -> " + s.hasher.ID(),
+	})
+}
+
+// passwordHashID returns the algorithm identifier of an encoded hash,
+// or an empty string for a legacy hash.
+func passwordHashID(hash []byte) string {
+	if len(hash) == 0 || hash[0] != '$' {
+		return ""
+	}
+	parts := strings.SplitN(string(hash), "$", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	switch parts[1] {
+	case "2a", "2b", "2y":
+		return "bcrypt"
+	}
+	return parts[1]
+}
+
+// phcFields splits an encoded hash into its $ separated fields and checks
+// that it has the expected id and number of fields.
+func phcFields(hash []byte, id string, n int) ([]string, error) {
+	fields := strings.Split(string(hash), "$")
+	if len(fields) != n+1 || fields[0] != "" || fields[1] != id {
+		return nil, ErrUnknownPasswordHash
+	}
+	return fields[1:], nil
+}
+
+func phcDecode(fields ...string) ([][]byte, error) {
+	out := make([][]byte, len(fields))
+	for i, f := range fields {
+		b, err := base64.RawStdEncoding.DecodeString(f)
+		if err != nil {
+			return nil, ErrUnknownPasswordHash
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+func phcEncode(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, passwordSaltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// ==================================================
+// ===================== scrypt =====================
+// ==================================================
+
+type scryptHasher struct {
+	n, r, p int
+	keyLen  int
+}
+
+// NewScryptHasher returns a PasswordHasher that uses scrypt with the
+// given CPU/memory cost n, which has to be a power of two, the block size
+// r and the parallelization p. The default hasher of a Store uses
+// n=16384, r=8 and p=1.
+func NewScryptHasher(n, r, p int) PasswordHasher {
+	return &scryptHasher{n: n, r: r, p: p, keyLen: 32}
+}
+
+func (h *scryptHasher) ID() string { return "scrypt" }
+
+func (h *scryptHasher) Hash(password []byte) ([]byte, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	dk, err := scrypt.Key(password, salt, h.n, h.r, h.p, h.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	ln := 0
+	for n := h.n; n > 1; n >>= 1 {
+		ln++
+	}
+	return []byte(fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		ln, h.r, h.p, phcEncode(salt), phcEncode(dk))), nil
+}
+
+func (h *scryptHasher) Verify(password, hash []byte) (bool, error) {
+	params, salt, dk, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	out, err := scrypt.Key(password, salt, params.n, params.r, params.p, len(dk))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(out, dk) == 1, nil
+}
+
+func (h *scryptHasher) NeedsRehash(hash []byte) bool {
+	params, _, _, err := parseScrypt(hash)
+	if err != nil {
+		return true
+	}
+	return params.n < h.n || params.r < h.r || params.p < h.p || params.keyLen < h.keyLen
+}
+
+func parseScrypt(hash []byte) (params scryptHasher, salt, dk []byte, err error) {
+	fields, err := phcFields(hash, "scrypt", 4)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	var ln int
+	_, err = fmt.Sscanf(fields[1], "ln=%d,r=%d,p=%d", &ln, &params.r, &params.p)
+	if err != nil || ln < 1 || ln > 62 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	params.n = 1 << uint(ln)
+	b, err := phcDecode(fields[2], fields[3])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.keyLen = len(b[1])
+	return params, b[0], b[1], nil
+}
+
+// ==================================================
+// ===================== bcrypt =====================
+// ==================================================
+
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a PasswordHasher that uses bcrypt with the given
+// cost. bcrypt only uses the first 72 bytes of a password. Its hashes use
+// the modular crypt format ($2a$cost$saltandhash) which is compatible with
+// the PHC string format.
+func NewBcryptHasher(cost int) PasswordHasher {
+	return &bcryptHasher{cost: cost}
+}
+
+func (h *bcryptHasher) ID() string { return "bcrypt" }
+
+func (h *bcryptHasher) Hash(password []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, h.cost)
+}
+
+func (h *bcryptHasher) Verify(password, hash []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *bcryptHasher) NeedsRehash(hash []byte) bool {
+	if passwordHashID(hash) != "bcrypt" {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost < h.cost
+}
+
+// ==================================================
+// ==================== argon2id ====================
+// ==================================================
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+// NewArgon2idHasher returns a PasswordHasher that uses argon2id with the
+// given number of passes over the memory, the memory size in KiB and the
+// number of threads. RFC 9106 recommends time=1, memory=2*1024*1024 and
+// threads=4, or time=3, memory=64*1024 and threads=4 where memory is
+// constrained.
+func NewArgon2idHasher(time, memory uint32, threads uint8) PasswordHasher {
+	return &argon2idHasher{time: time, memory: memory, threads: threads, keyLen: 32}
+}
+
+func (h *argon2idHasher) ID() string { return "argon2id" }
+
+func (h *argon2idHasher) Hash(password []byte) ([]byte, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	dk := argon2.IDKey(password, salt, h.time, h.memory, h.threads, h.keyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads, phcEncode(salt), phcEncode(dk))), nil
+}
+
+func (h *argon2idHasher) Verify(password, hash []byte) (bool, error) {
+	params, salt, dk, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	out := argon2.IDKey(password, salt, params.time, params.memory, params.threads, params.keyLen)
+	return subtle.ConstantTimeCompare(out, dk) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, _, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.time < h.time || params.memory < h.memory ||
+		params.threads < h.threads || params.keyLen < h.keyLen
+}
+
+func parseArgon2id(hash []byte) (params argon2idHasher, salt, dk []byte, err error) {
+	fields, err := phcFields(hash, "argon2id", 5)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	var version int
+	_, err = fmt.Sscanf(fields[1], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	_, err = fmt.Sscanf(fields[2], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	// argon2.IDKey panics for these, a corrupt hash must not crash a login
+	if err != nil || params.time == 0 || params.threads == 0 ||
+		params.memory < 8*uint32(params.threads) {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	b, err := phcDecode(fields[3], fields[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.keyLen = uint32(len(b[1]))
+	return params, b[0], b[1], nil
+}
@@ -0,0 +1,190 @@
+package crowd
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := []PasswordHasher{
+		NewScryptHasher(1024, 8, 1),
+		NewBcryptHasher(bcrypt.MinCost),
+		NewArgon2idHasher(1, 1024, 1),
+	}
+	for _, h := range hashers {
+		hash, err := h.Hash([]byte("secret"))
+		if err != nil {
+			t.Fatal(h.ID(), err)
+		}
+		if id := passwordHashID(hash); id != h.ID() {
+			t.Errorf("%s: hash %q has id %q", h.ID(), hash, id)
+		}
+		ok, err := h.Verify([]byte("secret"), hash)
+		if err != nil || !ok {
+			t.Errorf("%s: correct password not verified: %v", h.ID(), err)
+		}
+		ok, err = h.Verify([]byte("wrong"), hash)
+		if err != nil || ok {
+			t.Errorf("%s: wrong password verified: %v", h.ID(), err)
+		}
+	}
+
+	_, err := NewScryptHasher(1024, 8, 1).Verify([]byte("secret"), []byte("$scrypt$broken"))
+	if err != ErrUnknownPasswordHash {
+		t.Errorf("expected ErrUnknownPasswordHash, got %v", err)
+	}
+
+	// parameters that argon2 can't run with
+	argon := NewArgon2idHasher(1, 1024, 1)
+	salt := phcEncode([]byte("0123456789abcdef"))
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=7,t=1,p=1"} {
+		hash := "$argon2id$v=19$" + params + "$" + salt + "$" + salt
+		if _, err = argon.Verify([]byte("secret"), []byte(hash)); err != ErrUnknownPasswordHash {
+			t.Errorf("%s: expected ErrUnknownPasswordHash, got %v", params, err)
+		}
+	}
+}
+
+func TestStorePasswordHasherChange(t *testing.T) {
+	store := NewMemoryStore(WithPasswordHasher(NewBcryptHasher(bcrypt.MinCost)))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := store.store.GetUser(1)
+	if !strings.HasPrefix(string(u.Pass), "$2a$") {
+		t.Errorf("expected a bcrypt hash, got %q", u.Pass)
+	}
+
+	// hashes of the previous hasher can still be verified
+	store = NewStore(store.store, WithPasswordHasher(NewArgon2idHasher(1, 1024, 1)))
+	defer store.StopSessionGC()
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = store.IDLogin("", "alice", "wrong")
+	if err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong, got %v", err)
+	}
+}
+
+func TestLegacyPasswordHash(t *testing.T) {
+	var events []Event
+	store := NewMemoryStore(WithEventHandler(func(e Event) { events = append(events, e) }))
+	defer store.StopSessionGC()
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	pass, err := scrypt.Key([]byte("secret"), salt, 16384, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.store.AddUser(&StoredUser{Name: "alice", Pass: pass, Salt: salt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(events) != 1 || events[0].Detail != "legacy scrypt -> scrypt" {
+		t.Errorf("expected an upgrade of the legacy hash, got %v", events)
+	}
+	u, _ := store.store.GetUser(1)
+	if passwordHashID(u.Pass) != "scrypt" || u.Salt != nil {
+		t.Errorf("legacy hash was not replaced, got %q", u.Pass)
+	}
+	_, err = store.IDLogin("", "alice", "wrong")
+	if err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong, got %v", err)
+	}
+}
+
+func TestPasswordUpgradeOnLogin(t *testing.T) {
+	var events []Event
+	onEvent := WithEventHandler(func(e Event) { events = append(events, e) })
+	store := NewMemoryStore(onEvent, WithPasswordHasher(NewScryptHasher(1024, 8, 1)))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same policy, no upgrade
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	// wrong password, no upgrade
+	store = NewStore(store.store, onEvent, WithPasswordHasher(NewScryptHasher(2048, 8, 1)))
+	defer store.StopSessionGC()
+	_, err = store.IDLogin("", "alice", "wrong")
+	if err != ErrLoginWrong {
+		t.Fatalf("expected ErrLoginWrong, got %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	// stronger parameters
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EventPasswordUpgraded || events[0].UserID != 1 {
+		t.Fatalf("expected one upgrade event, got %v", events)
+	}
+	u, _ := store.store.GetUser(1)
+	if !strings.HasPrefix(string(u.Pass), "$scrypt$ln=11,") {
+		t.Errorf("password was not rehashed, got %q", u.Pass)
+	}
+
+	// other algorithm
+	store = NewStore(store.store, onEvent, WithPasswordHasher(NewArgon2idHasher(1, 1024, 1)))
+	defer store.StopSessionGC()
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Detail != "scrypt -> argon2id" {
+		t.Fatalf("expected an upgrade to argon2id, got %v", events)
+	}
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+func TestLoginUnknownUserHashes(t *testing.T) {
+	h := &countingHasher{PasswordHasher: NewScryptHasher(1024, 8, 1)}
+	store := NewMemoryStore(WithGCInterval(0), WithPasswordHasher(h))
+	if _, err := store.IDLogin("", "bob", "secret"); err != ErrLoginWrong {
+		t.Fatalf("expected ErrLoginWrong, got %v", err)
+	}
+	if h.verified != 1 {
+		t.Errorf("expected the password to be verified once for an unknown user, got %d", h.verified)
+	}
+}
+
+// countingHasher counts the Verify calls of a PasswordHasher.
+type countingHasher struct {
+	PasswordHasher
+	verified int
+}
+
+func (h *countingHasher) Verify(password, hash []byte) (bool, error) {
+	h.verified++
+	return h.PasswordHasher.Verify(password, hash)
+}
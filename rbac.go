@@ -0,0 +1,190 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Roles and permissions are plain names like "admin" or "billing:write".
+// Both can be assigned to users directly. A role can additionally grant
+// permissions to all of its users, which is configured with the
+// WithRolePermissions option.
+
+// UserIDAddRole assigns the role to the user with the given ID.
+// Adding a role that the user already has does nothing.
+func (s *Store) UserIDAddRole(id uint64, role string) (*User, error) {
+	return s.updateUser(id, func(u *StoredUser) bool {
+		var ok bool
+		u.Roles, ok = addName(u.Roles, role)
+		return ok
+	})
+}
+
+// UserIDRemoveRole revokes the role from the user with the given ID.
+func (s *Store) UserIDRemoveRole(id uint64, role string) (*User, error) {
+	return s.updateUser(id, func(u *StoredUser) bool {
+		var ok bool
+		u.Roles, ok = removeName(u.Roles, role)
+		return ok
+	})
+}
+
+// UserIDGrantPermission assigns the permission directly to the user with
+// the given ID.
+func (s *Store) UserIDGrantPermission(id uint64, permission string) (*User, error) {
+	return s.updateUser(id, func(u *StoredUser) bool {
+		var ok bool
+		u.Permissions, ok = addName(u.Permissions, permission)
+		return ok
+	})
+}
+
+// UserIDRevokePermission revokes a directly assigned permission from the
+// user with the given ID. Permissions that are granted by a role of the
+// user are not affected.
+func (s *Store) UserIDRevokePermission(id uint64, permission string) (*User, error) {
+	return s.updateUser(id, func(u *StoredUser) bool {
+		var ok bool
+		u.Permissions, ok = removeName(u.Permissions, permission)
+		return ok
+	})
+}
+
+// UserIDPermissions returns the sorted list of all permissions of the user
+// with the given ID, including the ones granted by roles.
+func (s *Store) UserIDPermissions(id uint64) ([]string, error) {
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]struct{}{}
+	for _, p := range u.Permissions {
+		set[p] = struct{}{}
+	}
+	for _, r := range u.Roles {
+		for _, p := range s.rolePermissions[r] {
+			set[p] = struct{}{}
+		}
+	}
+	list := make([]string, 0, len(set))
+	for p := range set {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// HasRole reports whether the role is assigned to the user.
+func (u *User) HasRole(role string) bool {
+	return hasName(u.Roles, role)
+}
+
+// HasPermission reports whether u has the permission, either directly or
+// through one of its roles.
+func (s *Store) HasPermission(u *User, permission string) bool {
+	if hasName(u.Permissions, permission) {
+		return true
+	}
+	for _, r := range u.Roles {
+		if hasName(s.rolePermissions[r], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole returns a guard that only passes requests of logged in users
+// with the role to the next handler. Requests of users that are not logged
+// in are handled like in RequireLogin, other users get 403 Forbidden.
+// The guard resolves the session cookie itself if the request wasn't
+// handled by the Middleware before.
+func (s *Store) RequireRole(role string) func(next http.Handler) http.Handler {
+	return s.requireUser(func(u *User) bool {
+		return u.HasRole(role)
+	})
+}
+
+// RequirePermission returns a guard that only passes requests of logged in
+// users with the permission to the next handler. It works like RequireRole.
+func (s *Store) RequirePermission(permission string) func(next http.Handler) http.Handler {
+	return s.requireUser(func(u *User) bool {
+		return s.HasPermission(u, permission)
+	})
+}
+
+func (s *Store) requireUser(allowed func(u *User) bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return s.withUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+			if !u.LoggedIn {
+				s.unauthorized(w, r)
+				return
+			}
+			if !allowed(u) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// updateUser loads the user, calls fn and saves the user if fn reports
+// a change.
+func (s *Store) updateUser(id uint64, fn func(u *StoredUser) (changed bool)) (*User, error) {
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if fn(u) {
+		err = s.store.PutUser(u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return makeUser(u), nil
+}
+
+func hasName(list []string, name string) bool {
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addName returns a new list with name appended, so that the list of a
+// stored user is never modified in place.
+func addName(list []string, name string) ([]string, bool) {
+	if hasName(list, name) {
+		return list, false
+	}
+	return append(list[:len(list):len(list)], name), true
+}
+
+// removeName returns a new list without name.
+func removeName(list []string, name string) ([]string, bool) {
+	if !hasName(list, name) {
+		return list, false
+	}
+	out := make([]string, 0, len(list)-1)
+	for _, n := range list {
+		if n != name {
+			out = append(out, n)
+		}
+	}
+	return out, true
+}
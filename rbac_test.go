@@ -0,0 +1,105 @@
+package crowd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	store := NewMemoryStore(WithRolePermissions("admin", "billing:write", "users:delete"))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.UserIDAddRole(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.UserIDAddRole(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.HasRole("admin") || len(u.Roles) != 1 {
+		t.Errorf("expected role admin once, got %v", u.Roles)
+	}
+	u, err = store.UserIDGrantPermission(1, "reports:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := store.UserIDPermissions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(perms) != "[billing:write reports:read users:delete]" {
+		t.Errorf("unexpected permissions %v", perms)
+	}
+	if !store.HasPermission(u, "billing:write") || store.HasPermission(u, "billing:read") {
+		t.Errorf("wrong permission check for %+v", u)
+	}
+
+	u, err = store.UserIDRemoveRole(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.UserIDRevokePermission(1, "reports:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.HasRole("admin") || store.HasPermission(u, "billing:write") || len(u.Permissions) != 0 {
+		t.Errorf("roles and permissions were not revoked: %+v", u)
+	}
+	if _, err = store.UserIDAddRole(2, "admin"); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	store := NewMemoryStore(WithRolePermissions("admin", "billing:write"))
+	defer store.StopSessionGC()
+	for _, name := range []string{"alice", "bob"} {
+		_, err := store.UserNameRegister(name, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := store.UserIDAddRole(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := store.IDLogin("", "bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, h := range []http.Handler{
+		store.RequireRole("admin")(ok),
+		store.RequirePermission("billing:write")(ok),
+	} {
+		for id, code := range map[string]int{
+			"":               http.StatusUnauthorized,
+			bob.Session.ID:   http.StatusForbidden,
+			alice.Session.ID: http.StatusTeapot,
+		} {
+			r := httptest.NewRequest("GET", "/admin", nil)
+			if id != "" {
+				r.AddCookie(store.cookie(&StoredSession{ID: id}))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != code {
+				t.Errorf("expected %d, got %d", code, w.Code)
+			}
+		}
+	}
+}
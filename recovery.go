@@ -0,0 +1,216 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodeCount     = 10
+	recoveryCodeBytes     = 5
+	tokenKindRecoveryCode = "recovery_code"
+	recoveryClaimTTL      = time.Hour * 24
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes creates a new set of recovery codes for the user
+// with the given ID and replaces the previous ones. Only hashes of the codes
+// are stored, so show the returned codes to the user once. Each code can be
+// used for one login with IDLoginWithRecoveryCode or
+// CookieLoginWithRecoveryCode.
+func (s *Store) GenerateRecoveryCodes(userID uint64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	buf := make([]byte, recoveryCodeBytes)
+	for i := range codes {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	_, err := s.updateUser(userID, func(u *StoredUser) bool {
+		u.RecoveryCodes = hashes
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CookieLoginWithRecoveryCode logs a user in with a username and one of the
+// recovery codes instead of the password and second factor. The code is
+// used up. If the username or the code are wrong, ErrLoginWrong is
+// returned. The client gets a new session cookie and the previous session
+// is deleted. Wrong codes are counted for the user and the client like
+// failed logins, also without WithLoginThrottle.
+func (s *Store) CookieLoginWithRecoveryCode(w http.ResponseWriter, r *http.Request, username, code string) (*User, error) {
+	u, changed, err := s.recoveryLoginClientID(s.getCookieID(r), s.clientKey(r), username, code)
+	if changed {
+		s.saveCookie(w, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// IDLoginWithRecoveryCode logs a user in with a username and one of the
+// recovery codes. It works like CookieLoginWithRecoveryCode, but wrong
+// codes are only counted for the username.
+//
+// It is the callers responsibility to pass the session token (User.ID) back
+// to the client.
+func (s *Store) IDLoginWithRecoveryCode(id string, username, code string) (*User, error) {
+	u, _, err := s.recoveryLoginID(id, username, code)
+	return makeUser(u), err
+}
+
+// recoveryLoginID logs in without counting wrong codes for a client.
+func (s *Store) recoveryLoginID(id, username, code string) (*StoredUser, bool, error) {
+	return s.recoveryLoginClientID(id, "", username, code)
+}
+
+func (s *Store) recoveryLoginClientID(id, clientKey, username, code string) (*StoredUser, bool, error) {
+	sess, changed, err := s.getSessionID(id)
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	u, err := s.recoveryLogin(sess, clientKey, username, code)
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	next, err := s.rotateSession(sess)
+	changed = true
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	u.StoredSession = next
+	return u, changed, nil
+}
+
+// recoveryLogin counts failures like login, with the codeThrottle.
+func (s *Store) recoveryLogin(sess *StoredSession, clientKey, username, code string) (*StoredUser, error) {
+	uid, err := s.store.GetUserID(username)
+	if err != nil && err != ErrUserNotFound {
+		return nil, err
+	}
+	throttle := s.codeThrottle()
+	keys := attemptsKeys(uid, username, clientKey)
+	err = s.checkAttempts(throttle, keys)
+	if err != nil {
+		return nil, err
+	}
+	var user *StoredUser
+	if uid != 0 {
+		user, err = s.store.GetUser(uid)
+		if err != nil && err != ErrUserNotFound {
+			return nil, err
+		}
+	}
+	i := -1
+	if user != nil {
+		i = findRecoveryCode(user.RecoveryCodes, code)
+	}
+	if i >= 0 {
+		err = s.claimRecoveryCode(user.ID, user.RecoveryCodes[i])
+		if err == ErrLoginWrong {
+			i = -1
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if i < 0 {
+		err = s.failAttempt(throttle, keys, uid)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrLoginWrong
+	}
+	err = s.resetAttempts(throttle, keys[0])
+	if err != nil {
+		return nil, err
+	}
+	codes := make([][]byte, 0, len(user.RecoveryCodes)-1)
+	codes = append(codes, user.RecoveryCodes[:i]...)
+	user.RecoveryCodes = append(codes, user.RecoveryCodes[i+1:]...)
+	err = s.store.PutUser(user)
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{
+		Type:   EventRecoveryCodeUsed,
+		UserID: user.ID,
+		Detail: fmt.Sprint(len(user.RecoveryCodes), " codes left"),
+	})
+	sess.LoggedIn = true
+	sess.SecondFactorPending = false
+	sess.UserID = user.ID
+	s.refreshExpiry(sess)
+	return user, nil
+}
+
+// claimRecoveryCode marks the code with the hash as used by the user. The
+// token can only be added once, so that concurrent logins can't both use a
+// code before it is removed from the user. It returns ErrLoginWrong if the
+// code was already claimed. Without a TokenStorer only the removal from
+// the user is checked.
+func (s *Store) claimRecoveryCode(uid uint64, hash []byte) error {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil
+	}
+	err = s.addToken(ts, &StoredToken{
+		ID:      fmt.Sprint(tokenKindRecoveryCode, ":", uid, ":", base64.RawURLEncoding.EncodeToString(hash)),
+		Kind:    tokenKindRecoveryCode,
+		UserID:  uid,
+		Expires: time.Now().Add(recoveryClaimTTL),
+	})
+	if err == ErrTokenExists {
+		return ErrLoginWrong
+	}
+	return err
+}
+
+// findRecoveryCode returns the index of the hash of code, or -1. All
+// hashes are compared, so that the time doesn't depend on the index.
+func findRecoveryCode(hashes [][]byte, code string) int {
+	h := hashRecoveryCode(code)
+	found := -1
+	for i, stored := range hashes {
+		if subtle.ConstantTimeCompare(stored, h) == 1 {
+			found = i
+		}
+	}
+	return found
+}
+
+// hashRecoveryCode hashes the code without separators and case. The codes
+// are random, so a fast hash is enough.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
@@ -0,0 +1,138 @@
+package crowd
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	var events []Event
+	store := NewMemoryStore(WithEventHandler(func(e Event) { events = append(events, e) }))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := store.GenerateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d codes, got %v", recoveryCodeCount, codes)
+	}
+	u, err := store.UserIDGet(1)
+	if err != nil || u.RecoveryCodesLeft != recoveryCodeCount {
+		t.Errorf("expected %d codes left, got %+v %v", recoveryCodeCount, u, err)
+	}
+
+	// recovery codes also replace the second factor
+	key, err := store.UserIDEnrollTOTP(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := totpEncoding.DecodeString(key.Secret)
+	err = store.UserIDConfirmTOTP(1, totpCode(secret, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err = store.IDLoginWithRecoveryCode("", "alice", strings.ToUpper(codes[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.LoggedIn || u.Name != "alice" || u.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if len(events) != 1 || events[0].Type != EventRecoveryCodeUsed {
+		t.Errorf("expected a recovery event, got %v", events)
+	}
+	if _, err = store.IDLoginWithRecoveryCode("", "alice", codes[3]); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong for a used code, got %v", err)
+	}
+	if _, err = store.IDLoginWithRecoveryCode("", "bob", codes[4]); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong for an unknown user, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	u, err = store.CookieLoginWithRecoveryCode(w, httptest.NewRequest("POST", "/", nil),
+		"alice", strings.Replace(codes[4], "-", "", 1))
+	if err != nil || !u.LoggedIn || len(w.Result().Cookies()) != 1 {
+		t.Errorf("expected a login with cookie, got %+v %v", u, err)
+	}
+
+	// new codes replace the old ones
+	_, err = store.GenerateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.IDLoginWithRecoveryCode("", "alice", codes[5]); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong for a replaced code, got %v", err)
+	}
+}
+
+func TestRecoveryCodeThrottle(t *testing.T) {
+	store := NewMemoryStore(WithLoginThrottle(testLoginThrottle))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := store.GenerateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= testLoginThrottle.FreeAttempts; i++ {
+		if _, err = store.IDLoginWithRecoveryCode("", "alice", "aaaa-aaaa"); err != ErrLoginWrong {
+			t.Fatalf("attempt %d: expected ErrLoginWrong, got %v", i, err)
+		}
+	}
+	_, err = store.IDLoginWithRecoveryCode("", "alice", codes[0])
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+	if err = store.UnlockUser(1); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDLoginWithRecoveryCode("", "alice", codes[0])
+	if err != nil || !u.LoggedIn {
+		t.Errorf("expected a login after the unlock, got %+v %v", u, err)
+	}
+}
+
+func TestRecoveryCodeConcurrent(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := store.GenerateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	logins := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.IDLoginWithRecoveryCode("", "alice", codes[0])
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				logins++
+			} else if err != ErrLoginWrong && !errors.Is(err, ErrTooManyAttempts) {
+				t.Errorf("unexpected error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if logins != 1 {
+		t.Errorf("code was used for %d logins", logins)
+	}
+}
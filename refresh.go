@@ -0,0 +1,384 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	tokenKindRefresh       = "refresh"
+	defaultRefreshTokenTTL = time.Hour * 24 * 90
+	defaultAccessTokenTTL  = time.Minute * 15
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for refresh tokens that don't
+	// exist or were revoked.
+	ErrRefreshTokenInvalid = errors.New("Refresh token is invalid")
+
+	// ErrRefreshTokenExpired is returned for expired refresh tokens.
+	ErrRefreshTokenExpired = errors.New("Refresh token is expired")
+
+	// ErrRefreshTokenReused is returned when a refresh token is presented
+	// that was already rotated. All tokens and sessions of its family are
+	// revoked, because either the client or an attacker has a stolen copy.
+	ErrRefreshTokenReused = errors.New("Refresh token was already used")
+)
+
+// refreshData is saved as JSON in the Data of a refresh token. Family is
+// shared by all tokens that were rotated from the same login, Session is
+// the stored ID of the session that was issued with the token. Used tokens
+// are kept until they expire to detect their reuse.
+type refreshData struct {
+	Family  string
+	Session string
+	Used    bool
+}
+
+// IDIssueRefreshToken returns a new refresh token for the logged in session
+// with the given ID. The refresh token is valid for the TTL that is set
+// with WithRefreshTokenTTL and gets a new session with IDRefresh when the
+// session expired. Refresh tokens are meant for API clients, their sessions
+// expire after the TTL that is set with WithAccessTokenTTL, which is not
+// extended on access. With stateless sessions this only applies to the
+// cookies that are sent after this call. If no user is logged in with the
+// session ErrNotLoggedIn is returned.
+func (s *Store) IDIssueRefreshToken(id string) (string, error) {
+	sess, _, err := s.getSessionID(id)
+	if err != nil {
+		return "", err
+	}
+	if !sess.LoggedIn {
+		return "", ErrNotLoggedIn
+	}
+	family, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if !sess.FixedExpiry {
+		sess.FixedExpiry = true
+		sess.Expires = time.Now().Add(s.accessTTL)
+		err = s.sessions.PutSession(sess)
+		if err != nil {
+			return "", err
+		}
+	}
+	return s.issueRefreshToken(sess, family)
+}
+
+// IDRefresh rotates a refresh token. It returns the user with a new logged
+// in session and a new refresh token, the passed token and the session
+// that was issued with it are used up. If a used token is presented again,
+// all tokens that were rotated from the same login and their sessions are
+// revoked and ErrRefreshTokenReused is returned. It returns
+// ErrRefreshTokenInvalid or ErrRefreshTokenExpired for invalid tokens.
+//
+// It is the callers responsibility to pass the session token (User.ID) and
+// the refresh token back to the client.
+func (s *Store) IDRefresh(refreshToken string) (*User, string, error) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil, "", err
+	}
+	t, data, err := s.getRefreshToken(refreshToken)
+	if err != nil {
+		return nil, "", err
+	}
+	if data.Used {
+		return nil, "", s.refreshTokenReused(t.UserID, data.Family)
+	}
+	// only one caller can take the token, a concurrent refresh with the
+	// same token fails as invalid
+	t, err = ts.TakeToken(t.ID)
+	if err == ErrTokenNotFound {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	data.Used = true
+	t.Data, err = json.Marshal(data)
+	if err != nil {
+		return nil, "", err
+	}
+	err = ts.PutToken(t)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, err := s.store.GetUser(t.UserID)
+	if err == ErrUserNotFound {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	err = s.deleteStoredSession(data.Session)
+	if err != nil {
+		return nil, "", err
+	}
+	sess, err := s.makeSession()
+	if err != nil {
+		return nil, "", err
+	}
+	sess.LoggedIn = true
+	sess.UserID = user.ID
+	sess.FixedExpiry = true
+	sess.Expires = time.Now().Add(s.accessTTL)
+	err = s.sessions.PutSession(sess)
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := s.issueRefreshToken(sess, data.Family)
+	if err != nil {
+		return nil, "", err
+	}
+	user.StoredSession = sess
+	return makeUser(user), next, nil
+}
+
+// RevokeRefreshToken revokes the refresh token and all other tokens that
+// were rotated from the same login, together with their sessions. API
+// clients should call it on logout. Unknown tokens return
+// ErrRefreshTokenInvalid, expired tokens are ignored.
+func (s *Store) RevokeRefreshToken(refreshToken string) error {
+	t, data, err := s.getRefreshToken(refreshToken)
+	if err == ErrRefreshTokenExpired {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.revokeRefreshFamily(t.UserID, data.Family)
+	return err
+}
+
+// getRefreshToken returns the stored refresh token and its decoded data.
+func (s *Store) getRefreshToken(token string) (*StoredToken, *refreshData, error) {
+	t, err := s.getToken(tokenKindRefresh, token)
+	switch err {
+	case ErrTokenNotFound:
+		return nil, nil, ErrRefreshTokenInvalid
+	case errTokenExpired:
+		return nil, nil, ErrRefreshTokenExpired
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var data refreshData
+	err = json.Unmarshal(t.Data, &data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, &data, nil
+}
+
+// issueRefreshToken saves a new refresh token of the family for sess.
+func (s *Store) issueRefreshToken(sess *StoredSession, family string) (string, error) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(refreshData{
+		Family:  family,
+		Session: s.storedSessionID(sess.ID),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = ts.PutToken(&StoredToken{
+		ID:      tokenID(tokenKindRefresh, token),
+		Kind:    tokenKindRefresh,
+		UserID:  sess.UserID,
+		Expires: time.Now().Add(s.refreshTTL),
+		Data:    data,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// refreshTokenReused revokes the family of a reused token and returns
+// ErrRefreshTokenReused.
+func (s *Store) refreshTokenReused(userID uint64, family string) error {
+	count, err := s.revokeRefreshFamily(userID, family)
+	if err != nil {
+		return err
+	}
+	s.emit(Event{
+		Type:   EventRefreshTokenReused,
+		UserID: userID,
+		Detail: fmt.Sprint(count, " sessions revoked"),
+	})
+	return ErrRefreshTokenReused
+}
+
+// revokeRefreshFamily deletes all refresh tokens of the family and their
+// sessions. It returns the number of deleted sessions.
+func (s *Store) revokeRefreshFamily(userID uint64, family string) (int, error) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return 0, err
+	}
+	tokens, err := s.userRefreshTokens(ts, userID)
+	if err != nil {
+		return 0, err
+	}
+	var sessions []string
+	for _, t := range tokens {
+		if t.data.Family != family {
+			continue
+		}
+		err = ts.DeleteToken(t.ID)
+		if err != nil {
+			return 0, err
+		}
+		if !t.data.Used {
+			// used tokens already had their session deleted
+			sessions = append(sessions, t.data.Session)
+		}
+	}
+	for _, id := range sessions {
+		err = s.deleteStoredSession(id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// revokeUserRefreshTokens deletes all refresh tokens of the user, except
+// the family whose unused token belongs to the session with the stored ID
+// keepSession, which can be empty. Their sessions are left to the caller.
+// Without a TokenStorer there are no refresh tokens.
+func (s *Store) revokeUserRefreshTokens(userID uint64, keepSession string) error {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil
+	}
+	tokens, err := s.userRefreshTokens(ts, userID)
+	if err != nil {
+		return err
+	}
+	var keep string
+	for _, t := range tokens {
+		if keepSession != "" && !t.data.Used && t.data.Session == keepSession {
+			keep = t.data.Family
+		}
+	}
+	for _, t := range tokens {
+		if keep != "" && t.data.Family == keep {
+			continue
+		}
+		err = ts.DeleteToken(t.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeSessionRefreshTokens revokes the families of the unused refresh
+// tokens that were issued for the session with the stored ID, so that a
+// revoked or logged out session can't be refreshed. If userID is 0 all
+// tokens are searched. Without a TokenStorer there are no refresh tokens.
+func (s *Store) revokeSessionRefreshTokens(userID uint64, storedID string) error {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil
+	}
+	var tokens []refreshToken
+	if userID != 0 {
+		tokens, err = s.userRefreshTokens(ts, userID)
+	} else {
+		err = ts.ForEachToken(func(t *StoredToken) bool {
+			if t.Kind == tokenKindRefresh {
+				c := *t
+				tokens = append(tokens, decodeRefreshToken(&c))
+			}
+			return false
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.data.Used || t.data.Session != storedID {
+			continue
+		}
+		_, err = s.revokeRefreshFamily(t.UserID, t.data.Family)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshToken is a stored refresh token with its decoded data.
+type refreshToken struct {
+	*StoredToken
+	data refreshData
+}
+
+// userRefreshTokens returns the refresh tokens of the user.
+func (s *Store) userRefreshTokens(ts TokenStorer, userID uint64) ([]refreshToken, error) {
+	tokens, err := s.userTokens(ts, userID)
+	if err != nil {
+		return nil, err
+	}
+	var refresh []refreshToken
+	for _, t := range tokens {
+		if t.Kind != tokenKindRefresh {
+			continue
+		}
+		refresh = append(refresh, decodeRefreshToken(t))
+	}
+	return refresh, nil
+}
+
+// decodeRefreshToken decodes the data of t. Data that can't be decoded is
+// returned empty.
+func decodeRefreshToken(t *StoredToken) refreshToken {
+	r := refreshToken{StoredToken: t}
+	json.Unmarshal(t.Data, &r.data)
+	return r
+}
+
+// storedSessionID returns the ID under which the session with the ID is
+// kept, so that it can be deleted without knowing the token.
+func (s *Store) storedSessionID(id string) string {
+	if s.statelessSessions() != nil {
+		return id
+	}
+	return hashSessionID(id)
+}
+
+// deleteStoredSession deletes a session by its stored ID, sessions that
+// are already gone are ignored.
+func (s *Store) deleteStoredSession(id string) error {
+	err := s.sessions.DeleteSession(id)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package crowd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	var events []Event
+	store := NewMemoryStore(WithGCInterval(0),
+		WithEventHandler(func(e Event) { events = append(events, e) }))
+
+	anon, err := store.IDGet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.IDIssueRefreshToken(anon.Session.ID); err != ErrNotLoggedIn {
+		t.Errorf("expected ErrNotLoggedIn, got %v", err)
+	}
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.IDIssueRefreshToken(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.store.(TokenStorer).GetToken(first); err != ErrTokenNotFound {
+		t.Errorf("refresh token is stored in plain text: %v", err)
+	}
+
+	refreshed, second, err := store.IDRefresh(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refreshed.LoggedIn || refreshed.Name != "alice" || second == first {
+		t.Fatalf("expected a new session for alice, got %+v", refreshed)
+	}
+	if got, _ := store.IDGet(u.Session.ID); got.LoggedIn {
+		t.Errorf("session of the rotated refresh token is still valid")
+	}
+	if got, _ := store.IDGet(refreshed.Session.ID); !got.LoggedIn {
+		t.Errorf("refreshed session is not logged in")
+	}
+	third, err := store.IDIssueRefreshToken(refreshed.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reusing the rotated token revokes its family, but not other logins
+	_, _, err = store.IDRefresh(first)
+	if err != ErrRefreshTokenReused {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if got, _ := store.IDGet(refreshed.Session.ID); got.LoggedIn {
+		t.Errorf("session of the revoked family is still valid")
+	}
+	if _, _, err = store.IDRefresh(second); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid for the revoked family, got %v", err)
+	}
+	if len(events) != 1 || events[0].Type != EventRefreshTokenReused || events[0].Detail != "1 sessions revoked" {
+		t.Errorf("expected a RefreshTokenReused event, got %v", events)
+	}
+	if _, _, err = store.IDRefresh(third); err != nil {
+		t.Errorf("refresh token of another login was revoked: %v", err)
+	}
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0), WithRefreshTokenTTL(time.Hour))
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.IDIssueRefreshToken(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, second, err := store.IDRefresh(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.RevokeRefreshToken(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.IDGet(u.Session.ID); got.LoggedIn {
+		t.Errorf("session of the revoked token is still valid")
+	}
+	if _, _, err = store.IDRefresh(second); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid, got %v", err)
+	}
+	if err = store.RevokeRefreshToken("unknown"); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid, got %v", err)
+	}
+
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := store.IDIssueRefreshToken(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := store.store.(TokenStorer)
+	tok, err := ts.GetToken(tokenID(tokenKindRefresh, expired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok.Expires = time.Now().Add(-time.Second)
+	if err = ts.PutToken(tok); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(expired); err != ErrRefreshTokenExpired {
+		t.Errorf("expected ErrRefreshTokenExpired, got %v", err)
+	}
+}
+
+func TestAccessTokenTTL(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0), WithAccessTokenTTL(time.Minute))
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.IDIssueRefreshToken(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.IDGet(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LoggedIn || got.Session.Expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("expected the session to expire within the access TTL, got %v",
+			got.Session.Expires)
+	}
+
+	// the session is not extended on access and expires, while its
+	// refresh token still works
+	sess, err := store.store.GetSession(hashSessionID(u.Session.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.FixedExpiry || !sess.Expires.Equal(got.Session.Expires) {
+		t.Errorf("expected a fixed expiry of %v, got %+v", got.Session.Expires, sess)
+	}
+	sess.Expires = time.Now().Add(-time.Second)
+	if err = store.store.PutSession(sess); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.IDGet(u.Session.ID); got.LoggedIn {
+		t.Errorf("expired session is still logged in")
+	}
+	refreshed, _, err := store.IDRefresh(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refreshed.LoggedIn || refreshed.Session.Expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("expected a refreshed session within the access TTL, got %v",
+			refreshed.Session.Expires)
+	}
+
+	// a new login gets a normal session again
+	u, err = store.IDLogin(refreshed.Session.ID, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Session.Expires.Before(time.Now().Add(time.Hour)) {
+		t.Errorf("expected the logged in TTL after a login, got %v", u.Session.Expires)
+	}
+}
+
+func TestRefreshTokenRevocation(t *testing.T) {
+	// the tokens of a user are found with and without a UserTokenStorer
+	mem := NewMemoryStore(WithGCInterval(0)).store
+	for name, backend := range map[string]Storer{
+		"indexed": NewMemoryStore(WithGCInterval(0)).store,
+		"plain":   plainTokenStorer{mem, mem.(TokenStorer)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testRefreshTokenRevocation(t, backend)
+		})
+	}
+}
+
+func testRefreshTokenRevocation(t *testing.T, backend Storer) {
+	notifier := NewMemoryNotifier()
+	store := NewStore(backend, WithGCInterval(0), WithNotifier(notifier))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a password reset revokes all refresh tokens
+	_, token := refreshLogin(t, store, "secret")
+	if err = store.RequestPasswordReset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := notifier.Last()
+	if _, err = store.ResetPassword(n.Token, "reset"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(token); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after a reset, got %v", err)
+	}
+
+	// a password change keeps the tokens of the current login
+	_, other := refreshLogin(t, store, "reset")
+	u, current := refreshLogin(t, store, "reset")
+	if _, err = store.IDSetPassword(u.Session.ID, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(other); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after a password change, got %v", err)
+	}
+	u, current, err = store.IDRefresh(current)
+	if err != nil {
+		t.Fatalf("token of the current login was revoked: %v", err)
+	}
+
+	// so does logging out all other sessions
+	_, other = refreshLogin(t, store, "changed")
+	if _, err = store.RevokeAllSessions(1, u.Session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(other); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after RevokeAllSessions, got %v", err)
+	}
+	_, current, err = store.IDRefresh(current)
+	if err != nil {
+		t.Errorf("token of the current session was revoked: %v", err)
+	}
+
+	// revoking or logging out a session revokes its refresh tokens
+	u, token = refreshLogin(t, store, "changed")
+	u, token, err = store.IDRefresh(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RevokeSession(hashSessionID(u.Session.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(token); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after RevokeSession, got %v", err)
+	}
+	u, token = refreshLogin(t, store, "changed")
+	if err = store.RevokeSession(u.Session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(token); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after RevokeSession with the token, got %v", err)
+	}
+	u, token = refreshLogin(t, store, "changed")
+	if _, err = store.IDLogout(u.Session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(token); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after logout, got %v", err)
+	}
+	if _, _, err = store.IDRefresh(current); err != nil {
+		t.Errorf("token of another session was revoked: %v", err)
+	}
+
+	// setting the password without a session revokes all tokens
+	_, token = refreshLogin(t, store, "changed")
+	if _, err = store.UserIDSetPassword(1, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.IDRefresh(token); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid after UserIDSetPassword, got %v", err)
+	}
+}
+
+// refreshLogin logs alice in with pass and returns the user and a refresh
+// token of the new session.
+func refreshLogin(t *testing.T, store *Store, pass string) (*User, string) {
+	t.Helper()
+	u, err := store.IDLogin("", "alice", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.IDIssueRefreshToken(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, token
+}
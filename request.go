@@ -0,0 +1,237 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultTokenHeader = "X-Session-Token"
+	defaultTokenQuery  = "token"
+)
+
+// TokenSource is a place in a request that can carry the session token.
+// The Request methods and the Middleware look for the token in the sources
+// that are set with WithTokenSources, in their order. The refreshed token
+// is passed back on the transport it came from: as a cookie for
+// TokenCookie, and in the response header that is set with WithTokenHeader
+// for all other sources. A request without a token gets a new session on
+// the transport of the first source. Only the cookie is signed with the
+// Keyring of WithCookieKeyring, the other sources carry the session ID as
+// it is returned by the ID methods.
+type TokenSource int
+
+const (
+	// TokenCookie is the session cookie, as used by the Cookie methods
+	TokenCookie TokenSource = iota
+	// TokenBearer is an "Authorization: Bearer <token>" header
+	TokenBearer
+	// TokenHeader is the header that is set with WithTokenHeader
+	TokenHeader
+	// TokenQuery is the query parameter that is set with WithTokenQuery
+	TokenQuery
+)
+
+// RequestGet works like CookieGet, but with the token sources of the Store.
+func (s *Store) RequestGet(w http.ResponseWriter, r *http.Request) (*User, error) {
+	id, src := s.requestToken(r)
+	user, changed, err := s.getID(id)
+	if changed {
+		s.writeToken(w, src, user.StoredSession)
+	}
+	return makeUser(user), err
+}
+
+// RequestSaveData works like CookieSaveData, but with the token sources of
+// the Store.
+func (s *Store) RequestSaveData(w http.ResponseWriter, r *http.Request, data interface{}) (*User, error) {
+	id, src := s.requestToken(r)
+	user, changed, err := s.saveDataID(id, data)
+	if changed {
+		s.writeToken(w, src, user.StoredSession)
+	}
+	return makeUser(user), err
+}
+
+// RequestRegister works like CookieRegister, but with the token sources of
+// the Store.
+func (s *Store) RequestRegister(w http.ResponseWriter, r *http.Request, username, pass string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.registerID(id, username, pass)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestRegisterWithInvite works like CookieRegisterWithInvite, but with
+// the token sources of the Store.
+func (s *Store) RequestRegisterWithInvite(w http.ResponseWriter, r *http.Request, token, username, pass string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.registerInviteID(id, token, username, pass)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestSetUsername works like CookieSetUsername, but with the token
+// sources of the Store.
+func (s *Store) RequestSetUsername(w http.ResponseWriter, r *http.Request, nextusername string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.setNameID(id, nextusername)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestSetPassword works like CookieSetPassword, but with the token
+// sources of the Store.
+func (s *Store) RequestSetPassword(w http.ResponseWriter, r *http.Request, pass string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.setPasswordID(id, pass)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestSetEmail works like CookieSetEmail, but with the token sources of
+// the Store.
+func (s *Store) RequestSetEmail(w http.ResponseWriter, r *http.Request, email string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.setEmailID(id, email)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestLogin works like CookieLogin, but with the token sources of the
+// Store.
+func (s *Store) RequestLogin(w http.ResponseWriter, r *http.Request, username, pass string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.loginID(id, s.clientKey(r), username, pass)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestVerifyTOTP works like CookieVerifyTOTP, but with the token
+// sources of the Store.
+func (s *Store) RequestVerifyTOTP(w http.ResponseWriter, r *http.Request, code string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.verifyTOTPClientID(id, s.clientKey(r), code)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestLoginWithRecoveryCode works like CookieLoginWithRecoveryCode, but
+// with the token sources of the Store.
+func (s *Store) RequestLoginWithRecoveryCode(w http.ResponseWriter, r *http.Request, username, code string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.recoveryLoginClientID(id, s.clientKey(r), username, code)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestRedeemMagicLink works like CookieRedeemMagicLink, but with the
+// token sources of the Store.
+func (s *Store) RequestRedeemMagicLink(w http.ResponseWriter, r *http.Request, token string) (*User, error) {
+	id, src := s.requestToken(r)
+	u, changed, err := s.redeemMagicLinkClientID(id, s.clientKey(r), token)
+	if changed {
+		s.writeToken(w, src, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// RequestLogout works like CookieLogout, but with the token sources of the
+// Store.
+func (s *Store) RequestLogout(w http.ResponseWriter, r *http.Request) (*User, error) {
+	id, src := s.requestToken(r)
+	sess, changed, err := s.logoutID(id)
+	if changed {
+		s.writeToken(w, src, sess)
+	}
+	return makeUser(&StoredUser{StoredSession: sess}), err
+}
+
+// RequestDelete works like CookieDelete, but with the token sources of the
+// Store.
+func (s *Store) RequestDelete(w http.ResponseWriter, r *http.Request) (*User, error) {
+	id, src := s.requestToken(r)
+	sess, changed, err := s.deleteID(id)
+	if changed {
+		s.writeToken(w, src, sess)
+	}
+	return makeUser(&StoredUser{StoredSession: sess}), err
+}
+
+// requestToken returns the session ID of the first source that carries a
+// token, and the source. Without a token it returns the first source. Only
+// cookies have a signature that needs to be checked.
+func (s *Store) requestToken(r *http.Request) (string, TokenSource) {
+	for _, src := range s.tokenSources {
+		var value string
+		switch src {
+		case TokenCookie:
+			if cookie, err := r.Cookie(s.cookieName); err == nil && cookie.Value != "" {
+				return s.parseToken(cookie.Value), src
+			}
+		case TokenBearer:
+			value = bearerToken(r)
+		case TokenHeader:
+			value = r.Header.Get(s.tokenHeader)
+		case TokenQuery:
+			value = r.URL.Query().Get(s.tokenQuery)
+		}
+		if value != "" {
+			return value, src
+		}
+	}
+	if len(s.tokenSources) == 0 {
+		return "", TokenCookie
+	}
+	return "", s.tokenSources[0]
+}
+
+// writeToken passes the token of sess back to the client on the transport
+// of src.
+func (s *Store) writeToken(w http.ResponseWriter, src TokenSource, sess *StoredSession) {
+	if src == TokenCookie {
+		s.saveCookie(w, sess)
+		return
+	}
+	w.Header().Set(s.tokenHeader, s.token(sess))
+}
+
+// bearerToken returns the token of an Authorization header with the Bearer
+// scheme, whose name is case insensitive.
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
@@ -0,0 +1,163 @@
+package crowd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBearerTokens(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0), WithTokenSources(TokenBearer, TokenCookie))
+
+	w := httptest.NewRecorder()
+	u, err := store.RequestRegister(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := w.Result()
+	if len(res.Cookies()) != 0 {
+		t.Errorf("API client got a cookie: %v", res.Cookies())
+	}
+	token := res.Header.Get(defaultTokenHeader)
+	if token == "" || token != u.Session.ID {
+		t.Fatalf("expected the token %q in the response header, got %q", u.Session.ID, token)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "bearer "+token)
+	w = httptest.NewRecorder()
+	got, err := store.RequestGet(w, r)
+	if err != nil || !got.LoggedIn || got.Name != "alice" {
+		t.Fatalf("expected alice, got %+v, %v", got, err)
+	}
+	if w.Header().Get(defaultTokenHeader) != token {
+		t.Errorf("refreshed token was not written to the response header")
+	}
+
+	// the bearer token takes precedence over the cookie
+	r.AddCookie(store.cookie(&StoredSession{ID: "other"}))
+	w = httptest.NewRecorder()
+	got, err = store.RequestLogout(w, r)
+	if err != nil || got.LoggedIn {
+		t.Fatalf("expected a logout, got %+v, %v", got, err)
+	}
+	if len(w.Result().Cookies()) != 0 || w.Header().Get(defaultTokenHeader) == "" {
+		t.Errorf("logout didn't use the bearer transport")
+	}
+	if u, _ = store.IDGet(token); u.LoggedIn {
+		t.Errorf("session is still logged in")
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0),
+		WithTokenSources(TokenCookie, TokenHeader, TokenQuery),
+		WithTokenHeader("X-Token"), WithTokenQuery("t"))
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := u.Session.ID
+
+	header := httptest.NewRequest("GET", "/", nil)
+	header.Header.Set("X-Token", token)
+	query := httptest.NewRequest("GET", "/?t="+url.QueryEscape(token), nil)
+	// the default sources don't contain the bearer header
+	bearer := httptest.NewRequest("GET", "/", nil)
+	bearer.Header.Set("Authorization", "Bearer "+token)
+	for _, tc := range []struct {
+		r        *http.Request
+		loggedIn bool
+	}{
+		{header, true},
+		{query, true},
+		{bearer, false},
+	} {
+		w := httptest.NewRecorder()
+		got, err := store.RequestGet(w, tc.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.LoggedIn != tc.loggedIn {
+			t.Errorf("%v: expected logged in %v, got %+v", tc.r.Header, tc.loggedIn, got)
+		}
+		// new sessions use the first source
+		if !tc.loggedIn && len(w.Result().Cookies()) != 1 {
+			t.Errorf("expected a new session cookie, got %v", w.Result().Cookies())
+		}
+	}
+
+	var mid *User
+	h := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mid, _ = UserFromContext(r.Context())
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, header)
+	if mid == nil || !mid.LoggedIn || w.Header().Get("X-Token") != token {
+		t.Errorf("middleware didn't use the header token, got %+v", mid)
+	}
+}
+
+func TestKeyringBearerTokens(t *testing.T) {
+	keys := mustKeyring(t, testKey(1))
+	store := NewMemoryStore(WithGCInterval(0), WithCookieKeyring(keys),
+		WithTokenSources(TokenCookie, TokenBearer))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := u.Session.ID
+
+	// the bearer token is the session ID of the ID methods
+	var mid *User
+	h := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mid, _ = UserFromContext(r.Context())
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if mid == nil || !mid.LoggedIn || mid.Name != "alice" {
+		t.Fatalf("expected alice from the bearer token, got %+v", mid)
+	}
+	if w.Header().Get(defaultTokenHeader) != token || len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected the unsigned token in the response header")
+	}
+
+	// cookies still need a signature
+	signed := keys.sign(cookieSigningPurpose, token)
+	for value, loggedIn := range map[string]bool{token: false, signed: true} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: defaultSessionCookieName, Value: value})
+		got, err := store.RequestGet(httptest.NewRecorder(), r)
+		if err != nil || got.LoggedIn != loggedIn {
+			t.Errorf("cookie %q: expected logged in %v, got %+v, %v", value, loggedIn, got, err)
+		}
+	}
+}
+
+func TestRequestThrottlesClient(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0), WithLoginThrottle(testLoginThrottle),
+		WithTokenSources(TokenBearer))
+	for i := 0; i < testLoginThrottle.FreeAttempts; i++ {
+		_, err := store.RequestRedeemMagicLink(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "wrong")
+		if err != ErrMagicLinkInvalid {
+			t.Fatalf("attempt %d: expected ErrMagicLinkInvalid, got %v", i, err)
+		}
+	}
+	// the free attempts of the client are used up
+	_, err := store.RequestRedeemMagicLink(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "wrong")
+	if err != ErrMagicLinkInvalid {
+		t.Fatalf("expected ErrMagicLinkInvalid, got %v", err)
+	}
+	_, err = store.RequestRedeemMagicLink(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "wrong")
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("expected ErrTooManyAttempts for the client, got %v", err)
+	}
+}
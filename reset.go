@@ -0,0 +1,108 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	tokenKindPasswordReset  = "password_reset"
+	defaultPasswordResetTTL = time.Hour
+)
+
+var (
+	// ErrResetTokenInvalid is returned when a password reset token doesn't
+	// exist or was already used.
+	ErrResetTokenInvalid = errors.New("Password reset token is invalid")
+
+	// ErrResetTokenExpired is returned when a password reset token is expired.
+	ErrResetTokenExpired = errors.New("Password reset token is expired")
+)
+
+// RequestPasswordReset sends a single use token to the user with the given
+// username or email address through the Notifier of the Store. The token
+// expires after the TTL that is set with WithPasswordResetTTL. To not
+// reveal which users exist, nil is also returned if there is no such user.
+// The backend of the Store needs to implement TokenStorer.
+func (s *Store) RequestPasswordReset(username string) error {
+	if s.notifier == nil {
+		return ErrNoNotifier
+	}
+	uid, err := s.loginUserID(username)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	u, err := s.store.GetUser(uid)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.notify(NotifyPasswordReset, tokenKindPasswordReset, u, s.resetTTL, nil)
+}
+
+// ResetPassword sets a new password for the user of a token that was sent
+// by RequestPasswordReset. The token and all other reset tokens of the
+// user are used up, and all sessions and refresh tokens of the user are
+// revoked. It returns ErrResetTokenInvalid or ErrResetTokenExpired for
+// invalid tokens.
+func (s *Store) ResetPassword(token, newPass string) (*User, error) {
+	t, err := s.takeToken(tokenKindPasswordReset, token)
+	switch err {
+	case ErrTokenNotFound:
+		return nil, ErrResetTokenInvalid
+	case errTokenExpired:
+		return nil, ErrResetTokenExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.store.GetUser(t.UserID)
+	if err == ErrUserNotFound {
+		return nil, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.setUserPassword(u, newPass)
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.PutUser(u)
+	if err != nil {
+		return nil, err
+	}
+	// reset links that were requested before can't be used anymore
+	err = s.deleteUserTokens(u.ID, tokenKindPasswordReset)
+	if err != nil {
+		return makeUser(u), err
+	}
+	n, err := s.RevokeAllSessions(u.ID, "")
+	if err != nil {
+		return makeUser(u), err
+	}
+	s.emit(Event{
+		Type:   EventPasswordReset,
+		UserID: u.ID,
+		Detail: fmt.Sprint(n, " sessions revoked"),
+	})
+	return makeUser(u), nil
+}
@@ -0,0 +1,127 @@
+package crowd
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	store := NewMemoryStore(WithNotifier(notifier))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.RequestPasswordReset("bob"); err != nil {
+		t.Errorf("expected no error for an unknown user, got %v", err)
+	}
+	if len(notifier.Notifications()) != 0 {
+		t.Errorf("unexpected notification for an unknown user")
+	}
+	if err = store.RequestPasswordReset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := notifier.Last()
+	if err = store.RequestPasswordReset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := notifier.Last()
+	if !ok || n.Type != NotifyPasswordReset || n.UserID != 1 || n.Username != "alice" || n.Token == "" {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+	if _, err = store.store.(TokenStorer).GetToken(n.Token); err != ErrTokenNotFound {
+		t.Errorf("reset token is stored in plain text: %v", err)
+	}
+
+	if _, err = store.ResetPassword("wrong", "new"); err != ErrResetTokenInvalid {
+		t.Errorf("expected ErrResetTokenInvalid, got %v", err)
+	}
+	if _, err = store.ResetPassword(n.Token, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.ResetPassword(first.Token, "other"); err != ErrResetTokenInvalid {
+		t.Errorf("expected ErrResetTokenInvalid for an earlier token, got %v", err)
+	}
+	if _, err = store.ResetPassword(n.Token, "other"); err != ErrResetTokenInvalid {
+		t.Errorf("expected ErrResetTokenInvalid for a used token, got %v", err)
+	}
+	if u, _ = store.IDGet(u.Session.ID); u.LoggedIn {
+		t.Error("session was not revoked")
+	}
+	if _, err = store.IDLogin("", "alice", "secret"); err != ErrLoginWrong {
+		t.Errorf("expected ErrLoginWrong for the old password, got %v", err)
+	}
+	if _, err = store.IDLogin("", "alice", "new"); err != nil {
+		t.Errorf("login with the new password failed: %v", err)
+	}
+
+	expired := NewStore(store.store, WithNotifier(notifier), WithPasswordResetTTL(-time.Second))
+	defer expired.StopSessionGC()
+	if err = expired.RequestPasswordReset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = notifier.Last()
+	if _, err = store.ResetPassword(n.Token, "other"); err != ErrResetTokenExpired {
+		t.Errorf("expected ErrResetTokenExpired, got %v", err)
+	}
+}
+
+func TestUserIDSetPassword(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.UserIDSetPassword(1, "new"); err != nil {
+		t.Fatal(err)
+	}
+	// like ResetPassword, setting the password revokes all sessions
+	if u, _ = store.IDGet(u.Session.ID); u.LoggedIn {
+		t.Error("session was not revoked")
+	}
+	if _, err = store.IDLogin("", "alice", "new"); err != nil {
+		t.Errorf("login with the new password failed: %v", err)
+	}
+}
+
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(Notification) error { return errors.New("offline") }
+
+func TestPasswordResetNotifier(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RequestPasswordReset("alice"); err != ErrNoNotifier {
+		t.Errorf("expected ErrNoNotifier, got %v", err)
+	}
+
+	failing := NewStore(store.store, WithNotifier(failingNotifier{}))
+	defer failing.StopSessionGC()
+	if err = failing.RequestPasswordReset("alice"); err == nil {
+		t.Error("expected the error of the notifier")
+	}
+	count := 0
+	store.store.(TokenStorer).ForEachToken(func(*StoredToken) bool {
+		count++
+		return false
+	})
+	if count != 0 {
+		t.Errorf("token of a failed notification was not deleted")
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// hashedSessionPrefix marks the stored IDs of sessions, which are hashes of
+// the session tokens. Tokens never contain a ':'.
+const hashedSessionPrefix = "sha256:"
+
+// UserSessionStorer is an optional interface for Storer backends that keep
+// an index of sessions by their UserID. Without it the Store has to range
+// over all sessions to find the sessions of a user.
+type UserSessionStorer interface {
+	// Get all sessions with the given UserID, no matter if they
+	// are logged in or expired.
+	GetUserSessions(userID uint64) ([]*StoredSession, error)
+}
+
+// UserSessions returns all sessions in which the user with the given ID
+// is currently logged in. The IDs of the returned sessions are the hashes
+// that are stored instead of the tokens, which can be passed to
+// RevokeSession. Stateless sessions are not known to the Store, so it
+// returns none for them.
+func (s *Store) UserSessions(userID uint64) ([]*StoredSession, error) {
+	all, err := s.userSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*StoredSession
+	now := time.Now()
+	for _, sess := range all {
+		if sess.LoggedIn && now.Before(sess.Expires) {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions, nil
+}
+
+// RevokeSession deletes the session with the given ID, which can be the
+// token of the session or its stored ID from UserSessions. A client that
+// uses this session gets a new session on its next request. The refresh
+// tokens that were rotated from the same login are revoked too.
+func (s *Store) RevokeSession(sessionID string) error {
+	userID, storedID, err := s.sessionOwner(sessionID)
+	if err != nil {
+		return err
+	}
+	err = s.revokeSessionRefreshTokens(userID, storedID)
+	if err != nil {
+		return err
+	}
+	if c := s.statelessSessions(); c != nil {
+		return c.DeleteSession(storedID)
+	}
+	return s.sessions.DeleteSession(sessionID)
+}
+
+// sessionOwner returns the user and the stored ID of the session with the
+// token or stored ID. The user is 0 if the session is not found.
+func (s *Store) sessionOwner(sessionID string) (uint64, string, error) {
+	if c := s.statelessSessions(); c != nil {
+		if cs, ok := c.decode(sessionID); ok {
+			return cs.UserID, cs.ID, nil
+		}
+		return 0, sessionID, nil
+	}
+	storedID := sessionID
+	if !strings.HasPrefix(storedID, hashedSessionPrefix) {
+		storedID = hashSessionID(storedID)
+	}
+	sess, err := s.store.GetSession(storedID)
+	if err == ErrSessionNotFound {
+		return 0, storedID, nil
+	}
+	if err != nil {
+		return 0, storedID, err
+	}
+	return sess.UserID, storedID, nil
+}
+
+// RevokeAllSessions deletes all sessions of the user with the given ID
+// except the one with the ID exceptCurrent, which can be empty. It returns
+// the number of deleted sessions. Use it to implement "log out of all
+// devices" or after a password change. The refresh tokens of the user are
+// revoked too, except the ones that were rotated from the same login as
+// the current session.
+//
+// Stateless sessions of the user are revoked if they were issued before
+// the call, exceptCurrent can be the session ID or the token of the
+// current one. The returned number is 0 for them.
+func (s *Store) RevokeAllSessions(userID uint64, exceptCurrent string) (int, error) {
+	if c := s.statelessSessions(); c != nil {
+		keep := c.sessionID(exceptCurrent)
+		err := s.revokeUserRefreshTokens(userID, keep)
+		if err != nil {
+			return 0, err
+		}
+		return 0, c.revokeUser(userID, keep)
+	}
+	keep := exceptCurrent
+	if keep != "" && !strings.HasPrefix(keep, hashedSessionPrefix) {
+		keep = hashSessionID(keep)
+	}
+	err := s.revokeUserRefreshTokens(userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := s.userSessions(userID)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, sess := range sessions {
+		if sess.ID == exceptCurrent || sess.ID == hashSessionID(exceptCurrent) {
+			continue
+		}
+		err = s.store.DeleteSession(sess.ID)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// userSessions returns all sessions with the given UserID, using the index
+// of the backend if it has one.
+func (s *Store) userSessions(userID uint64) ([]*StoredSession, error) {
+	if us, ok := s.store.(UserSessionStorer); ok {
+		return us.GetUserSessions(userID)
+	}
+	var sessions []*StoredSession
+	err := s.store.ForEachSession(func(sess *StoredSession) bool {
+		if sess.UserID == userID {
+			c := *sess
+			sessions = append(sessions, &c)
+		}
+		return false
+	})
+	return sessions, err
+}
+
+// MigrateSessionIDs replaces the stored sessions that are still saved with
+// their token as ID by sessions with the hash of the token. It returns the
+// number of migrated sessions. Old sessions are also migrated when they are
+// used, so calling it once after an update is optional. Afterwards the
+// lookup of old sessions can be disabled with WithLegacySessionIDs(false).
+func (s *Store) MigrateSessionIDs() (int, error) {
+	var legacy []*StoredSession
+	err := s.store.ForEachSession(func(sess *StoredSession) bool {
+		if !strings.HasPrefix(sess.ID, hashedSessionPrefix) {
+			c := *sess
+			legacy = append(legacy, &c)
+		}
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, sess := range legacy {
+		err = migrateSession(s.store, sess)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(legacy), nil
+}
+
+// hashedSessions is the sessionStorer of sessions in the backend. It saves
+// the sessions with the SHA-256 hash of their token as ID, so that a leak
+// of the stored sessions can't be used to take them over. The sessions
+// that are returned and passed in carry the token as ID.
+type hashedSessions struct {
+	store  Storer
+	legacy bool
+}
+
+// GetSession gets the session with the hash of the token. If legacy is
+// set, sessions that were stored with the token as ID are found as well
+// and migrated.
+func (h *hashedSessions) GetSession(token string) (*StoredSession, error) {
+	sess, err := h.store.GetSession(hashSessionID(token))
+	if err == ErrSessionNotFound && h.legacy &&
+		!strings.HasPrefix(token, hashedSessionPrefix) {
+		// a stored hash must never be accepted as a token
+		sess, err = h.store.GetSession(token)
+		if err == nil {
+			err = migrateSession(h.store, sess)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sess.ID = token
+	return sess, nil
+}
+
+// PutSession saves a copy of the session with the hash as ID.
+func (h *hashedSessions) PutSession(sess *StoredSession) error {
+	stored := *sess
+	stored.ID = hashSessionID(sess.ID)
+	return h.store.PutSession(&stored)
+}
+
+// DeleteSession deletes the session with the token, or with the stored ID
+// if the hash is passed.
+func (h *hashedSessions) DeleteSession(id string) error {
+	if strings.HasPrefix(id, hashedSessionPrefix) {
+		return h.store.DeleteSession(id)
+	}
+	err := h.store.DeleteSession(hashSessionID(id))
+	if err != nil || !h.legacy {
+		return err
+	}
+	return h.store.DeleteSession(id)
+}
+
+// migrateSession saves sess, which is stored with its token as ID, with
+// the hash of the token and deletes the old session.
+func migrateSession(store Storer, sess *StoredSession) error {
+	stored := *sess
+	stored.ID = hashSessionID(sess.ID)
+	err := store.PutSession(&stored)
+	if err != nil {
+		return err
+	}
+	return store.DeleteSession(sess.ID)
+}
+
+// hashSessionID returns the stored ID of a session token.
+func hashSessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashedSessionPrefix + base64.RawURLEncoding.EncodeToString(sum[:])
+}
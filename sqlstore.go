@@ -0,0 +1,1072 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrSQLSchemaTooNew is returned by NewSQLStore when the database was
+// migrated by a newer version of this package.
+var ErrSQLSchemaTooNew = errors.New("SQL schema is newer than supported")
+
+// sqlMigrations holds the schema migrations for the SQL backend. The version
+// of a migration is its index plus one. Migrations are applied in order and
+// each of them exactly once, so only ever append to this list.
+var sqlMigrations = [][]string{
+	// 1: users, sessions and the user ID counter
+	{
+		`CREATE TABLE crowd_counters (
+			name VARCHAR(64) NOT NULL PRIMARY KEY,
+			value BIGINT NOT NULL
+		)`,
+		`INSERT INTO crowd_counters (name, value) VALUES ('users', 0)`,
+		`CREATE TABLE crowd_users (
+			id BIGINT NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			pass BLOB,
+			salt BLOB,
+			data BLOB
+		)`,
+		`CREATE UNIQUE INDEX crowd_users_name ON crowd_users (name)`,
+		`CREATE TABLE crowd_sessions (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			expires BIGINT NOT NULL,
+			last_access BIGINT NOT NULL,
+			logged_in BOOLEAN NOT NULL,
+			user_id BIGINT NOT NULL
+		)`,
+	},
+	// 2: index for the sessions of a user
+	{
+		`CREATE INDEX crowd_sessions_user_id ON crowd_sessions (user_id)`,
+	},
+	// 3: roles and permissions of users
+	{
+		`ALTER TABLE crowd_users ADD COLUMN roles BLOB`,
+		`ALTER TABLE crowd_users ADD COLUMN permissions BLOB`,
+	},
+	// 4: groups and their members
+	{
+		`INSERT INTO crowd_counters (name, value) VALUES ('groups', 0)`,
+		`CREATE TABLE crowd_groups (
+			id BIGINT NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX crowd_groups_name ON crowd_groups (name)`,
+		`CREATE TABLE crowd_group_members (
+			group_id BIGINT NOT NULL,
+			user_id BIGINT NOT NULL,
+			owner BOOLEAN NOT NULL,
+			roles BLOB,
+			PRIMARY KEY (group_id, user_id)
+		)`,
+		`CREATE INDEX crowd_group_members_user_id ON crowd_group_members (user_id)`,
+	},
+	// 5: tokens and the inviter of users
+	{
+		`CREATE TABLE crowd_tokens (
+			id VARCHAR(255) NOT NULL PRIMARY KEY,
+			kind VARCHAR(64) NOT NULL,
+			user_id BIGINT NOT NULL,
+			expires BIGINT NOT NULL,
+			data BLOB
+		)`,
+		`ALTER TABLE crowd_users ADD COLUMN invited_by BIGINT NOT NULL DEFAULT 0`,
+	},
+	// 6: TOTP second factor
+	{
+		`ALTER TABLE crowd_users ADD COLUMN totp_secret BLOB`,
+		`ALTER TABLE crowd_users ADD COLUMN totp_pending BLOB`,
+		`ALTER TABLE crowd_users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE crowd_sessions ADD COLUMN second_factor_pending BOOLEAN NOT NULL DEFAULT 0`,
+	},
+	// 7: recovery codes
+	{
+		`ALTER TABLE crowd_users ADD COLUMN recovery_codes BLOB`,
+	},
+	// 8: email addresses, NULL if not set. Only verified addresses are
+	// unique, unverified ones are kept in pending_email
+	{
+		`ALTER TABLE crowd_users ADD COLUMN email VARCHAR(255)`,
+		`ALTER TABLE crowd_users ADD COLUMN verified BOOLEAN NOT NULL DEFAULT 0`,
+		`ALTER TABLE crowd_users ADD COLUMN pending_email VARCHAR(255)`,
+		`CREATE UNIQUE INDEX crowd_users_email ON crowd_users (email)`,
+	},
+	// 9: index for the tokens of a user
+	{
+		`CREATE INDEX crowd_tokens_user_id ON crowd_tokens (user_id)`,
+	},
+	// 10: sessions of refresh tokens
+	{
+		`ALTER TABLE crowd_sessions ADD COLUMN fixed_expiry BOOLEAN NOT NULL DEFAULT 0`,
+	},
+}
+
+// sqlUserColumns are the columns of crowd_users in the order that is used
+// by sqlUserValues and scanSQLUser. The first column is the ID.
+var sqlUserColumns = []string{"id", "name", "pass", "salt", "data", "roles", "permissions",
+	"invited_by", "totp_secret", "totp_pending", "totp_last_step", "recovery_codes", "email",
+	"verified", "pending_email"}
+
+// sqlSessionColumns are the columns of crowd_sessions in the order that is
+// used by sqlSessionValues and scanSQLSession. The first column is the ID.
+var sqlSessionColumns = []string{"id", "expires", "last_access", "logged_in", "user_id",
+	"second_factor_pending", "fixed_expiry"}
+
+var (
+	sqlSelectUser    = sqlSelect("crowd_users", sqlUserColumns)
+	sqlInsertUser    = sqlInsert("crowd_users", sqlUserColumns)
+	sqlSelectSession = sqlSelect("crowd_sessions", sqlSessionColumns)
+)
+
+// sqlTokenColumns are the columns of crowd_tokens. The first column is the
+// ID.
+var sqlTokenColumns = []string{"id", "kind", "user_id", "expires", "data"}
+
+func sqlSelect(table string, columns []string) string {
+	return `SELECT ` + strings.Join(columns, ", ") + ` FROM ` + table
+}
+
+func sqlInsert(table string, columns []string) string {
+	return `INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") +
+		`) VALUES (?` + strings.Repeat(", ?", len(columns)-1) + `)`
+}
+
+// sqlUpdate returns an UPDATE of all columns but the first one, which
+// is the ID that is passed last.
+func sqlUpdate(table string, columns []string) string {
+	return `UPDATE ` + table + ` SET ` + strings.Join(columns[1:], " = ?, ") +
+		` = ? WHERE ` + columns[0] + ` = ?`
+}
+
+// sqlUpsert updates the row with the ID in the first value and inserts it
+// if it doesn't exist. MySQL doesn't count rows that an UPDATE left
+// unchanged as affected, so a missing row is confirmed with sqlRowExists
+// in the same transaction before the INSERT.
+func sqlUpsert(tx *sql.Tx, table string, columns []string, values []interface{}) error {
+	id := values[0]
+	args := append(values[1:len(values):len(values)], id)
+	res, err := tx.Exec(sqlUpdate(table, columns), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	exists, err := sqlRowExists(tx, table, columns[0], id)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(sqlInsert(table, columns), values...)
+	return err
+}
+
+// sqlRowExists reports whether table has a row with the id in column.
+func sqlRowExists(tx *sql.Tx, table, column string, id interface{}) (bool, error) {
+	var one int
+	err := tx.QueryRow(`SELECT 1 FROM `+table+` WHERE `+column+` = ?`, id).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sqlStore is a backend for the Store type that uses a database/sql
+// database. The queries use ? placeholders and are written for SQLite
+// and MySQL compatible databases. Times are stored as Unix nanoseconds
+// and the Data, Roles and Permissions fields of users are stored as JSON.
+// Do not use this directly, instead call NewSQLStore().
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore returns a Store that uses the passed database as a storage
+// backend. Missing schema migrations are applied before the Store is
+// returned. The database driver needs to be registered by the caller.
+func NewSQLStore(db *sql.DB, opts ...Option) (*Store, error) {
+	s, err := newSQLStore(db)
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(s, opts...), nil
+}
+
+func newSQLStore(db *sql.DB) (*sqlStore, error) {
+	s := &sqlStore{db: db}
+	err := s.migrate()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies all migrations that are newer than the current schema
+// version. Each migration runs in its own transaction.
+func (s *sqlStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS crowd_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM crowd_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return ErrSQLSchemaTooNew
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		err = s.tx(func(tx *sql.Tx) error {
+			for _, stmt := range sqlMigrations[i] {
+				_, err := tx.Exec(stmt)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO crowd_migrations (version, applied) VALUES (?, ?)`,
+				i+1, time.Now().UnixNano())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("SQL migration %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// tx runs fn in a transaction which is committed if fn returns nil
+// and rolled back otherwise.
+func (s *sqlStore) tx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlUniqueViolation reports whether err is a unique constraint violation.
+// database/sql has no portable error type for this, so the messages of the
+// common drivers are checked.
+func sqlUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") ||
+		strings.Contains(msg, "duplicate entry") ||
+		strings.Contains(msg, "duplicate key")
+}
+
+// sqlUserExists maps a unique constraint violation on crowd_users to
+// ErrEmailExists or ErrUserExists. Rows are never inserted over existing
+// IDs, so only the name and email indexes can be violated. The drivers
+// name the violated column (crowd_users.email) or index (crowd_users_email)
+// in the message. MySQL also quotes the duplicate value before the key, so
+// only the part after it is checked.
+func sqlUserExists(err error) error {
+	msg := err.Error()
+	if i := strings.LastIndex(msg, " for key "); i >= 0 {
+		msg = msg[i:]
+	}
+	if strings.Contains(msg, "crowd_users_email") || strings.Contains(msg, "crowd_users.email") {
+		return ErrEmailExists
+	}
+	return ErrUserExists
+}
+
+// CountUsers returns the number of saved users
+func (s *sqlStore) CountUsers() int {
+	if storeDebug {
+		log.Println("CountUsers")
+	}
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM crowd_users`).Scan(&count)
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// GetSession gets a Session object from the sqlStore
+func (s *sqlStore) GetSession(id string) (*StoredSession, error) {
+	if storeDebug {
+		log.Println("GetSession:", id)
+	}
+	row := s.db.QueryRow(sqlSelectSession+` WHERE id = ?`, id)
+	sess, err := scanSQLSession(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// PutSession puts a Session object in the sqlStore
+func (s *sqlStore) PutSession(sess *StoredSession) error {
+	if storeDebug {
+		log.Println("PutSession:", sess.ID)
+	}
+	return s.tx(func(tx *sql.Tx) error {
+		return sqlUpsert(tx, "crowd_sessions", sqlSessionColumns, sqlSessionValues(sess))
+	})
+}
+
+// DeleteSession deletes a session object from the sqlStore
+func (s *sqlStore) DeleteSession(id string) error {
+	if storeDebug {
+		log.Println("DeleteSession:", id)
+	}
+	_, err := s.db.Exec(`DELETE FROM crowd_sessions WHERE id = ?`, id)
+	return err
+}
+
+// ForEachSession ranges over all sessions from the sqlStore. The sessions
+// are read before fn is called, the deletions are done afterwards in a
+// single transaction.
+func (s *sqlStore) ForEachSession(fn func(s *StoredSession) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachSession")
+	}
+	rows, err := s.db.Query(sqlSelectSession)
+	if err != nil {
+		return err
+	}
+	var sessions []*StoredSession
+	for rows.Next() {
+		sess, err := scanSQLSession(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		sessions = append(sessions, sess)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	var del []string
+	for _, sess := range sessions {
+		id := sess.ID
+		if fn(sess) {
+			del = append(del, id)
+		}
+	}
+	if len(del) == 0 {
+		return nil
+	}
+	return s.tx(func(tx *sql.Tx) error {
+		for _, id := range del {
+			_, err := tx.Exec(`DELETE FROM crowd_sessions WHERE id = ?`, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUserSessions gets all sessions of a user from the sqlStore
+func (s *sqlStore) GetUserSessions(userID uint64) ([]*StoredSession, error) {
+	if storeDebug {
+		log.Println("GetUserSessions:", userID)
+	}
+	rows, err := s.db.Query(sqlSelectSession+` WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []*StoredSession
+	for rows.Next() {
+		sess, err := scanSQLSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// GetUser gets a User object via the user ID from the sqlStore
+func (s *sqlStore) GetUser(id uint64) (*StoredUser, error) {
+	if storeDebug {
+		log.Println("GetUser:", id)
+	}
+	row := s.db.QueryRow(sqlSelectUser+` WHERE id = ?`, id)
+	u, err := scanSQLUser(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUserID gets the user ID via the username from the sqlStore
+func (s *sqlStore) GetUserID(username string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetUserID:", username)
+	}
+	var uid uint64
+	err := s.db.QueryRow(`SELECT id FROM crowd_users WHERE name = ?`, username).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uid, nil
+}
+
+// PutUser puts a User object in the sqlStore
+func (s *sqlStore) PutUser(u *StoredUser) error {
+	if storeDebug {
+		log.Println("PutUser:", u.ID, u.Name)
+	}
+	values, err := sqlUserValues(u)
+	if err != nil {
+		return err
+	}
+	err = s.tx(func(tx *sql.Tx) error {
+		return sqlUpsert(tx, "crowd_users", sqlUserColumns, values)
+	})
+	if sqlUniqueViolation(err) {
+		return sqlUserExists(err)
+	}
+	return err
+}
+
+// GetUserIDByEmail gets the user ID via the email address from the sqlStore
+func (s *sqlStore) GetUserIDByEmail(email string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetUserIDByEmail:", email)
+	}
+	var uid uint64
+	err := s.db.QueryRow(`SELECT id FROM crowd_users WHERE email = ?`, email).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uid, nil
+}
+
+// AddUser puts a new User object in the sqlStore and returns the user ID.
+// The ID is taken from a counter table in the same transaction, so IDs
+// start at 1 and are never reused.
+func (s *sqlStore) AddUser(u *StoredUser) (uint64, error) {
+	if storeDebug {
+		log.Println("AddUser:", u.ID, u.Name)
+	}
+	if u == nil {
+		panic("AddUser: argument stored user is nil")
+	}
+	values, err := sqlUserValues(u)
+	if err != nil {
+		return 0, err
+	}
+	var id uint64
+	err = s.tx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE crowd_counters SET value = value + 1 WHERE name = 'users'`)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(`SELECT value FROM crowd_counters WHERE name = 'users'`).Scan(&id)
+		if err != nil {
+			return err
+		}
+		values[0] = id
+		_, err = tx.Exec(sqlInsertUser, values...)
+		return err
+	})
+	if sqlUniqueViolation(err) {
+		return 0, sqlUserExists(err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	u.ID = id
+	return id, nil
+}
+
+// RenameUser renames a user while keeping the ID the same
+func (s *sqlStore) RenameUser(id uint64, newname string) error {
+	if storeDebug {
+		log.Println("RenameUser:", id, newname)
+	}
+	err := s.tx(func(tx *sql.Tx) error {
+		exists, err := sqlRowExists(tx, "crowd_users", "id", id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+		_, err = tx.Exec(`UPDATE crowd_users SET name = ? WHERE id = ?`, newname, id)
+		return err
+	})
+	if sqlUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// DeleteUser deletes a user object from the sqlStore
+func (s *sqlStore) DeleteUser(id uint64) error {
+	if storeDebug {
+		log.Println("DeleteUser:", id)
+	}
+	res, err := s.db.Exec(`DELETE FROM crowd_users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ForEachUser ranges over all users from the sqlStore. The users are read
+// before fn is called, the deletions are done afterwards in a single
+// transaction.
+func (s *sqlStore) ForEachUser(fn func(u *StoredUser) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachUser")
+	}
+	rows, err := s.db.Query(sqlSelectUser)
+	if err != nil {
+		return err
+	}
+	var users []*StoredUser
+	for rows.Next() {
+		u, err := scanSQLUser(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	var del []uint64
+	for _, u := range users {
+		id := u.ID
+		if fn(u) {
+			del = append(del, id)
+		}
+	}
+	if len(del) == 0 {
+		return nil
+	}
+	return s.tx(func(tx *sql.Tx) error {
+		for _, id := range del {
+			_, err := tx.Exec(`DELETE FROM crowd_users WHERE id = ?`, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetGroup gets a Group object via the group ID from the sqlStore
+func (s *sqlStore) GetGroup(id uint64) (*Group, error) {
+	if storeDebug {
+		log.Println("GetGroup:", id)
+	}
+	return sqlGetGroup(s.db, id)
+}
+
+// GetGroupID gets the group ID via the group name from the sqlStore
+func (s *sqlStore) GetGroupID(name string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetGroupID:", name)
+	}
+	var id uint64
+	err := s.db.QueryRow(`SELECT id FROM crowd_groups WHERE name = ?`, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrGroupNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// PutGroup puts a Group object and its members in the sqlStore
+func (s *sqlStore) PutGroup(g *Group) error {
+	if storeDebug {
+		log.Println("PutGroup:", g.ID, g.Name)
+	}
+	err := s.tx(func(tx *sql.Tx) error {
+		err := sqlUpsert(tx, "crowd_groups", []string{"id", "name"},
+			[]interface{}{g.ID, g.Name})
+		if err != nil {
+			return err
+		}
+		return sqlPutGroupMembers(tx, g)
+	})
+	if sqlUniqueViolation(err) {
+		return ErrGroupExists
+	}
+	return err
+}
+
+// AddGroup puts a new Group object in the sqlStore and returns the group ID
+func (s *sqlStore) AddGroup(g *Group) (uint64, error) {
+	if storeDebug {
+		log.Println("AddGroup:", g.Name)
+	}
+	var id uint64
+	err := s.tx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE crowd_counters SET value = value + 1 WHERE name = 'groups'`)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(`SELECT value FROM crowd_counters WHERE name = 'groups'`).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO crowd_groups (id, name) VALUES (?, ?)`, id, g.Name)
+		if err != nil {
+			return err
+		}
+		g.ID = id
+		return sqlPutGroupMembers(tx, g)
+	})
+	if sqlUniqueViolation(err) {
+		return 0, ErrGroupExists
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// DeleteGroup deletes a group object and its members from the sqlStore
+func (s *sqlStore) DeleteGroup(id uint64) error {
+	if storeDebug {
+		log.Println("DeleteGroup:", id)
+	}
+	return s.tx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM crowd_groups WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrGroupNotFound
+		}
+		_, err = tx.Exec(`DELETE FROM crowd_group_members WHERE group_id = ?`, id)
+		return err
+	})
+}
+
+// GetUserGroups gets all groups of a user from the sqlStore
+func (s *sqlStore) GetUserGroups(userID uint64) ([]*Group, error) {
+	if storeDebug {
+		log.Println("GetUserGroups:", userID)
+	}
+	rows, err := s.db.Query(`SELECT group_id FROM crowd_group_members
+		WHERE user_id = ? ORDER BY group_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for rows.Next() {
+		var id uint64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	var groups []*Group
+	for _, id := range ids {
+		g, err := sqlGetGroup(s.db, id)
+		if err == ErrGroupNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// GetToken gets a Token object from the sqlStore
+func (s *sqlStore) GetToken(id string) (*StoredToken, error) {
+	if storeDebug {
+		log.Println("GetToken:", id)
+	}
+	return sqlGetToken(s.db, id)
+}
+
+// PutToken puts a Token object in the sqlStore
+func (s *sqlStore) PutToken(t *StoredToken) error {
+	if storeDebug {
+		log.Println("PutToken:", t.ID)
+	}
+	return s.tx(func(tx *sql.Tx) error {
+		return sqlUpsert(tx, "crowd_tokens", sqlTokenColumns,
+			[]interface{}{t.ID, t.Kind, t.UserID, t.Expires.UnixNano(), t.Data})
+	})
+}
+
+// AddToken puts a Token object in the sqlStore if its ID is unused. Of
+// concurrent inserts, the primary key only lets one succeed.
+func (s *sqlStore) AddToken(t *StoredToken) error {
+	if storeDebug {
+		log.Println("AddToken:", t.ID)
+	}
+	err := s.tx(func(tx *sql.Tx) error {
+		exists, err := sqlRowExists(tx, "crowd_tokens", "id", t.ID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrTokenExists
+		}
+		_, err = tx.Exec(sqlInsert("crowd_tokens", sqlTokenColumns),
+			t.ID, t.Kind, t.UserID, t.Expires.UnixNano(), t.Data)
+		return err
+	})
+	if sqlUniqueViolation(err) {
+		return ErrTokenExists
+	}
+	return err
+}
+
+// TakeToken gets and deletes a Token object from the sqlStore. Only the
+// caller whose delete succeeds gets the token.
+func (s *sqlStore) TakeToken(id string) (*StoredToken, error) {
+	if storeDebug {
+		log.Println("TakeToken:", id)
+	}
+	var t *StoredToken
+	err := s.tx(func(tx *sql.Tx) error {
+		var err error
+		t, err = sqlGetToken(tx, id)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM crowd_tokens WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrTokenNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DeleteToken deletes a Token object from the sqlStore
+func (s *sqlStore) DeleteToken(id string) error {
+	if storeDebug {
+		log.Println("DeleteToken:", id)
+	}
+	_, err := s.db.Exec(`DELETE FROM crowd_tokens WHERE id = ?`, id)
+	return err
+}
+
+// ForEachToken ranges over all tokens from the sqlStore. The tokens are
+// read before fn is called, the deletions are done afterwards in a single
+// transaction.
+func (s *sqlStore) ForEachToken(fn func(t *StoredToken) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachToken")
+	}
+	rows, err := s.db.Query(`SELECT id, kind, user_id, expires, data FROM crowd_tokens`)
+	if err != nil {
+		return err
+	}
+	var tokens []*StoredToken
+	for rows.Next() {
+		t, err := scanSQLToken(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	var del []string
+	for _, t := range tokens {
+		id := t.ID
+		if fn(t) {
+			del = append(del, id)
+		}
+	}
+	if len(del) == 0 {
+		return nil
+	}
+	return s.tx(func(tx *sql.Tx) error {
+		for _, id := range del {
+			_, err := tx.Exec(`DELETE FROM crowd_tokens WHERE id = ?`, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUserTokens gets all tokens of a user from the sqlStore
+func (s *sqlStore) GetUserTokens(userID uint64) ([]*StoredToken, error) {
+	if storeDebug {
+		log.Println("GetUserTokens:", userID)
+	}
+	rows, err := s.db.Query(`SELECT id, kind, user_id, expires, data
+		FROM crowd_tokens WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []*StoredToken
+	for rows.Next() {
+		t, err := scanSQLToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func sqlGetToken(q sqlQueryer, id string) (*StoredToken, error) {
+	row := q.QueryRow(`SELECT id, kind, user_id, expires, data
+		FROM crowd_tokens WHERE id = ?`, id)
+	t, err := scanSQLToken(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func scanSQLToken(row sqlScanner) (*StoredToken, error) {
+	var t StoredToken
+	var expires int64
+	err := row.Scan(&t.ID, &t.Kind, &t.UserID, &expires, &t.Data)
+	if err != nil {
+		return nil, err
+	}
+	t.Expires = time.Unix(0, expires)
+	return &t, nil
+}
+
+// sqlQueryer is implemented by *sql.DB and *sql.Tx.
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func sqlGetGroup(q sqlQueryer, id uint64) (*Group, error) {
+	g := Group{ID: id}
+	err := q.QueryRow(`SELECT name FROM crowd_groups WHERE id = ?`, id).Scan(&g.Name)
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(`SELECT user_id, owner, roles FROM crowd_group_members
+		WHERE group_id = ? ORDER BY user_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m GroupMember
+		var roles []byte
+		err = rows.Scan(&m.UserID, &m.Owner, &roles)
+		if err == nil {
+			err = sqlUnmarshal(roles, &m.Roles)
+		}
+		if err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, m)
+	}
+	return &g, rows.Err()
+}
+
+// sqlPutGroupMembers replaces the stored members of g.
+func sqlPutGroupMembers(tx *sql.Tx, g *Group) error {
+	_, err := tx.Exec(`DELETE FROM crowd_group_members WHERE group_id = ?`, g.ID)
+	if err != nil {
+		return err
+	}
+	for _, m := range g.Members {
+		roles, err := sqlMarshalStrings(m.Roles)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO crowd_group_members (group_id, user_id, owner, roles)
+			VALUES (?, ?, ?, ?)`, g.ID, m.UserID, m.Owner, roles)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlScanner is implemented by *sql.Row and *sql.Rows.
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLSession(row sqlScanner) (*StoredSession, error) {
+	var sess StoredSession
+	var expires, lastAccess int64
+	err := row.Scan(&sess.ID, &expires, &lastAccess, &sess.LoggedIn, &sess.UserID,
+		&sess.SecondFactorPending, &sess.FixedExpiry)
+	if err != nil {
+		return nil, err
+	}
+	sess.Expires = time.Unix(0, expires)
+	sess.LastAccess = time.Unix(0, lastAccess)
+	return &sess, nil
+}
+
+// sqlSessionValues returns the values of sess in the order of
+// sqlSessionColumns.
+func sqlSessionValues(sess *StoredSession) []interface{} {
+	return []interface{}{sess.ID, sess.Expires.UnixNano(), sess.LastAccess.UnixNano(),
+		sess.LoggedIn, sess.UserID, sess.SecondFactorPending, sess.FixedExpiry}
+}
+
+func scanSQLUser(row sqlScanner) (*StoredUser, error) {
+	var u StoredUser
+	var data, roles, permissions, recoveryCodes []byte
+	var email, pendingEmail sql.NullString
+	err := row.Scan(&u.ID, &u.Name, &u.Pass, &u.Salt, &data, &roles, &permissions,
+		&u.InvitedBy, &u.TOTPSecret, &u.TOTPPending, &u.TOTPLastStep, &recoveryCodes,
+		&email, &u.Verified, &pendingEmail)
+	if err != nil {
+		return nil, err
+	}
+	u.Email = email.String
+	if !email.Valid {
+		u.Email = pendingEmail.String
+	}
+	err = sqlUnmarshal(data, &u.Data)
+	if err == nil {
+		err = sqlUnmarshal(roles, &u.Roles)
+	}
+	if err == nil {
+		err = sqlUnmarshal(permissions, &u.Permissions)
+	}
+	if err == nil {
+		err = sqlUnmarshal(recoveryCodes, &u.RecoveryCodes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// sqlUserValues returns the values of u in the order of sqlUserColumns.
+func sqlUserValues(u *StoredUser) ([]interface{}, error) {
+	data, err := json.Marshal(u.Data)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := sqlMarshalStrings(u.Roles)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := sqlMarshalStrings(u.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	var recoveryCodes []byte
+	if len(u.RecoveryCodes) > 0 {
+		recoveryCodes, err = json.Marshal(u.RecoveryCodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the unique index allows many NULLs, but only one empty string. Only
+	// verified addresses are in the indexed column.
+	email := sql.NullString{String: u.Email, Valid: indexedEmail(u) != ""}
+	pendingEmail := sql.NullString{String: u.Email, Valid: u.Email != "" && !email.Valid}
+	return []interface{}{u.ID, u.Name, u.Pass, u.Salt, data, roles, permissions,
+		u.InvitedBy, u.TOTPSecret, u.TOTPPending, u.TOTPLastStep, recoveryCodes,
+		email, u.Verified, pendingEmail}, nil
+}
+
+// sqlMarshalStrings stores empty lists as NULL.
+func sqlMarshalStrings(list []string) ([]byte, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(list)
+}
+
+// sqlUnmarshal leaves v unchanged for NULL values.
+func sqlUnmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
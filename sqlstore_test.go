@@ -0,0 +1,185 @@
+package crowd
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func openTestSQLDB(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite only allows a single writer at a time
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestSQLStoreMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crowd.db")
+	db := openTestSQLDB(t, path)
+	defer db.Close()
+
+	_, err := newSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// applying the migrations a second time must be a no-op
+	_, err = newSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	err = db.QueryRow(`SELECT MAX(version) FROM crowd_migrations`).Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqlMigrations) {
+		t.Errorf("schema version is %d, expected %d", version, len(sqlMigrations))
+	}
+
+	_, err = db.Exec(`INSERT INTO crowd_migrations (version, applied) VALUES (?, 0)`, len(sqlMigrations)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newSQLStore(db)
+	if err != ErrSQLSchemaTooNew {
+		t.Errorf("expected ErrSQLSchemaTooNew, got %v", err)
+	}
+}
+
+func TestSQLStoreErrors(t *testing.T) {
+	db := openTestSQLDB(t, ":memory:")
+	defer db.Close()
+	s, err := newSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.GetUser(1); err != ErrUserNotFound {
+		t.Errorf("GetUser: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err = s.GetUserID("a"); err != ErrUserNotFound {
+		t.Errorf("GetUserID: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err = s.GetSession("a"); err != ErrSessionNotFound {
+		t.Errorf("GetSession: expected ErrSessionNotFound, got %v", err)
+	}
+	if err = s.DeleteUser(1); err != ErrUserNotFound {
+		t.Errorf("DeleteUser: expected ErrUserNotFound, got %v", err)
+	}
+	if err = s.RenameUser(1, "a"); err != ErrUserNotFound {
+		t.Errorf("RenameUser: expected ErrUserNotFound, got %v", err)
+	}
+
+	id, err := s.AddUser(&StoredUser{Name: "a"})
+	if err != nil || id != 1 {
+		t.Fatalf("AddUser: expected ID 1, got %d %v", id, err)
+	}
+	if _, err = s.AddUser(&StoredUser{Name: "a"}); err != ErrUserExists {
+		t.Errorf("AddUser: expected ErrUserExists, got %v", err)
+	}
+	id, err = s.AddUser(&StoredUser{Name: "b"})
+	if err != nil || id != 2 {
+		t.Fatalf("AddUser: expected ID 2, got %d %v", id, err)
+	}
+	if err = s.RenameUser(2, "a"); err != ErrUserExists {
+		t.Errorf("RenameUser: expected ErrUserExists, got %v", err)
+	}
+	if err = s.PutUser(&StoredUser{ID: 2, Name: "a"}); err != ErrUserExists {
+		t.Errorf("PutUser: expected ErrUserExists, got %v", err)
+	}
+
+	// saving unchanged rows updates them, instead of inserting duplicates
+	u := &StoredUser{ID: 2, Name: "b"}
+	sess := &StoredSession{ID: "s", UserID: 2}
+	g := &Group{ID: 1, Name: "g"}
+	tok := &StoredToken{ID: "t", Kind: "k"}
+	for i := 0; i < 2; i++ {
+		if err = s.PutUser(u); err != nil {
+			t.Errorf("PutUser %d: %v", i, err)
+		}
+		if err = s.RenameUser(2, "b"); err != nil {
+			t.Errorf("RenameUser %d: %v", i, err)
+		}
+		if err = s.PutSession(sess); err != nil {
+			t.Errorf("PutSession %d: %v", i, err)
+		}
+		if err = s.PutGroup(g); err != nil {
+			t.Errorf("PutGroup %d: %v", i, err)
+		}
+		if err = s.PutToken(tok); err != nil {
+			t.Errorf("PutToken %d: %v", i, err)
+		}
+	}
+}
+
+func TestSQLUserExists(t *testing.T) {
+	for msg, expected := range map[string]error{
+		"UNIQUE constraint failed: crowd_users.name":                              ErrUserExists,
+		"UNIQUE constraint failed: crowd_users.email":                             ErrEmailExists,
+		"Error 1062: Duplicate entry 'myemail' for key 'crowd_users.name'":        ErrUserExists,
+		"Error 1062: Duplicate entry 'a@example.com' for key 'crowd_users_email'": ErrEmailExists,
+		`pq: duplicate key value violates unique constraint "crowd_users_name"`:   ErrUserExists,
+		`pq: duplicate key value violates unique constraint "crowd_users_email"`:  ErrEmailExists,
+	} {
+		if err := sqlUserExists(errors.New(msg)); err != expected {
+			t.Errorf("%s: expected %v, got %v", msg, expected, err)
+		}
+	}
+
+	db := openTestSQLDB(t, ":memory:")
+	defer db.Close()
+	s, err := newSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.AddUser(&StoredUser{Name: "myemail"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.AddUser(&StoredUser{Name: "myemail"}); err != ErrUserExists {
+		t.Errorf("AddUser: expected ErrUserExists, got %v", err)
+	}
+}
+
+func TestSQLStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crowd.db")
+	db := openTestSQLDB(t, path)
+	store, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.IDSaveData(u.Session.ID, "some data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.StopSessionGC()
+	db.Close()
+
+	db = openTestSQLDB(t, path)
+	defer db.Close()
+	store, err = NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.StopSessionGC()
+	got, err := store.IDGet(u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LoggedIn || got.Name != "alice" || got.Data != "some data" {
+		t.Errorf("unexpected user after reopening: %+v", got)
+	}
+	_, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Error("login after reopening:", err)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxCookieSize is the size limit of a cookie that browsers support,
+// including its name.
+const maxCookieSize = 4096
+
+// sessionEncryptionPurpose derives the AES keys of stateless sessions from
+// the keys of a Keyring.
+const sessionEncryptionPurpose = "crowd session encryption"
+
+// ErrCookieTooLarge is returned when an encrypted session doesn't fit
+// into a cookie.
+var ErrCookieTooLarge = errors.New("Session cookie too large")
+
+// sessionStorer is the part of the Storer that keeps sessions. It is the
+// backend, unless the Store uses stateless sessions.
+type sessionStorer interface {
+	GetSession(id string) (*StoredSession, error)
+	PutSession(s *StoredSession) error
+	DeleteSession(id string) error
+}
+
+// RevocationList keeps the revoked sessions of a Store with stateless
+// sessions, which can't be deleted because they are stored in the cookie.
+// It only holds sessions that were explicitly revoked and is consulted on
+// every request, so it should answer from memory. The until times are the
+// latest expiration time of the revoked sessions, after that the entries
+// can be dropped.
+type RevocationList interface {
+	// Revoke the session with the ID
+	RevokeSession(id string, until time.Time) error
+	// Revoke all sessions of the user that were issued before the time,
+	// except the one with the ID except, which can be empty. A session
+	// that was revoked before stays revoked when it is excepted later
+	RevokeUser(userID uint64, before, until time.Time, except string) error
+	// Report whether the session with the ID of the user, which was
+	// issued at the time, is revoked
+	Revoked(id string, userID uint64, issued time.Time) (bool, error)
+}
+
+// MemoryRevocationList is a RevocationList that is kept in memory. It is
+// the default of a Store with stateless sessions. Revocations are lost on
+// restart and are not shared with other processes.
+type MemoryRevocationList struct {
+	mutex    sync.RWMutex
+	sessions map[string]time.Time
+	users    map[uint64]revokedUser
+}
+
+// revokedUser revokes the sessions of a user that were issued before
+// before. The session with the ID except is only spared if it was issued
+// after exceptAfter, the time of the previous revocation that didn't
+// except it.
+type revokedUser struct {
+	before      time.Time
+	until       time.Time
+	except      string
+	exceptAfter time.Time
+}
+
+// NewMemoryRevocationList returns an empty MemoryRevocationList.
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{
+		sessions: make(map[string]time.Time),
+		users:    make(map[uint64]revokedUser),
+	}
+}
+
+// RevokeSession adds the session to the list.
+func (l *MemoryRevocationList) RevokeSession(id string, until time.Time) error {
+	l.mutex.Lock()
+	l.prune(time.Now())
+	l.sessions[id] = until
+	l.mutex.Unlock()
+	return nil
+}
+
+// RevokeUser adds the user to the list.
+func (l *MemoryRevocationList) RevokeUser(userID uint64, before, until time.Time, except string) error {
+	l.mutex.Lock()
+	l.prune(time.Now())
+	next := revokedUser{before: before, until: until, except: except}
+	if prev, ok := l.users[userID]; ok {
+		next.exceptAfter = prev.before
+		if prev.except == except {
+			next.exceptAfter = prev.exceptAfter
+		}
+	}
+	l.users[userID] = next
+	l.mutex.Unlock()
+	return nil
+}
+
+// Revoked reports whether the session or all sessions of the user before
+// issued are revoked.
+func (l *MemoryRevocationList) Revoked(id string, userID uint64, issued time.Time) (bool, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if _, ok := l.sessions[id]; ok {
+		return true, nil
+	}
+	u, ok := l.users[userID]
+	if !ok || !issued.Before(u.before) {
+		return false, nil
+	}
+	spared := u.except != "" && id == u.except && !issued.Before(u.exceptAfter)
+	return !spared, nil
+}
+
+// prune needs to be called with mutex held.
+func (l *MemoryRevocationList) prune(now time.Time) {
+	for id, until := range l.sessions {
+		if now.After(until) {
+			delete(l.sessions, id)
+		}
+	}
+	for id, u := range l.users {
+		if now.After(u.until) {
+			delete(l.users, id)
+		}
+	}
+}
+
+// cookieSessions is the sessionStorer of stateless sessions. The IDs that
+// are passed to GetSession are the encrypted cookie values, the returned
+// sessions have their random session ID.
+type cookieSessions struct {
+	keys       *Keyring
+	revoked    RevocationList
+	cookieName string
+	maxTTL     time.Duration
+}
+
+// cookieSession is the encrypted content of a stateless session cookie.
+type cookieSession struct {
+	ID                  string    `json:"i"`
+	Expires             time.Time `json:"e"`
+	LastAccess          time.Time `json:"a"`
+	LoggedIn            bool      `json:"l,omitempty"`
+	UserID              uint64    `json:"u,omitempty"`
+	SecondFactorPending bool      `json:"p,omitempty"`
+	FixedExpiry         bool      `json:"f,omitempty"`
+	Issued              time.Time `json:"t"`
+}
+
+// sealedSession caches the encrypted value of a session together with the
+// content it was encrypted from, so that PutSession and the cookie of a
+// request share one encryption.
+type sealedSession struct {
+	content cookieSession
+	value   string
+}
+
+// GetSession decrypts the cookie value. Values that can't be decrypted and
+// revoked sessions return ErrSessionNotFound.
+func (c *cookieSessions) GetSession(value string) (*StoredSession, error) {
+	cs, ok := c.decode(value)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	revoked, err := c.revoked.Revoked(cs.ID, cs.UserID, cs.Issued)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrSessionNotFound
+	}
+	return &StoredSession{
+		ID:                  cs.ID,
+		Expires:             cs.Expires,
+		LastAccess:          cs.LastAccess,
+		LoggedIn:            cs.LoggedIn,
+		UserID:              cs.UserID,
+		SecondFactorPending: cs.SecondFactorPending,
+		FixedExpiry:         cs.FixedExpiry,
+		issued:              cs.Issued,
+	}, nil
+}
+
+// PutSession only checks that the session fits into a cookie, which is
+// written by the Cookie methods of the Store with the value that is cached
+// in the session.
+func (c *cookieSessions) PutSession(sess *StoredSession) error {
+	value, err := c.encode(sess)
+	if err != nil {
+		return err
+	}
+	if len(c.cookieName)+1+len(value) > maxCookieSize {
+		return ErrCookieTooLarge
+	}
+	return nil
+}
+
+// DeleteSession revokes the session, cookies with it stay valid otherwise.
+func (c *cookieSessions) DeleteSession(id string) error {
+	return c.revoked.RevokeSession(id, time.Now().Add(c.maxTTL))
+}
+
+// revokeUser revokes all sessions of the user that were issued until now,
+// except the session with the ID except.
+func (c *cookieSessions) revokeUser(userID uint64, except string) error {
+	now := time.Now()
+	return c.revoked.RevokeUser(userID, now, now.Add(c.maxTTL), except)
+}
+
+// sessionID returns the ID of the session in an encrypted value. Other
+// values are returned unchanged, they are already session IDs.
+func (c *cookieSessions) sessionID(value string) string {
+	if cs, ok := c.decode(value); ok {
+		return cs.ID
+	}
+	return value
+}
+
+// encode encrypts the session with AES-GCM using the primary key. The
+// cookie name is authenticated as additional data. The value is cached in
+// sess until the session changes. The issue time is kept from the creation
+// of the session, so that RevokeUser also revokes refreshed cookies.
+func (c *cookieSessions) encode(sess *StoredSession) (string, error) {
+	if sess.issued.IsZero() {
+		sess.issued = time.Now()
+	}
+	cs := cookieSession{
+		ID:                  sess.ID,
+		Expires:             sess.Expires,
+		LastAccess:          sess.LastAccess,
+		LoggedIn:            sess.LoggedIn,
+		UserID:              sess.UserID,
+		SecondFactorPending: sess.SecondFactorPending,
+		FixedExpiry:         sess.FixedExpiry,
+		Issued:              sess.issued,
+	}
+	if sess.sealed.value != "" && sess.sealed.content == cs {
+		return sess.sealed.value, nil
+	}
+	plain, err := json.Marshal(cs)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newSessionAEAD(c.keys.derive(sessionEncryptionPurpose)[0])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, []byte(c.cookieName))
+	value := base64.RawURLEncoding.EncodeToString(sealed)
+	sess.sealed = sealedSession{content: cs, value: value}
+	return value, nil
+}
+
+// decode decrypts a cookie value with any of the keys.
+func (c *cookieSessions) decode(value string) (*cookieSession, bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+	for _, key := range c.keys.derive(sessionEncryptionPurpose) {
+		aead, err := newSessionAEAD(key)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil, false
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plain, err := aead.Open(nil, nonce, ciphertext, []byte(c.cookieName))
+		if err != nil {
+			continue
+		}
+		var cs cookieSession
+		if json.Unmarshal(plain, &cs) != nil {
+			return nil, false
+		}
+		return &cs, true
+	}
+	return nil, false
+}
+
+func newSessionAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// statelessSessions returns the stateless session storer, or nil if the
+// Store keeps sessions in the backend.
+func (s *Store) statelessSessions() *cookieSessions {
+	c, _ := s.sessions.(*cookieSessions)
+	return c
+}
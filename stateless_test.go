@@ -0,0 +1,338 @@
+package crowd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newStatelessTestStore(t *testing.T) (*Store, *countingStorer, *Keyring) {
+	k, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingStorer{Storer: NewMemoryStore(WithGCInterval(0)).store}
+	return NewStore(backend, WithStatelessSessions(k), WithGCInterval(0)), backend, k
+}
+
+// cookieGet calls CookieGet with the cookie and returns the user and the
+// cookie that was set in the response, or the passed one.
+func cookieGet(t *testing.T, store *Store, c *http.Cookie) (*User, *http.Cookie) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	if c != nil {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	u, err := store.CookieGet(w, r)
+	if err != nil {
+		t.Fatal("CookieGet:", err)
+	}
+	return u, responseCookie(w, c)
+}
+
+func responseCookie(w *httptest.ResponseRecorder, c *http.Cookie) *http.Cookie {
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		return c
+	}
+	return cookies[len(cookies)-1]
+}
+
+func TestStatelessSessions(t *testing.T) {
+	store, backend, _ := newStatelessTestStore(t)
+	_, anon := cookieGet(t, store, nil)
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(anon)
+	w := httptest.NewRecorder()
+	u, err := store.CookieRegister(w, r, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggedIn := responseCookie(w, nil)
+	if strings.Contains(loggedIn.Value, u.Session.ID) {
+		t.Errorf("cookie contains the plain session ID")
+	}
+
+	backend.gets = 0
+	got, c := cookieGet(t, store, loggedIn)
+	if !got.LoggedIn || got.Name != "alice" || got.Session.ID != u.Session.ID {
+		t.Errorf("unexpected user %+v", got)
+	}
+	if backend.gets != 0 {
+		t.Errorf("session was looked up in the backend")
+	}
+	count := 0
+	backend.ForEachSession(func(*StoredSession) bool {
+		count++
+		return false
+	})
+	if count != 0 {
+		t.Errorf("%d sessions were saved in the backend", count)
+	}
+
+	// the refreshed cookie works as well
+	if got, _ = cookieGet(t, store, c); !got.LoggedIn {
+		t.Errorf("refreshed cookie is not logged in")
+	}
+
+	tampered := *loggedIn
+	tampered.Value = loggedIn.Value[:len(loggedIn.Value)-2] + "AA"
+	if got, _ = cookieGet(t, store, &tampered); got.LoggedIn {
+		t.Errorf("tampered cookie is logged in")
+	}
+	other := NewStore(backend, WithStatelessSessions(mustKeyring(t, testKey(1))),
+		WithCookieName("other"), WithGCInterval(0))
+	renamed := *loggedIn
+	renamed.Name = "other"
+	if got, _ = cookieGet(t, other, &renamed); got.LoggedIn {
+		t.Errorf("cookie is valid under another name")
+	}
+
+	// logout revokes the logged in cookie
+	r = httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(loggedIn)
+	w = httptest.NewRecorder()
+	out, err := store.CookieLogout(w, r)
+	if err != nil || out.LoggedIn || out.Session.ID == u.Session.ID {
+		t.Errorf("CookieLogout: got %+v %v", out, err)
+	}
+	if got, _ = cookieGet(t, store, loggedIn); got.LoggedIn {
+		t.Errorf("cookie is still logged in after logout")
+	}
+	if got, _ = cookieGet(t, store, c); got.LoggedIn {
+		t.Errorf("refreshed cookie is still logged in after logout")
+	}
+}
+
+func TestStatelessRevokeAll(t *testing.T) {
+	store, _, _ := newStatelessTestStore(t)
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cookies []*http.Cookie
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		_, err = store.CookieLogin(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies = append(cookies, responseCookie(w, nil))
+	}
+	if _, err = store.RevokeAllSessions(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range cookies {
+		if got, _ := cookieGet(t, store, c); got.LoggedIn {
+			t.Errorf("cookie %d is still logged in", i)
+		}
+	}
+	// new logins are not affected
+	w := httptest.NewRecorder()
+	_, err = store.CookieLogin(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cookieGet(t, store, responseCookie(w, nil)); !got.LoggedIn {
+		t.Errorf("new login is revoked")
+	}
+}
+
+func TestStatelessRevokeOthers(t *testing.T) {
+	store := NewStore(NewMemoryStore(WithGCInterval(0)).store,
+		WithStatelessSessions(mustKeyring(t, testKey(1))), WithGCInterval(0))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []*User
+	var cookies []*http.Cookie
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		u, err := store.CookieLogin(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+		cookies = append(cookies, responseCookie(w, nil))
+	}
+	current, err := store.IDIssueRefreshToken(cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := store.IDIssueRefreshToken(cookies[1].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the current session can be passed by its ID
+	if _, err = store.RevokeAllSessions(1, users[0].Session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cookieGet(t, store, cookies[0]); !got.LoggedIn {
+		t.Errorf("current session was revoked")
+	}
+	for i, c := range cookies[1:] {
+		if got, _ := cookieGet(t, store, c); got.LoggedIn {
+			t.Errorf("cookie %d is still logged in", i+1)
+		}
+	}
+	if _, _, err = store.IDRefresh(other); err != ErrRefreshTokenInvalid {
+		t.Errorf("expected ErrRefreshTokenInvalid, got %v", err)
+	}
+	if _, _, err = store.IDRefresh(current); err != nil {
+		t.Errorf("refresh token of the current session was revoked: %v", err)
+	}
+
+	// or by its token, and a revoked session isn't spared later
+	if _, err = store.RevokeAllSessions(1, cookies[1].Value); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cookieGet(t, store, cookies[0]); got.LoggedIn {
+		t.Errorf("previous current session is still logged in")
+	}
+	if got, _ := cookieGet(t, store, cookies[1]); got.LoggedIn {
+		t.Errorf("revoked session was restored")
+	}
+}
+
+func TestStatelessRevokeSessionRefresh(t *testing.T) {
+	store := NewStore(NewMemoryStore(WithGCInterval(0)).store,
+		WithStatelessSessions(mustKeyring(t, testKey(1))), WithGCInterval(0))
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func() (*User, string, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		u, err := store.CookieLogin(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := responseCookie(w, nil).Value
+		token, err := store.IDIssueRefreshToken(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u, value, token
+	}
+
+	// the session can be revoked by its ID, by its token or logged out
+	u, _, byID := login()
+	_, value, byToken := login()
+	_, logout, loggedOut := login()
+	if err = store.RevokeSession(u.Session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RevokeSession(value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.IDLogout(logout); err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"ID": byID, "token": byToken, "logout": loggedOut,
+	} {
+		if _, _, err = store.IDRefresh(token); err != ErrRefreshTokenInvalid {
+			t.Errorf("%s: expected ErrRefreshTokenInvalid, got %v", name, err)
+		}
+	}
+	if got, _ := store.IDGet(value); got.LoggedIn {
+		t.Errorf("session revoked by its token is still logged in")
+	}
+}
+
+func TestStatelessIssued(t *testing.T) {
+	store, _, _ := newStatelessTestStore(t)
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	_, err = store.CookieLogin(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := store.statelessSessions()
+	sess, err := c.GetSession(responseCookie(w, nil).Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the encrypted value is reused until the session changes
+	value, err := c.encode(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.encode(sess); again != value {
+		t.Errorf("unchanged session was encrypted again")
+	}
+	store.refreshExpiry(sess)
+	if again, _ := c.encode(sess); again == value {
+		t.Errorf("changed session kept the old value")
+	}
+
+	// a session that is refreshed after the revocation keeps its issue time
+	if _, err = store.RevokeAllSessions(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	store.refreshExpiry(sess)
+	value, err = c.encode(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.GetSession(value); err != ErrSessionNotFound {
+		t.Errorf("refreshed session escaped the revocation: %v", err)
+	}
+}
+
+func TestStatelessKeyRotation(t *testing.T) {
+	store, _, k := newStatelessTestStore(t)
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	_, err = store.CookieLogin(w, httptest.NewRequest("POST", "/", nil), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := responseCookie(w, nil)
+
+	if err = k.Rotate(testKey(2), 1); err != nil {
+		t.Fatal(err)
+	}
+	got, next := cookieGet(t, store, c)
+	if !got.LoggedIn {
+		t.Fatalf("cookie of the previous key is not accepted")
+	}
+	if err = k.Rotate(testKey(3), 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = cookieGet(t, store, c); got.LoggedIn {
+		t.Errorf("cookie of a dropped key is accepted")
+	}
+	if got, _ = cookieGet(t, store, next); !got.LoggedIn {
+		t.Errorf("cookie that was re-encrypted with the new key is not accepted")
+	}
+}
+
+func TestStatelessCookieSize(t *testing.T) {
+	store, _, _ := newStatelessTestStore(t)
+	sess := &StoredSession{ID: strings.Repeat("x", maxCookieSize)}
+	if err := store.sessions.PutSession(sess); err != ErrCookieTooLarge {
+		t.Errorf("expected ErrCookieTooLarge, got %v", err)
+	}
+}
+
+func mustKeyring(t *testing.T, keys ...[]byte) *Keyring {
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
@@ -14,9 +14,15 @@
 package crowd
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"log"
+	"sort"
 	"sync"
 	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 // enable debug messages when store functions are called
@@ -28,21 +34,36 @@ const storeDebug = false
 // memoryStore saves the actual values behind the passed pointers.
 type memoryStore struct {
 	sessions      map[string]StoredSession
+	userSessions  map[uint64]map[string]struct{}
 	sessionsMutex sync.RWMutex
 	users         map[uint64]StoredUser
 	usersMutex    sync.RWMutex
 	userIDs       map[string]uint64
+	emailIDs      map[string]uint64
 	maxUserID     uint64
+	groups        map[uint64]Group
+	groupIDs      map[string]uint64
+	groupsMutex   sync.RWMutex
+	maxGroupID    uint64
+	tokens        map[string]StoredToken
+	userTokens    map[uint64]map[string]struct{}
+	tokensMutex   sync.Mutex
 }
 
 // NewMemoryStore returns a Store with a memory backend.
-func NewMemoryStore() *Store {
+func NewMemoryStore(opts ...Option) *Store {
 	var s = memoryStore{
-		sessions: make(map[string]StoredSession),
-		users:    make(map[uint64]StoredUser),
-		userIDs:  make(map[string]uint64),
+		sessions:     make(map[string]StoredSession),
+		userSessions: make(map[uint64]map[string]struct{}),
+		users:        make(map[uint64]StoredUser),
+		userIDs:      make(map[string]uint64),
+		emailIDs:     make(map[string]uint64),
+		groups:       make(map[uint64]Group),
+		groupIDs:     make(map[string]uint64),
+		tokens:       make(map[string]StoredToken),
+		userTokens:   make(map[uint64]map[string]struct{}),
 	}
-	return NewStore(&s)
+	return NewStore(&s, opts...)
 }
 
 func (s *memoryStore) nextUserID() uint64 {
@@ -80,17 +101,40 @@ func (s *memoryStore) PutSession(sess *StoredSession) error {
 		log.Println("PutSession:", sess.ID)
 	}
 	s.sessionsMutex.Lock()
+	if old, ok := s.sessions[sess.ID]; ok && old.UserID != sess.UserID {
+		s.unindexSession(old.UserID, old.ID)
+	}
 	s.sessions[sess.ID] = *sess
+	if sess.UserID != 0 {
+		ids := s.userSessions[sess.UserID]
+		if ids == nil {
+			ids = make(map[string]struct{})
+			s.userSessions[sess.UserID] = ids
+		}
+		ids[sess.ID] = struct{}{}
+	}
 	s.sessionsMutex.Unlock()
 	return nil
 }
 
+// unindexSession needs to be called with sessionsMutex held.
+func (s *memoryStore) unindexSession(userID uint64, id string) {
+	ids := s.userSessions[userID]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(s.userSessions, userID)
+	}
+}
+
 // DeleteSession deletes a session object from the memoryStore
 func (s *memoryStore) DeleteSession(id string) error {
 	if storeDebug {
 		log.Println("DeleteSession:", id)
 	}
 	s.sessionsMutex.Lock()
+	if old, ok := s.sessions[id]; ok {
+		s.unindexSession(old.UserID, id)
+	}
 	delete(s.sessions, id)
 	s.sessionsMutex.Unlock()
 	return nil
@@ -106,6 +150,9 @@ func (s *memoryStore) ForEachSession(fn func(s *StoredSession) (del bool)) error
 		if fn(&v) {
 			s.sessionsMutex.RUnlock()
 			s.sessionsMutex.Lock()
+			if old, ok := s.sessions[k]; ok {
+				s.unindexSession(old.UserID, k)
+			}
 			delete(s.sessions, k)
 			s.sessionsMutex.Unlock()
 			s.sessionsMutex.RLock()
@@ -115,6 +162,21 @@ func (s *memoryStore) ForEachSession(fn func(s *StoredSession) (del bool)) error
 	return nil
 }
 
+// GetUserSessions gets all sessions of a user from the memoryStore
+func (s *memoryStore) GetUserSessions(userID uint64) ([]*StoredSession, error) {
+	if storeDebug {
+		log.Println("GetUserSessions:", userID)
+	}
+	s.sessionsMutex.RLock()
+	sessions := make([]*StoredSession, 0, len(s.userSessions[userID]))
+	for id := range s.userSessions[userID] {
+		sess := s.sessions[id]
+		sessions = append(sessions, &sess)
+	}
+	s.sessionsMutex.RUnlock()
+	return sessions, nil
+}
+
 // GetUser gets a User object via the user ID from the memoryStore
 func (s *memoryStore) GetUser(id uint64) (*StoredUser, error) {
 	if storeDebug {
@@ -143,14 +205,55 @@ func (s *memoryStore) GetUserID(username string) (uint64, error) {
 	return uid, nil
 }
 
-// PutUser puts a User object in the memoryStore
+// GetUserIDByEmail gets the user ID via the email address from the memoryStore
+func (s *memoryStore) GetUserIDByEmail(email string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetUserIDByEmail:", email)
+	}
+	s.usersMutex.RLock()
+	uid, ok := s.emailIDs[email]
+	s.usersMutex.RUnlock()
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return uid, nil
+}
+
+// PutUser puts a User object in the memoryStore. The username and email
+// indexes are updated if the name or email of the user changed.
 func (s *memoryStore) PutUser(u *StoredUser) error {
 	if storeDebug {
 		log.Println("PutUser:", u.ID, u.Name)
 	}
 	s.usersMutex.Lock()
-	s.users[u.ID] = *u
+	err := s.putUser(u)
 	s.usersMutex.Unlock()
+	return err
+}
+
+// putUser needs to be called with usersMutex held. It returns ErrUserExists
+// if the name belongs to another user and ErrEmailExists if the email does.
+func (s *memoryStore) putUser(u *StoredUser) error {
+	if other, ok := s.userIDs[u.Name]; ok && other != u.ID {
+		return ErrUserExists
+	}
+	email := indexedEmail(u)
+	if other, ok := s.emailIDs[email]; ok && email != "" && other != u.ID {
+		return ErrEmailExists
+	}
+	if old, ok := s.users[u.ID]; ok {
+		if old.Name != u.Name {
+			delete(s.userIDs, old.Name)
+		}
+		if oldEmail := indexedEmail(&old); oldEmail != email {
+			delete(s.emailIDs, oldEmail)
+		}
+	}
+	s.users[u.ID] = *u
+	s.userIDs[u.Name] = u.ID
+	if email != "" {
+		s.emailIDs[email] = u.ID
+	}
 	return nil
 }
 
@@ -162,12 +265,13 @@ func (s *memoryStore) AddUser(u *StoredUser) (uint64, error) {
 	if u == nil {
 		panic("AddUser: argument stored user is nil")
 	}
-	u.ID = s.nextUserID()
 	s.usersMutex.Lock()
-	s.users[u.ID] = *u
-	s.userIDs[u.Name] = u.ID
-	s.usersMutex.Unlock()
-	return u.ID, nil
+	defer s.usersMutex.Unlock()
+	if _, ok := s.userIDs[u.Name]; ok {
+		return 0, ErrUserExists
+	}
+	u.ID = s.nextUserID()
+	return u.ID, s.putUser(u)
 }
 
 // RenameUser renames a user while keeping the ID the same
@@ -176,17 +280,13 @@ func (s *memoryStore) RenameUser(id uint64, newname string) error {
 		log.Println("RenameUser:", id, newname)
 	}
 	s.usersMutex.Lock()
+	defer s.usersMutex.Unlock()
 	u, ok := s.users[id]
 	if !ok {
-		s.usersMutex.Unlock()
 		return ErrUserNotFound
 	}
-	delete(s.userIDs, u.Name)
 	u.Name = newname
-	s.userIDs[newname] = id
-	s.users[id] = u
-	s.usersMutex.Unlock()
-	return nil
+	return s.putUser(&u)
 }
 
 // DeleteUser deletes a user object from the memoryStore
@@ -202,6 +302,7 @@ func (s *memoryStore) DeleteUser(id uint64) error {
 	}
 	delete(s.users, id)
 	delete(s.userIDs, u.Name)
+	delete(s.emailIDs, indexedEmail(&u))
 	s.usersMutex.Unlock()
 	return nil
 }
@@ -213,10 +314,17 @@ func (s *memoryStore) ForEachUser(fn func(u *StoredUser) (del bool)) error {
 	}
 	s.usersMutex.RLock()
 	for k, v := range s.users {
+		name, email := v.Name, indexedEmail(&v)
 		if fn(&v) {
 			s.usersMutex.RUnlock()
 			s.usersMutex.Lock()
 			delete(s.users, k)
+			if s.userIDs[name] == k {
+				delete(s.userIDs, name)
+			}
+			if email != "" && s.emailIDs[email] == k {
+				delete(s.emailIDs, email)
+			}
 			s.usersMutex.Unlock()
 			s.usersMutex.RLock()
 		}
@@ -225,174 +333,1069 @@ func (s *memoryStore) ForEachUser(fn func(u *StoredUser) (del bool)) error {
 	return nil
 }
 
-// type boltDBStore struct {
-// 	db         *bolt.DB
-// 	sessBucket []byte
-// 	userBucket []byte
-// }
-
-// // NewBoltDBStore returns a Store that used the passed BoltDB as
-// // a storage backend.
-// func NewBoltDBStore(db *bolt.DB) (*Store, error) {
-// 	err := db.Update(func(tx *bolt.Tx) error {
-// 		_, err := tx.CreateBucketIfNotExists([]byte("users.S"))
-// 		if err != nil {
-// 			return err
-// 		}
-// 		_, err = tx.CreateBucketIfNotExists([]byte("users.U"))
-// 		if err != nil {
-// 			return err
-// 		}
-// 		return nil
-// 	})
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	var s = boltDBStore{
-// 		db:         db,
-// 		sessBucket: []byte("users.S"),
-// 		userBucket: []byte("users.U"),
-// 	}
-// 	return NewStore(&s), nil
-// }
-
-// // GetSession gets a Session object from the boltDBStore
-// func (s *boltDBStore) GetSession(id string) (*StoredSession, error) {
-// 	if storeDebug {
-// 		log.Println("GetSession:", id)
-// 	}
-// 	var sess StoredSession
-// 	err := s.db.View(func(tx *bolt.Tx) error {
-// 		val := tx.Bucket(s.sessBucket).Get([]byte(id))
-// 		if val == nil {
-// 			return ErrSessionNotFound
-// 		}
-// 		return json.Unmarshal(val, &sess)
-// 	})
-// 	return &sess, err
-// }
-
-// // PutSession puts a Session object in the boltDBStore
-// func (s *boltDBStore) PutSession(sess *StoredSession) error {
-// 	if storeDebug {
-// 		log.Println("PutSession:", sess.ID)
-// 	}
-// 	return s.db.Update(func(tx *bolt.Tx) error {
-// 		val, err := json.Marshal(sess)
-// 		if err != nil {
-// 			return err
-// 		}
-// 		return tx.Bucket(s.sessBucket).Put([]byte(sess.ID), val)
-// 	})
-// }
-
-// // DeleteSession deletes a session object from the boltDBStore
-// func (s *boltDBStore) DeleteSession(id string) error {
-// 	if storeDebug {
-// 		log.Println("DeleteSession:", id)
-// 	}
-// 	return s.db.Update(func(tx *bolt.Tx) error {
-// 		return tx.Bucket(s.sessBucket).Delete([]byte(id))
-// 	})
-// }
-
-// // ForEachSession ranges over all sessions from the boltDBStore
-// func (s *boltDBStore) ForEachSession(fn func(s *StoredSession) (del bool)) error {
-// 	if storeDebug {
-// 		log.Println("ForEachSession")
-// 	}
-// 	var sess StoredSession
-// 	return s.db.Update(func(tx *bolt.Tx) error {
-// 		return tx.Bucket(s.sessBucket).ForEach(func(k, v []byte) error {
-// 			err := json.Unmarshal(v, &sess)
-// 			if err != nil {
-// 				return err
-// 			}
-// 			if fn(&sess) {
-// 				err := tx.Bucket(s.sessBucket).Delete(k)
-// 				if err != nil {
-// 					return err
-// 				}
-// 			}
-// 			return nil
-// 		})
-// 	})
-// }
-
-// // GetUser gets a User object from the boltDBStore
-// func (s *boltDBStore) GetUser(id uint64) (*StoredUser, error) {
-// 	if storeDebug {
-// 		log.Println("GetUser:", id)
-// 	}
-// 	var user StoredUser
-// 	err := s.db.View(func(tx *bolt.Tx) error {
-// 		val := tx.Bucket(s.userBucket).Get(itob(id))
-// 		if val == nil {
-// 			return ErrUserNotFound
-// 		}
-// 		return json.Unmarshal(val, &user)
-// 	})
-// 	return &user, err
-// }
-
-// // PutUser puts a User object in the boltDBStore
-// func (s *boltDBStore) PutUser(u *StoredUser) error {
-// 	if storeDebug {
-// 		log.Println("PutUser:", u.Name)
-// 	}
-// 	return s.db.Update(func(tx *bolt.Tx) error {
-// 		val, err := json.Marshal(u)
-// 		if err != nil {
-// 			return err
-// 		}
-// 		return tx.Bucket(s.userBucket).Put(itob(u.ID), val)
-// 	})
-// }
-
-// // DeleteUser deletes a user object from the boltDBStore
-// func (s *boltDBStore) DeleteUser(id uint64) error {
-// 	if storeDebug {
-// 		log.Println("DeleteUser:", id)
-// 	}
-// 	return s.db.Update(func(tx *bolt.Tx) error {
-// 		return tx.Bucket(s.userBucket).Delete(itob(id))
-// 	})
-// }
-
-// // ForEachUser ranges over all users from the boltDBStore
-// func (s *boltDBStore) ForEachUser(fn func(u *StoredUser) (del bool)) error {
-// 	if storeDebug {
-// 		log.Println("ForEachUser")
-// 	}
-// 	var user StoredUser
-// 	return s.db.Update(func(tx *bolt.Tx) error {
-// 		return tx.Bucket(s.userBucket).ForEach(func(k, v []byte) error {
-// 			err := json.Unmarshal(v, &user)
-// 			if err != nil {
-// 				return err
-// 			}
-// 			if fn(&user) {
-// 				err := tx.Bucket(s.userBucket).Delete(k)
-// 				if err != nil {
-// 					return err
-// 				}
-// 			}
-// 			return nil
-// 		})
-// 	})
-// }
-
-// // itob returns an 8-byte big endian representation of v.
-// func itob(v uint64) []byte {
-// 	b := make([]byte, 8)
-// 	binary.BigEndian.PutUint64(b, v)
-// 	return b
-// }
-
-// // btoi returns an uint64 from a 8-byte slice.
-// func btoi(v []byte) uint64 {
-// 	if len(v) != 8 {
-// 		log.Println("WARNING: btoi length is not 8 but", len(v))
-// 	}
-// 	return binary.BigEndian.Uint64(v)
-// }
+// GetGroup gets a Group object via the group ID from the memoryStore
+func (s *memoryStore) GetGroup(id uint64) (*Group, error) {
+	if storeDebug {
+		log.Println("GetGroup:", id)
+	}
+	s.groupsMutex.RLock()
+	g, ok := s.groups[id]
+	s.groupsMutex.RUnlock()
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return copyGroup(&g), nil
+}
+
+// GetGroupID gets the group ID via the group name from the memoryStore
+func (s *memoryStore) GetGroupID(name string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetGroupID:", name)
+	}
+	s.groupsMutex.RLock()
+	id, ok := s.groupIDs[name]
+	s.groupsMutex.RUnlock()
+	if !ok {
+		return 0, ErrGroupNotFound
+	}
+	return id, nil
+}
+
+// PutGroup puts a Group object in the memoryStore
+func (s *memoryStore) PutGroup(g *Group) error {
+	if storeDebug {
+		log.Println("PutGroup:", g.ID, g.Name)
+	}
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+	return s.putGroup(g)
+}
+
+// putGroup needs to be called with groupsMutex held.
+func (s *memoryStore) putGroup(g *Group) error {
+	if other, ok := s.groupIDs[g.Name]; ok && other != g.ID {
+		return ErrGroupExists
+	}
+	if old, ok := s.groups[g.ID]; ok && old.Name != g.Name {
+		delete(s.groupIDs, old.Name)
+	}
+	s.groups[g.ID] = *copyGroup(g)
+	s.groupIDs[g.Name] = g.ID
+	return nil
+}
+
+// AddGroup puts a new Group object in the memoryStore and returns the group ID
+func (s *memoryStore) AddGroup(g *Group) (uint64, error) {
+	if storeDebug {
+		log.Println("AddGroup:", g.Name)
+	}
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+	if _, ok := s.groupIDs[g.Name]; ok {
+		return 0, ErrGroupExists
+	}
+	s.maxGroupID++
+	g.ID = s.maxGroupID
+	return g.ID, s.putGroup(g)
+}
+
+// DeleteGroup deletes a group object from the memoryStore
+func (s *memoryStore) DeleteGroup(id uint64) error {
+	if storeDebug {
+		log.Println("DeleteGroup:", id)
+	}
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+	g, ok := s.groups[id]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	delete(s.groups, id)
+	delete(s.groupIDs, g.Name)
+	return nil
+}
+
+// GetUserGroups gets all groups of a user from the memoryStore
+func (s *memoryStore) GetUserGroups(userID uint64) ([]*Group, error) {
+	if storeDebug {
+		log.Println("GetUserGroups:", userID)
+	}
+	var groups []*Group
+	s.groupsMutex.RLock()
+	for _, g := range s.groups {
+		if g.IsMember(userID) {
+			groups = append(groups, copyGroup(&g))
+		}
+	}
+	s.groupsMutex.RUnlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+// GetToken gets a Token object from the memoryStore
+func (s *memoryStore) GetToken(id string) (*StoredToken, error) {
+	if storeDebug {
+		log.Println("GetToken:", id)
+	}
+	s.tokensMutex.Lock()
+	t, ok := s.tokens[id]
+	s.tokensMutex.Unlock()
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &t, nil
+}
+
+// PutToken puts a Token object in the memoryStore
+func (s *memoryStore) PutToken(t *StoredToken) error {
+	if storeDebug {
+		log.Println("PutToken:", t.ID)
+	}
+	s.tokensMutex.Lock()
+	s.unindexToken(t.ID)
+	s.tokens[t.ID] = *t
+	s.indexToken(t)
+	s.tokensMutex.Unlock()
+	return nil
+}
+
+// AddToken puts a Token object in the memoryStore if its ID is unused
+func (s *memoryStore) AddToken(t *StoredToken) error {
+	if storeDebug {
+		log.Println("AddToken:", t.ID)
+	}
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	if _, ok := s.tokens[t.ID]; ok {
+		return ErrTokenExists
+	}
+	s.tokens[t.ID] = *t
+	s.indexToken(t)
+	return nil
+}
+
+// TakeToken gets and deletes a Token object from the memoryStore
+func (s *memoryStore) TakeToken(id string) (*StoredToken, error) {
+	if storeDebug {
+		log.Println("TakeToken:", id)
+	}
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	s.unindexToken(id)
+	delete(s.tokens, id)
+	return &t, nil
+}
+
+// DeleteToken deletes a Token object from the memoryStore
+func (s *memoryStore) DeleteToken(id string) error {
+	if storeDebug {
+		log.Println("DeleteToken:", id)
+	}
+	s.tokensMutex.Lock()
+	s.unindexToken(id)
+	delete(s.tokens, id)
+	s.tokensMutex.Unlock()
+	return nil
+}
+
+// ForEachToken ranges over all tokens from the memoryStore
+func (s *memoryStore) ForEachToken(fn func(t *StoredToken) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachToken")
+	}
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	for k, v := range s.tokens {
+		if fn(&v) {
+			s.unindexToken(k)
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
+
+// GetUserTokens gets all tokens of a user from the memoryStore
+func (s *memoryStore) GetUserTokens(userID uint64) ([]*StoredToken, error) {
+	if storeDebug {
+		log.Println("GetUserTokens:", userID)
+	}
+	s.tokensMutex.Lock()
+	tokens := make([]*StoredToken, 0, len(s.userTokens[userID]))
+	for id := range s.userTokens[userID] {
+		t := s.tokens[id]
+		tokens = append(tokens, &t)
+	}
+	s.tokensMutex.Unlock()
+	return tokens, nil
+}
+
+// indexToken needs to be called with tokensMutex held.
+func (s *memoryStore) indexToken(t *StoredToken) {
+	if t.UserID == 0 {
+		return
+	}
+	ids := s.userTokens[t.UserID]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		s.userTokens[t.UserID] = ids
+	}
+	ids[t.ID] = struct{}{}
+}
+
+// unindexToken needs to be called with tokensMutex held.
+func (s *memoryStore) unindexToken(id string) {
+	old, ok := s.tokens[id]
+	if !ok || old.UserID == 0 {
+		return
+	}
+	ids := s.userTokens[old.UserID]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(s.userTokens, old.UserID)
+	}
+}
+
+var (
+	boltSessionBucket     = []byte("users.S")
+	boltUserSessionBucket = []byte("users.SU")
+	boltUserBucket        = []byte("users.U")
+	boltUsernameBucket    = []byte("users.N")
+	boltEmailBucket       = []byte("users.E")
+	boltGroupBucket       = []byte("groups.G")
+	boltGroupnameBucket   = []byte("groups.N")
+	boltUserGroupBucket   = []byte("groups.UG")
+	boltTokenBucket       = []byte("tokens.T")
+	boltUserTokenBucket   = []byte("tokens.UT")
+)
+
+// boltDBStore is a persistent backend for the Store type that saves users
+// and sessions in a BoltDB file. Users are stored under their big endian ID,
+// an additional bucket maps usernames to user IDs. The sessions of a user
+// are indexed with keys made of the user ID and session ID. Groups are
+// stored the same way as users and indexed by the IDs of their members.
+// Tokens are indexed by their user like sessions. Values are JSON encoded.
+// Do not use this directly, instead call NewBoltDBStore().
+type boltDBStore struct {
+	db *bolt.DB
+}
+
+// NewBoltDBStore returns a Store that uses the passed BoltDB as
+// a storage backend. The needed buckets are created if they don't exist.
+func NewBoltDBStore(db *bolt.DB, opts ...Option) (*Store, error) {
+	s, err := newBoltDBStore(db)
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(s, opts...), nil
+}
+
+func newBoltDBStore(db *bolt.DB) (*boltDBStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltSessionBucket, boltUserSessionBucket,
+			boltUserBucket, boltUsernameBucket, boltEmailBucket, boltGroupBucket,
+			boltGroupnameBucket, boltUserGroupBucket, boltTokenBucket,
+			boltUserTokenBucket} {
+			_, err := tx.CreateBucketIfNotExists(b)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltDBStore{db: db}, nil
+}
+
+// CountUsers returns the number of saved users
+func (s *boltDBStore) CountUsers() int {
+	if storeDebug {
+		log.Println("CountUsers")
+	}
+	count := 0
+	s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(boltUserBucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// GetSession gets a Session object from the boltDBStore
+func (s *boltDBStore) GetSession(id string) (*StoredSession, error) {
+	if storeDebug {
+		log.Println("GetSession:", id)
+	}
+	var sess StoredSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltSessionBucket).Get([]byte(id))
+		if val == nil {
+			return ErrSessionNotFound
+		}
+		return json.Unmarshal(val, &sess)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// PutSession puts a Session object in the boltDBStore
+func (s *boltDBStore) PutSession(sess *StoredSession) error {
+	if storeDebug {
+		log.Println("PutSession:", sess.ID)
+	}
+	val, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := boltUnindexSession(tx, []byte(sess.ID))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltSessionBucket).Put([]byte(sess.ID), val)
+		if err != nil {
+			return err
+		}
+		return boltIndexSession(tx, sess)
+	})
+}
+
+// DeleteSession deletes a session object from the boltDBStore
+func (s *boltDBStore) DeleteSession(id string) error {
+	if storeDebug {
+		log.Println("DeleteSession:", id)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := boltUnindexSession(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltSessionBucket).Delete([]byte(id))
+	})
+}
+
+// ForEachSession ranges over all sessions from the boltDBStore
+func (s *boltDBStore) ForEachSession(fn func(s *StoredSession) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachSession")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSessionBucket)
+		// bolt doesn't allow modifying a bucket while iterating over it
+		var del [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var sess StoredSession
+			err := json.Unmarshal(v, &sess)
+			if err != nil {
+				return err
+			}
+			if fn(&sess) {
+				del = append(del, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range del {
+			err = boltUnindexSession(tx, k)
+			if err != nil {
+				return err
+			}
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUserSessions gets all sessions of a user from the boltDBStore
+func (s *boltDBStore) GetUserSessions(userID uint64) ([]*StoredSession, error) {
+	if storeDebug {
+		log.Println("GetUserSessions:", userID)
+	}
+	var sessions []*StoredSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := itob(userID)
+		sessBucket := tx.Bucket(boltSessionBucket)
+		c := tx.Bucket(boltUserSessionBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			val := sessBucket.Get(k[len(prefix):])
+			if val == nil {
+				continue
+			}
+			var sess StoredSession
+			err := json.Unmarshal(val, &sess)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, &sess)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetUser gets a User object via the user ID from the boltDBStore
+func (s *boltDBStore) GetUser(id uint64) (*StoredUser, error) {
+	if storeDebug {
+		log.Println("GetUser:", id)
+	}
+	var user StoredUser
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltUserBucket).Get(itob(id))
+		if val == nil {
+			return ErrUserNotFound
+		}
+		return json.Unmarshal(val, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserID gets the user ID via the username from the boltDBStore
+func (s *boltDBStore) GetUserID(username string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetUserID:", username)
+	}
+	var uid uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltUsernameBucket).Get([]byte(username))
+		if val == nil {
+			return ErrUserNotFound
+		}
+		uid = btoi(val)
+		return nil
+	})
+	return uid, err
+}
+
+// GetUserIDByEmail gets the user ID via the email address from the boltDBStore
+func (s *boltDBStore) GetUserIDByEmail(email string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetUserIDByEmail:", email)
+	}
+	var uid uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltEmailBucket).Get([]byte(email))
+		if val == nil {
+			return ErrUserNotFound
+		}
+		uid = btoi(val)
+		return nil
+	})
+	return uid, err
+}
+
+// PutUser puts a User object in the boltDBStore. The username and email
+// indexes are updated if the name or email of the user changed.
+func (s *boltDBStore) PutUser(u *StoredUser) error {
+	if storeDebug {
+		log.Println("PutUser:", u.ID, u.Name)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutUser(tx, u)
+	})
+}
+
+// AddUser puts a new User object in the boltDBStore and returns the user ID
+func (s *boltDBStore) AddUser(u *StoredUser) (uint64, error) {
+	if storeDebug {
+		log.Println("AddUser:", u.ID, u.Name)
+	}
+	if u == nil {
+		panic("AddUser: argument stored user is nil")
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsernameBucket).Get([]byte(u.Name)) != nil {
+			return ErrUserExists
+		}
+		// NextSequence starts at 1, which is what the Storer interface needs
+		id, err := tx.Bucket(boltUserBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		u.ID = id
+		return boltPutUser(tx, u)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+// RenameUser renames a user while keeping the ID the same
+func (s *boltDBStore) RenameUser(id uint64, newname string) error {
+	if storeDebug {
+		log.Println("RenameUser:", id, newname)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltUserBucket).Get(itob(id))
+		if val == nil {
+			return ErrUserNotFound
+		}
+		var user StoredUser
+		err := json.Unmarshal(val, &user)
+		if err != nil {
+			return err
+		}
+		user.Name = newname
+		return boltPutUser(tx, &user)
+	})
+}
+
+// DeleteUser deletes a user object from the boltDBStore
+func (s *boltDBStore) DeleteUser(id uint64) error {
+	if storeDebug {
+		log.Println("DeleteUser:", id)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteUser(tx, itob(id))
+	})
+}
+
+// ForEachUser ranges over all users from the boltDBStore
+func (s *boltDBStore) ForEachUser(fn func(u *StoredUser) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachUser")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var del [][]byte
+		err := tx.Bucket(boltUserBucket).ForEach(func(k, v []byte) error {
+			var user StoredUser
+			err := json.Unmarshal(v, &user)
+			if err != nil {
+				return err
+			}
+			if fn(&user) {
+				del = append(del, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range del {
+			err = boltDeleteUser(tx, k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetGroup gets a Group object via the group ID from the boltDBStore
+func (s *boltDBStore) GetGroup(id uint64) (*Group, error) {
+	if storeDebug {
+		log.Println("GetGroup:", id)
+	}
+	var g *Group
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		g, err = boltGetGroup(tx, itob(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// GetGroupID gets the group ID via the group name from the boltDBStore
+func (s *boltDBStore) GetGroupID(name string) (uint64, error) {
+	if storeDebug {
+		log.Println("GetGroupID:", name)
+	}
+	var id uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltGroupnameBucket).Get([]byte(name))
+		if val == nil {
+			return ErrGroupNotFound
+		}
+		id = btoi(val)
+		return nil
+	})
+	return id, err
+}
+
+// PutGroup puts a Group object in the boltDBStore
+func (s *boltDBStore) PutGroup(g *Group) error {
+	if storeDebug {
+		log.Println("PutGroup:", g.ID, g.Name)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutGroup(tx, g)
+	})
+}
+
+// AddGroup puts a new Group object in the boltDBStore and returns the group ID
+func (s *boltDBStore) AddGroup(g *Group) (uint64, error) {
+	if storeDebug {
+		log.Println("AddGroup:", g.Name)
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltGroupnameBucket).Get([]byte(g.Name)) != nil {
+			return ErrGroupExists
+		}
+		id, err := tx.Bucket(boltGroupBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		g.ID = id
+		return boltPutGroup(tx, g)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return g.ID, nil
+}
+
+// DeleteGroup deletes a group object from the boltDBStore
+func (s *boltDBStore) DeleteGroup(id uint64) error {
+	if storeDebug {
+		log.Println("DeleteGroup:", id)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := boltGetGroup(tx, itob(id))
+		if err != nil {
+			return err
+		}
+		err = boltUnindexGroup(tx, old)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltGroupBucket).Delete(itob(id))
+	})
+}
+
+// GetUserGroups gets all groups of a user from the boltDBStore
+func (s *boltDBStore) GetUserGroups(userID uint64) ([]*Group, error) {
+	if storeDebug {
+		log.Println("GetUserGroups:", userID)
+	}
+	var groups []*Group
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := itob(userID)
+		c := tx.Bucket(boltUserGroupBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			g, err := boltGetGroup(tx, k[len(prefix):])
+			if err != nil {
+				return err
+			}
+			groups = append(groups, g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// GetToken gets a Token object from the boltDBStore
+func (s *boltDBStore) GetToken(id string) (*StoredToken, error) {
+	if storeDebug {
+		log.Println("GetToken:", id)
+	}
+	var t *StoredToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = boltGetToken(tx, []byte(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// PutToken puts a Token object in the boltDBStore
+func (s *boltDBStore) PutToken(t *StoredToken) error {
+	if storeDebug {
+		log.Println("PutToken:", t.ID)
+	}
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := boltUnindexToken(tx, []byte(t.ID))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltTokenBucket).Put([]byte(t.ID), val)
+		if err != nil {
+			return err
+		}
+		return boltIndexToken(tx, t)
+	})
+}
+
+// AddToken puts a Token object in the boltDBStore if its ID is unused
+func (s *boltDBStore) AddToken(t *StoredToken) error {
+	if storeDebug {
+		log.Println("AddToken:", t.ID)
+	}
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokenBucket)
+		if b.Get([]byte(t.ID)) != nil {
+			return ErrTokenExists
+		}
+		err := b.Put([]byte(t.ID), val)
+		if err != nil {
+			return err
+		}
+		return boltIndexToken(tx, t)
+	})
+}
+
+// TakeToken gets and deletes a Token object from the boltDBStore
+func (s *boltDBStore) TakeToken(id string) (*StoredToken, error) {
+	if storeDebug {
+		log.Println("TakeToken:", id)
+	}
+	var t *StoredToken
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		t, err = boltGetToken(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		err = boltUnindexToken(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltTokenBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DeleteToken deletes a Token object from the boltDBStore
+func (s *boltDBStore) DeleteToken(id string) error {
+	if storeDebug {
+		log.Println("DeleteToken:", id)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := boltUnindexToken(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltTokenBucket).Delete([]byte(id))
+	})
+}
+
+// ForEachToken ranges over all tokens from the boltDBStore
+func (s *boltDBStore) ForEachToken(fn func(t *StoredToken) (del bool)) error {
+	if storeDebug {
+		log.Println("ForEachToken")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokenBucket)
+		var del [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var t StoredToken
+			err := json.Unmarshal(v, &t)
+			if err != nil {
+				return err
+			}
+			if fn(&t) {
+				del = append(del, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range del {
+			err = boltUnindexToken(tx, k)
+			if err != nil {
+				return err
+			}
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUserTokens gets all tokens of a user from the boltDBStore
+func (s *boltDBStore) GetUserTokens(userID uint64) ([]*StoredToken, error) {
+	if storeDebug {
+		log.Println("GetUserTokens:", userID)
+	}
+	var tokens []*StoredToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := itob(userID)
+		c := tx.Bucket(boltUserTokenBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			t, err := boltGetToken(tx, k[len(prefix):])
+			if err == ErrTokenNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func boltGetToken(tx *bolt.Tx, key []byte) (*StoredToken, error) {
+	val := tx.Bucket(boltTokenBucket).Get(key)
+	if val == nil {
+		return nil, ErrTokenNotFound
+	}
+	var t StoredToken
+	err := json.Unmarshal(val, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func boltGetGroup(tx *bolt.Tx, key []byte) (*Group, error) {
+	val := tx.Bucket(boltGroupBucket).Get(key)
+	if val == nil {
+		return nil, ErrGroupNotFound
+	}
+	var g Group
+	err := json.Unmarshal(val, &g)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// boltPutGroup saves the group and keeps the group name and member
+// indexes consistent. It returns ErrGroupExists if the name belongs to
+// another group.
+func boltPutGroup(tx *bolt.Tx, g *Group) error {
+	names := tx.Bucket(boltGroupnameBucket)
+	key := itob(g.ID)
+	if other := names.Get([]byte(g.Name)); other != nil && btoi(other) != g.ID {
+		return ErrGroupExists
+	}
+	old, err := boltGetGroup(tx, key)
+	if err == nil {
+		err = boltUnindexGroup(tx, old)
+	}
+	if err != nil && err != ErrGroupNotFound {
+		return err
+	}
+	val, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(boltGroupBucket).Put(key, val)
+	if err != nil {
+		return err
+	}
+	err = names.Put([]byte(g.Name), key)
+	if err != nil {
+		return err
+	}
+	for _, m := range g.Members {
+		err = tx.Bucket(boltUserGroupBucket).Put(append(itob(m.UserID), key...), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltUnindexGroup removes the name and the members of g from the indexes.
+func boltUnindexGroup(tx *bolt.Tx, g *Group) error {
+	err := tx.Bucket(boltGroupnameBucket).Delete([]byte(g.Name))
+	if err != nil {
+		return err
+	}
+	for _, m := range g.Members {
+		err = tx.Bucket(boltUserGroupBucket).Delete(append(itob(m.UserID), itob(g.ID)...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltIndexToken adds the token to the index of its user.
+func boltIndexToken(tx *bolt.Tx, t *StoredToken) error {
+	if t.UserID == 0 {
+		return nil
+	}
+	key := append(itob(t.UserID), t.ID...)
+	return tx.Bucket(boltUserTokenBucket).Put(key, []byte{})
+}
+
+// boltUnindexToken removes the stored token with the given ID from the
+// index of its user.
+func boltUnindexToken(tx *bolt.Tx, id []byte) error {
+	val := tx.Bucket(boltTokenBucket).Get(id)
+	if val == nil {
+		return nil
+	}
+	var old StoredToken
+	err := json.Unmarshal(val, &old)
+	if err != nil {
+		return err
+	}
+	if old.UserID == 0 {
+		return nil
+	}
+	key := append(itob(old.UserID), id...)
+	return tx.Bucket(boltUserTokenBucket).Delete(key)
+}
+
+// boltIndexSession adds the session to the index of its user.
+func boltIndexSession(tx *bolt.Tx, sess *StoredSession) error {
+	if sess.UserID == 0 {
+		return nil
+	}
+	key := append(itob(sess.UserID), sess.ID...)
+	return tx.Bucket(boltUserSessionBucket).Put(key, []byte{})
+}
+
+// boltUnindexSession removes the stored session with the given ID
+// from the index of its user.
+func boltUnindexSession(tx *bolt.Tx, id []byte) error {
+	val := tx.Bucket(boltSessionBucket).Get(id)
+	if val == nil {
+		return nil
+	}
+	var old StoredSession
+	err := json.Unmarshal(val, &old)
+	if err != nil {
+		return err
+	}
+	if old.UserID == 0 {
+		return nil
+	}
+	key := append(itob(old.UserID), id...)
+	return tx.Bucket(boltUserSessionBucket).Delete(key)
+}
+
+// boltPutUser saves the user and keeps the username and email indexes
+// consistent. It returns ErrUserExists if the name belongs to another user
+// and ErrEmailExists if the verified email does.
+func boltPutUser(tx *bolt.Tx, u *StoredUser) error {
+	users := tx.Bucket(boltUserBucket)
+	names := tx.Bucket(boltUsernameBucket)
+	emails := tx.Bucket(boltEmailBucket)
+	key := itob(u.ID)
+	if other := names.Get([]byte(u.Name)); other != nil && btoi(other) != u.ID {
+		return ErrUserExists
+	}
+	email := indexedEmail(u)
+	if email != "" {
+		if other := emails.Get([]byte(email)); other != nil && btoi(other) != u.ID {
+			return ErrEmailExists
+		}
+	}
+	if old := users.Get(key); old != nil {
+		var oldUser StoredUser
+		err := json.Unmarshal(old, &oldUser)
+		if err != nil {
+			return err
+		}
+		if oldUser.Name != u.Name {
+			err = names.Delete([]byte(oldUser.Name))
+			if err != nil {
+				return err
+			}
+		}
+		if oldEmail := indexedEmail(&oldUser); oldEmail != "" && oldEmail != email {
+			err = emails.Delete([]byte(oldEmail))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// the session is only attached to a user for returning it to the caller
+	user := *u
+	user.StoredSession = nil
+	val, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	err = users.Put(key, val)
+	if err != nil {
+		return err
+	}
+	if email != "" {
+		err = emails.Put([]byte(email), key)
+		if err != nil {
+			return err
+		}
+	}
+	return names.Put([]byte(u.Name), key)
+}
+
+// boltDeleteUser deletes the user with the given key and its username and
+// email index.
+func boltDeleteUser(tx *bolt.Tx, key []byte) error {
+	users := tx.Bucket(boltUserBucket)
+	val := users.Get(key)
+	if val == nil {
+		return ErrUserNotFound
+	}
+	var user StoredUser
+	err := json.Unmarshal(val, &user)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(boltUsernameBucket).Delete([]byte(user.Name))
+	if err != nil {
+		return err
+	}
+	if email := indexedEmail(&user); email != "" {
+		err = tx.Bucket(boltEmailBucket).Delete([]byte(email))
+		if err != nil {
+			return err
+		}
+	}
+	return users.Delete(key)
+}
+
+// itob returns an 8-byte big endian representation of v.
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// btoi returns an uint64 from a 8-byte slice.
+func btoi(v []byte) uint64 {
+	if len(v) != 8 {
+		log.Println("WARNING: btoi length is not 8 but", len(v))
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
@@ -0,0 +1,49 @@
+package crowd_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/mbertschler/crowd"
+	"github.com/mbertschler/crowd/crowdtest"
+	bolt "go.etcd.io/bbolt"
+	_ "modernc.org/sqlite"
+)
+
+func TestMemoryStorer(t *testing.T) {
+	crowdtest.RunStorerTests(t, func(t *testing.T) crowd.Storer {
+		return crowd.NewMemoryStorer()
+	})
+}
+
+func TestBoltDBStorer(t *testing.T) {
+	crowdtest.RunStorerTests(t, func(t *testing.T) crowd.Storer {
+		db, err := bolt.Open(filepath.Join(t.TempDir(), "crowd.db"), 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		s, err := crowd.NewBoltDBStorer(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestSQLStorer(t *testing.T) {
+	crowdtest.RunStorerTests(t, func(t *testing.T) crowd.Storer {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "crowd.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		s, err := crowd.NewSQLStorer(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
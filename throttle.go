@@ -0,0 +1,292 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const tokenKindLoginAttempts = "login_attempts"
+
+// ErrTooManyAttempts is returned by logins while a username or client is
+// throttled. The returned error is a *TooManyAttemptsError, compare it
+// with errors.Is(err, ErrTooManyAttempts).
+var ErrTooManyAttempts = errors.New("Too many login attempts")
+
+// TooManyAttemptsError is returned instead of ErrTooManyAttempts. It
+// holds the time after which the next login attempt is allowed, which can
+// be sent to clients in a Retry-After header.
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrTooManyAttempts, e.RetryAfter)
+}
+
+// Is makes errors.Is(err, ErrTooManyAttempts) true.
+func (e *TooManyAttemptsError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// LoginThrottle configures the brute-force protection of password logins,
+// which is enabled with WithLoginThrottle. Failed attempts are counted per
+// username and per client key. After FreeAttempts failures, every further
+// attempt has to wait BaseDelay, which doubles with each failure up to
+// MaxDelay. After LockoutAfter failures, logins are locked for
+// LockoutDuration. The counters are forgotten LockoutDuration after the
+// last allowed attempt. A successful login only resets the counter of the
+// username, so that a client can't reset its counter with its own account.
+// Wrong TOTP and recovery codes are counted with the same counters, for
+// users with TOTP only the second factor resets them. Invalid magic links
+// are counted for the client.
+//
+// Zero values of BaseDelay, MaxDelay and LockoutDuration are replaced by
+// the ones of DefaultLoginThrottle, because without them failures would
+// never be delayed. A zero FreeAttempts delays from the first failure on,
+// a zero LockoutAfter never locks logins.
+type LoginThrottle struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+}
+
+// DefaultLoginThrottle allows 3 failed logins without delay, then waits
+// 1s, 2s, 4s and so on up to 1 minute, and locks logins for 15 minutes
+// after 10 failures.
+var DefaultLoginThrottle = LoginThrottle{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutAfter:    10,
+	LockoutDuration: time.Minute * 15,
+}
+
+// withDefaults returns t with the zero durations replaced by the ones of
+// DefaultLoginThrottle.
+func (t LoginThrottle) withDefaults() LoginThrottle {
+	if t.BaseDelay <= 0 {
+		t.BaseDelay = DefaultLoginThrottle.BaseDelay
+	}
+	if t.MaxDelay <= 0 {
+		t.MaxDelay = DefaultLoginThrottle.MaxDelay
+	}
+	if t.LockoutDuration <= 0 {
+		t.LockoutDuration = DefaultLoginThrottle.LockoutDuration
+	}
+	return t
+}
+
+// loginAttempts is the counter that is saved as JSON in the Data of a
+// token. Next is the earliest time for the next attempt.
+type loginAttempts struct {
+	Failures int
+	Next     time.Time
+}
+
+// UnlockUser resets the failed login counter of the user with the given
+// ID, which also ends a lockout. Counters of clients are not affected.
+func (s *Store) UnlockUser(id uint64) error {
+	_, err := s.store.GetUser(id)
+	if err != nil {
+		return err
+	}
+	return s.resetAttempts(s.codeThrottle(), userAttemptsKey(id))
+}
+
+// UnlockClient resets the failed login counter of the client key.
+func (s *Store) UnlockClient(clientKey string) error {
+	return s.resetAttempts(s.codeThrottle(), clientAttemptsKey(clientKey))
+}
+
+// IDLoginClient works like IDLogin, but it also throttles failed logins
+// per clientKey, which is usually the IP address of the client.
+//
+// It is the callers responsibility to pass the session token (User.ID) back
+// to the client.
+func (s *Store) IDLoginClient(id string, clientKey string, username, pass string) (*User, error) {
+	u, _, err := s.loginID(id, clientKey, username, pass)
+	return makeUser(u), err
+}
+
+// attemptsKeys returns the counter keys of a login. Logins of existing
+// users are counted per user ID, so that the username and email count
+// together. Unknown logins are counted per name, like existing ones, so
+// that the throttling doesn't reveal which users exist.
+func attemptsKeys(uid uint64, login, clientKey string) []string {
+	keys := make([]string, 0, 2)
+	if uid != 0 {
+		keys = append(keys, userAttemptsKey(uid))
+	} else {
+		keys = append(keys, "name:"+login)
+	}
+	if clientKey != "" {
+		keys = append(keys, clientAttemptsKey(clientKey))
+	}
+	return keys
+}
+
+func userAttemptsKey(id uint64) string {
+	return fmt.Sprint("user:", id)
+}
+
+func clientAttemptsKey(clientKey string) string {
+	return "client:" + clientKey
+}
+
+// codeThrottle returns the throttle of second factors. Unlike passwords,
+// their short codes are always throttled, with DefaultLoginThrottle if
+// WithLoginThrottle isn't used. The counters are shared with the password
+// logins of the user. It returns nil if the backend can't store tokens.
+func (s *Store) codeThrottle() *LoginThrottle {
+	if s.throttle != nil {
+		return s.throttle
+	}
+	if _, err := s.tokenStorer(); err != nil {
+		return nil
+	}
+	return &DefaultLoginThrottle
+}
+
+// checkAttempts returns a *TooManyAttemptsError if one of the counters
+// doesn't allow an attempt yet. A nil throttle allows all attempts.
+func (s *Store) checkAttempts(throttle *LoginThrottle, keys []string) error {
+	if throttle == nil {
+		return nil
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		a, err := s.getAttempts(key)
+		if err != nil {
+			return err
+		}
+		if d := a.Next.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return &TooManyAttemptsError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// failAttempt counts a failed login for all keys. uid is the user that is
+// locked out, or 0.
+func (s *Store) failAttempt(throttle *LoginThrottle, keys []string, uid uint64) error {
+	if throttle == nil {
+		return nil
+	}
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return err
+	}
+	// the counters are only updated under the mutex, concurrent failures
+	// of other processes with the same backend can still get lost
+	s.attemptsMutex.Lock()
+	defer s.attemptsMutex.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		a, err := s.getAttempts(key)
+		if err != nil {
+			return err
+		}
+		a.Failures++
+		a.Next = now.Add(throttle.delay(a.Failures))
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		// the key is hashed like a token, so that the IDs don't contain
+		// usernames or IP addresses
+		err = ts.PutToken(&StoredToken{
+			ID:      tokenID(tokenKindLoginAttempts, key),
+			Kind:    tokenKindLoginAttempts,
+			Expires: a.Next.Add(throttle.LockoutDuration),
+			Data:    data,
+		})
+		if err != nil {
+			return err
+		}
+		if a.Failures == throttle.LockoutAfter && key == userAttemptsKey(uid) {
+			s.emit(Event{
+				Type:   EventUserLockedOut,
+				UserID: uid,
+				Detail: fmt.Sprint(a.Failures, " failed logins"),
+			})
+		}
+	}
+	return nil
+}
+
+func (s *Store) resetAttempts(throttle *LoginThrottle, key string) error {
+	if throttle == nil {
+		return nil
+	}
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return err
+	}
+	return ts.DeleteToken(tokenID(tokenKindLoginAttempts, key))
+}
+
+// getAttempts returns the counter of the key. Missing and expired counters
+// are returned as zero.
+func (s *Store) getAttempts(key string) (loginAttempts, error) {
+	var a loginAttempts
+	t, err := s.getToken(tokenKindLoginAttempts, key)
+	if err == ErrTokenNotFound || err == errTokenExpired {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	err = json.Unmarshal(t.Data, &a)
+	return a, err
+}
+
+// delay returns how long the next attempt has to wait after the failures.
+func (t *LoginThrottle) delay(failures int) time.Duration {
+	if t.LockoutAfter > 0 && failures >= t.LockoutAfter {
+		return t.LockoutDuration
+	}
+	n := failures - t.FreeAttempts
+	if n <= 0 {
+		return 0
+	}
+	d := t.BaseDelay
+	for i := 1; i < n && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	return d
+}
+
+// remoteIP is the default client key of CookieLogin.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,146 @@
+package crowd
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	throttle := LoginThrottle{
+		FreeAttempts:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second * 5,
+		LockoutAfter:    8,
+		LockoutDuration: time.Hour,
+	}
+	want := []time.Duration{0, 0, 0, 1, 2, 4, 5, 5, 3600}
+	for failures, w := range want {
+		if d := throttle.delay(failures); d != w*time.Second {
+			t.Errorf("delay(%d): expected %v, got %v", failures, w*time.Second, d)
+		}
+	}
+}
+
+func TestLoginThrottleDefaults(t *testing.T) {
+	store := NewMemoryStore(WithGCInterval(0), WithLoginThrottle(LoginThrottle{LockoutAfter: 5}))
+	want := DefaultLoginThrottle
+	want.FreeAttempts = 0
+	want.LockoutAfter = 5
+	if *store.throttle != want {
+		t.Errorf("expected %+v, got %+v", want, *store.throttle)
+	}
+	if d := store.throttle.delay(1); d != time.Second {
+		t.Errorf("delay(1): expected 1s, got %v", d)
+	}
+}
+
+var testLoginThrottle = LoginThrottle{
+	FreeAttempts:    2,
+	BaseDelay:       time.Hour,
+	MaxDelay:        time.Hour * 4,
+	LockoutAfter:    4,
+	LockoutDuration: time.Hour * 24,
+}
+
+func TestLoginThrottle(t *testing.T) {
+	var events []Event
+	store := NewMemoryStore(WithLoginThrottle(testLoginThrottle), WithEventHandler(func(e Event) {
+		events = append(events, e)
+	}))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVerifiedEmail(t, store, 1, "alice@example.com")
+
+	// username and email count together
+	for _, login := range []string{"alice", "alice@example.com", "alice"} {
+		if _, err = store.IDLogin("", login, "wrong"); err != ErrLoginWrong {
+			t.Fatalf("expected ErrLoginWrong, got %v", err)
+		}
+	}
+	_, err = store.IDLogin("", "alice", "secret")
+	checkTooManyAttempts(t, err, time.Hour)
+
+	// a new Store with the same backend still throttles
+	restarted := NewStore(store.store, WithLoginThrottle(testLoginThrottle), WithGCInterval(0))
+	_, err = restarted.IDLogin("", "alice@example.com", "secret")
+	checkTooManyAttempts(t, err, time.Hour)
+
+	if err = store.UnlockUser(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.IDLogin("", "alice", "secret"); err != nil {
+		t.Fatalf("login after UnlockUser: %v", err)
+	}
+	if err = store.UnlockUser(2); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// the lockout of unknown users looks the same
+	for i := 0; i < 3; i++ {
+		store.IDLogin("", "bob", "wrong")
+	}
+	_, err = store.IDLogin("", "bob", "wrong")
+	checkTooManyAttempts(t, err, time.Hour)
+
+	// lockout after reaching the limit, the delays are skipped
+	for i := 0; i < testLoginThrottle.LockoutAfter; i++ {
+		err = store.failAttempt(store.throttle, attemptsKeys(1, "alice", ""), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = store.IDLogin("", "alice", "secret")
+	checkTooManyAttempts(t, err, testLoginThrottle.LockoutDuration)
+	if len(events) != 1 || events[0].Type != EventUserLockedOut || events[0].UserID != 1 {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+func TestLoginThrottleClient(t *testing.T) {
+	store := NewMemoryStore(WithLoginThrottle(testLoginThrottle))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every username fails once, but the client fails three times
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err = store.IDLoginClient("", "10.0.0.1", name, "wrong"); err != ErrLoginWrong {
+			t.Fatalf("expected ErrLoginWrong, got %v", err)
+		}
+	}
+	_, err = store.IDLoginClient("", "10.0.0.1", "alice", "secret")
+	checkTooManyAttempts(t, err, time.Hour)
+	if _, err = store.IDLoginClient("", "10.0.0.2", "alice", "secret"); err != nil {
+		t.Errorf("login from another client: %v", err)
+	}
+
+	// CookieLogin uses the IP address of the request
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "10.0.0.1:4242"
+	_, err = store.CookieLogin(httptest.NewRecorder(), r, "alice", "secret")
+	checkTooManyAttempts(t, err, time.Hour)
+
+	if err = store.UnlockClient("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CookieLogin(httptest.NewRecorder(), r, "alice", "secret"); err != nil {
+		t.Errorf("login after UnlockClient: %v", err)
+	}
+}
+
+func checkTooManyAttempts(t *testing.T, err error, retryAfter time.Duration) {
+	t.Helper()
+	var e *TooManyAttemptsError
+	if !errors.Is(err, ErrTooManyAttempts) || !errors.As(err, &e) {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+	if e.RetryAfter <= retryAfter-time.Minute || e.RetryAfter > retryAfter {
+		t.Errorf("expected retry after %v, got %v", retryAfter, e.RetryAfter)
+	}
+}
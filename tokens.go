@@ -0,0 +1,273 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTokenNotFound is returned when a store can't find the given token.
+	ErrTokenNotFound = errors.New("Token not found")
+
+	// ErrTokenExists is returned by UniqueTokenStorer.AddToken if a token
+	// with the ID exists.
+	ErrTokenExists = errors.New("Token already exists")
+
+	// ErrTokensNotSupported is returned by Store methods that need to save
+	// tokens, if the backend doesn't implement TokenStorer.
+	ErrTokensNotSupported = errors.New("Tokens not supported by the store backend")
+
+	// errTokenExpired is returned by takeToken and mapped to the error
+	// of the feature that uses the token.
+	errTokenExpired = errors.New("Token expired")
+)
+
+// TokenStorer is an optional interface for Storer backends that can store
+// tokens. Tokens are used for invites and other links that are sent
+// to users. They expire and most of them can only be used once. The tokens
+// are random strings that are not signed. They are stored with the SHA-256
+// hash of the token as ID, so that the stored tokens can't be used.
+type TokenStorer interface {
+	// Get a Token from the store
+	// If Token is not found, error needs to be ErrTokenNotFound
+	GetToken(id string) (*StoredToken, error)
+	// Put a Token into the store
+	PutToken(t *StoredToken) error
+	// Get a Token and delete it from the store in one step, so that only
+	// one caller can take it. If Token is not found, error needs to be
+	// ErrTokenNotFound
+	TakeToken(id string) (*StoredToken, error)
+	// Delete a Token from the store
+	DeleteToken(id string) error
+	// Run fn for each token and delete if true is returned
+	ForEachToken(fn func(t *StoredToken) (del bool)) error
+}
+
+// UniqueTokenStorer is an optional interface for TokenStorer backends that
+// can add a token in one step if its ID is unused. Without it the Store
+// checks for the token before it is put, which only keeps concurrent
+// callers of the same Store apart.
+type UniqueTokenStorer interface {
+	// Put a Token into the store only if there is no token with the ID,
+	// so that only one caller can add it. Otherwise error needs to be
+	// ErrTokenExists
+	AddToken(t *StoredToken) error
+}
+
+// UserTokenStorer is an optional interface for TokenStorer backends that
+// keep an index of tokens by their UserID. Without it the Store has to
+// range over all tokens to find the tokens of a user.
+type UserTokenStorer interface {
+	// Get all tokens with the given UserID, no matter if they are
+	// expired.
+	GetUserTokens(userID uint64) ([]*StoredToken, error)
+}
+
+// StoredToken is a random token of a certain Kind, like "invite". The ID
+// is the hash of the token that was handed out, see tokenID. UserID
+// is the user that the token belongs to or that created it. Data holds
+// the JSON encoded details that depend on the kind of the token.
+type StoredToken struct {
+	ID      string
+	Kind    string
+	UserID  uint64
+	Expires time.Time
+	Data    []byte
+}
+
+// newToken returns a random token with 24 bytes like the session IDs,
+// but encoded URL safe so that it can be used in links.
+func newToken() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// issueToken saves a new token of the kind that expires after ttl and
+// returns the token together with the saved StoredToken. data is JSON
+// encoded if it is not nil.
+func (s *Store) issueToken(kind string, userID uint64, ttl time.Duration, data interface{}) (string, *StoredToken, error) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	t := &StoredToken{
+		ID:      tokenID(kind, token),
+		Kind:    kind,
+		UserID:  userID,
+		Expires: time.Now().Add(ttl),
+	}
+	if data != nil {
+		t.Data, err = json.Marshal(data)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	err = ts.PutToken(t)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// getToken returns the stored token of a token that was issued with
+// issueToken, if it exists and has the kind. It returns ErrTokenNotFound
+// or errTokenExpired otherwise.
+func (s *Store) getToken(kind, token string) (*StoredToken, error) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil, err
+	}
+	t, err := ts.GetToken(tokenID(kind, token))
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind != kind {
+		return nil, ErrTokenNotFound
+	}
+	if time.Now().After(t.Expires) {
+		return nil, errTokenExpired
+	}
+	return t, nil
+}
+
+// takeToken is like getToken, but it also deletes the token. Expired
+// tokens are deleted as well.
+func (s *Store) takeToken(kind, token string) (*StoredToken, error) {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil, err
+	}
+	id := tokenID(kind, token)
+	// check the kind first, so that a token can't be used up by passing
+	// it to the wrong method
+	t, err := ts.GetToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind != kind {
+		return nil, ErrTokenNotFound
+	}
+	t, err = ts.TakeToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(t.Expires) {
+		return nil, errTokenExpired
+	}
+	return t, nil
+}
+
+// addToken saves the token if there is no token with its ID yet and
+// returns ErrTokenExists otherwise.
+func (s *Store) addToken(ts TokenStorer, t *StoredToken) error {
+	if us, ok := ts.(UniqueTokenStorer); ok {
+		return us.AddToken(t)
+	}
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	_, err := ts.GetToken(t.ID)
+	if err == nil {
+		return ErrTokenExists
+	}
+	if err != ErrTokenNotFound {
+		return err
+	}
+	return ts.PutToken(t)
+}
+
+// userTokens returns all tokens with the given UserID, using the index of
+// the backend if it has one.
+func (s *Store) userTokens(ts TokenStorer, userID uint64) ([]*StoredToken, error) {
+	if us, ok := ts.(UserTokenStorer); ok {
+		return us.GetUserTokens(userID)
+	}
+	var tokens []*StoredToken
+	err := ts.ForEachToken(func(t *StoredToken) bool {
+		if t.UserID == userID {
+			c := *t
+			tokens = append(tokens, &c)
+		}
+		return false
+	})
+	return tokens, err
+}
+
+// deleteUserTokens deletes all tokens of the kind with the given UserID.
+func (s *Store) deleteUserTokens(userID uint64, kind string) error {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return err
+	}
+	tokens, err := s.userTokens(ts, userID)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.Kind != kind {
+			continue
+		}
+		err = ts.DeleteToken(t.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectTokens deletes all expired tokens and returns their number.
+func (s *Store) collectTokens(now time.Time) (int, error) {
+	ts, ok := s.store.(TokenStorer)
+	if !ok {
+		return 0, nil
+	}
+	count := 0
+	err := ts.ForEachToken(func(t *StoredToken) bool {
+		if now.After(t.Expires) {
+			count++
+			return true
+		}
+		return false
+	})
+	return count, err
+}
+
+// tokenID returns the ID under which a token of the kind is stored. Only
+// the SHA-256 hash of the token is stored, so that the tokens can't be
+// taken from the backend. The kind keeps the IDs of different kinds apart.
+func tokenID(kind, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return kind + ":" + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (s *Store) tokenStorer() (TokenStorer, error) {
+	ts, ok := s.store.(TokenStorer)
+	if !ok {
+		return nil, ErrTokensNotSupported
+	}
+	return ts, nil
+}
@@ -0,0 +1,284 @@
+// Copyright © 2015 Martin Bertschler <mbertschler@gmail.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crowd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TOTP parameters as recommended by RFC 6238 and understood by all
+// authenticator apps.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpModulo        = 1000000
+	totpSecretLen     = 20
+	totpSkew          = 1
+	defaultTOTPIssuer = "crowd"
+	tokenKindTOTPStep = "totp_step"
+)
+
+var (
+	// ErrSecondFactorRequired is returned by a login with a correct password
+	// if the user has two-factor authentication enabled.
+	ErrSecondFactorRequired = errors.New("Second factor required")
+
+	// ErrNoSecondFactorPending is returned when a second factor is verified
+	// for a session without a preceding password login.
+	ErrNoSecondFactorPending = errors.New("No second factor pending")
+
+	// ErrTOTPInvalid is returned when a TOTP code is wrong, expired or
+	// was already used.
+	ErrTOTPInvalid = errors.New("TOTP code is invalid")
+
+	// ErrTOTPNotEnrolled is returned when a TOTP code is checked for a user
+	// without a TOTP secret.
+	ErrTOTPNotEnrolled = errors.New("TOTP is not enrolled")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPKey is the result of a TOTP enrollment. Show the URI as a QR code
+// or the Secret for manual entry in an authenticator app.
+type TOTPKey struct {
+	Secret string
+	URI    string
+}
+
+// UserIDEnrollTOTP generates a new TOTP secret for the user with the given
+// ID. The secret is only used for logins after it was confirmed with
+// UserIDConfirmTOTP. An already confirmed secret stays active until then.
+func (s *Store) UserIDEnrollTOTP(id uint64) (*TOTPKey, error) {
+	secret := make([]byte, totpSecretLen)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.updateUser(id, func(u *StoredUser) bool {
+		u.TOTPPending = secret
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.totpKey(u.Name, secret), nil
+}
+
+// UserIDConfirmTOTP completes the enrollment of the user with the given ID
+// with a code from the authenticator app. Afterwards logins of the user
+// need the second factor. It returns ErrTOTPInvalid for a wrong code and
+// ErrTOTPNotEnrolled if UserIDEnrollTOTP wasn't called.
+func (s *Store) UserIDConfirmTOTP(id uint64, code string) error {
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if u.TOTPPending == nil {
+		return ErrTOTPNotEnrolled
+	}
+	step, ok := checkTOTP(u.TOTPPending, code, 0, time.Now())
+	if !ok {
+		return ErrTOTPInvalid
+	}
+	u.TOTPSecret = u.TOTPPending
+	u.TOTPPending = nil
+	u.TOTPLastStep = step
+	return s.store.PutUser(u)
+}
+
+// UserIDDisableTOTP removes the TOTP secret of the user with the given ID,
+// so that logins only need the password again.
+func (s *Store) UserIDDisableTOTP(id uint64) error {
+	_, err := s.updateUser(id, func(u *StoredUser) bool {
+		u.TOTPSecret = nil
+		u.TOTPPending = nil
+		u.TOTPLastStep = 0
+		return true
+	})
+	return err
+}
+
+// CookieVerifyTOTP completes a login that returned ErrSecondFactorRequired
+// with a TOTP code. Every code can only be used once. The client gets a new
+// session cookie and the previous session is deleted. It returns
+// ErrTOTPInvalid for a wrong code and ErrNoSecondFactorPending if there
+// was no password login before. Wrong codes are counted for the user and
+// the client like failed logins, also without WithLoginThrottle, and return
+// an error that matches ErrTooManyAttempts once the limit is reached.
+func (s *Store) CookieVerifyTOTP(w http.ResponseWriter, r *http.Request, code string) (*User, error) {
+	u, changed, err := s.verifyTOTPClientID(s.getCookieID(r), s.clientKey(r), code)
+	if changed {
+		s.saveCookie(w, u.StoredSession)
+	}
+	return makeUser(u), err
+}
+
+// IDVerifyTOTP completes a login that returned ErrSecondFactorRequired
+// with a TOTP code. It works like CookieVerifyTOTP, but wrong codes are
+// only counted for the user.
+//
+// It is the callers responsibility to pass the session token (User.ID) back
+// to the client.
+func (s *Store) IDVerifyTOTP(id string, code string) (*User, error) {
+	u, _, err := s.verifyTOTPID(id, code)
+	return makeUser(u), err
+}
+
+// verifyTOTPID verifies the code without counting wrong codes for a
+// client.
+func (s *Store) verifyTOTPID(id, code string) (*StoredUser, bool, error) {
+	return s.verifyTOTPClientID(id, "", code)
+}
+
+func (s *Store) verifyTOTPClientID(id, clientKey, code string) (*StoredUser, bool, error) {
+	return s.secondFactorID(id, clientKey, func(u *StoredUser) error {
+		if u.TOTPSecret == nil {
+			return ErrTOTPNotEnrolled
+		}
+		step, ok := checkTOTP(u.TOTPSecret, code, u.TOTPLastStep, time.Now())
+		if !ok {
+			return ErrTOTPInvalid
+		}
+		err := s.claimTOTPStep(u.ID, step)
+		if err != nil {
+			return err
+		}
+		u.TOTPLastStep = step
+		return s.store.PutUser(u)
+	})
+}
+
+// claimTOTPStep marks the time step as used by the user. The token can
+// only be added once, so that concurrent logins can't both use a code
+// before TOTPLastStep is saved. It expires when the code of the step isn't
+// accepted anymore. Without a TokenStorer only TOTPLastStep is checked.
+func (s *Store) claimTOTPStep(uid uint64, step int64) error {
+	ts, err := s.tokenStorer()
+	if err != nil {
+		return nil
+	}
+	err = s.addToken(ts, &StoredToken{
+		ID:      fmt.Sprint(tokenKindTOTPStep, ":", uid, ":", step),
+		Kind:    tokenKindTOTPStep,
+		UserID:  uid,
+		Expires: time.Unix((step+totpSkew+1)*totpPeriod, 0),
+	})
+	if err == ErrTokenExists {
+		return ErrTOTPInvalid
+	}
+	return err
+}
+
+// secondFactorID loads the user of a session in the SecondFactorPending
+// state and calls check. If check returns no error, the user is logged in
+// with a new session. Failed checks are counted with the codeThrottle for
+// the user and the clientKey, if it is not empty.
+func (s *Store) secondFactorID(id, clientKey string, check func(u *StoredUser) error) (*StoredUser, bool, error) {
+	sess, changed, err := s.getSessionID(id)
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	if !sess.SecondFactorPending {
+		return &StoredUser{StoredSession: sess}, changed, ErrNoSecondFactorPending
+	}
+	u, err := s.store.GetUser(sess.UserID)
+	if err == ErrUserNotFound {
+		err = ErrLoginWrong
+	}
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	throttle := s.codeThrottle()
+	keys := attemptsKeys(u.ID, "", clientKey)
+	err = s.checkAttempts(throttle, keys)
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	err = check(u)
+	if err == ErrTOTPInvalid {
+		ferr := s.failAttempt(throttle, keys, u.ID)
+		if ferr != nil {
+			err = ferr
+		}
+	}
+	if err == nil {
+		err = s.resetAttempts(throttle, keys[0])
+	}
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	sess.LoggedIn = true
+	sess.SecondFactorPending = false
+	next, err := s.rotateSession(sess)
+	changed = true
+	if err != nil {
+		return &StoredUser{StoredSession: sess}, changed, err
+	}
+	u.StoredSession = next
+	return u, changed, nil
+}
+
+func (s *Store) totpKey(name string, secret []byte) *TOTPKey {
+	enc := totpEncoding.EncodeToString(secret)
+	v := url.Values{}
+	v.Set("secret", enc)
+	v.Set("issuer", s.totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(s.totpIssuer) + ":" + url.PathEscape(name)
+	return &TOTPKey{
+		Secret: enc,
+		URI:    "otpauth://totp/" + label + "?" + v.Encode(),
+	}
+}
+
+// checkTOTP reports whether code is valid for the secret at time now. Codes
+// of the neighboring time steps are accepted for clock skew, but only if
+// their step is after lastStep. The step of the matching code is returned.
+func checkTOTP(secret []byte, code string, lastStep int64, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode returns the code for the time step as defined in RFC 6238
+// and RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
@@ -0,0 +1,244 @@
+package crowd
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238 for SHA1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if got := totpCode(secret, unix/totpPeriod); got != want {
+			t.Errorf("code at %d: expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	store := NewMemoryStore(WithTOTPIssuer("Example Co"))
+	defer store.StopSessionGC()
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.UserIDEnrollTOTP(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(key.URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Example Co:alice" ||
+		uri.Query().Get("secret") != key.Secret || uri.Query().Get("issuer") != "Example Co" {
+		t.Errorf("unexpected URI %s", key.URI)
+	}
+	secret, err := totpEncoding.DecodeString(key.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / totpPeriod
+	code := func(offset int64) string {
+		return totpCode(secret, step+offset)
+	}
+
+	// not confirmed yet
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != nil || !u.LoggedIn || u.TOTPEnabled {
+		t.Fatalf("expected a password login, got %+v %v", u, err)
+	}
+	if err = store.UserIDConfirmTOTP(1, "000000"+code(0)); err != ErrTOTPInvalid {
+		t.Errorf("expected ErrTOTPInvalid, got %v", err)
+	}
+	if err = store.UserIDConfirmTOTP(1, code(-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != ErrSecondFactorRequired {
+		t.Fatalf("expected ErrSecondFactorRequired, got %v", err)
+	}
+	if u.LoggedIn || !u.SecondFactorPending || u.Name != "" {
+		t.Errorf("expected a pending session, got %+v", u)
+	}
+	pending := u.Session.ID
+	u, err = store.IDGet(pending)
+	if err != nil || u.LoggedIn || !u.SecondFactorPending {
+		t.Errorf("pending session is not pending anymore: %+v %v", u, err)
+	}
+
+	// the code that was used for the confirmation can't be used again
+	if _, err = store.IDVerifyTOTP(pending, code(-1)); err != ErrTOTPInvalid {
+		t.Errorf("expected ErrTOTPInvalid for a replayed code, got %v", err)
+	}
+	u, err = store.IDVerifyTOTP(pending, code(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.LoggedIn || u.SecondFactorPending || !u.TOTPEnabled || u.Session.ID == pending {
+		t.Errorf("expected a new logged in session, got %+v", u)
+	}
+	if _, err = store.IDVerifyTOTP(u.Session.ID, code(1)); err != ErrNoSecondFactorPending {
+		t.Errorf("expected ErrNoSecondFactorPending, got %v", err)
+	}
+
+	// replay within the window
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != ErrSecondFactorRequired {
+		t.Fatal(err)
+	}
+	if _, err = store.IDVerifyTOTP(u.Session.ID, code(0)); err != ErrTOTPInvalid {
+		t.Errorf("expected ErrTOTPInvalid for a replayed code, got %v", err)
+	}
+	if _, err = store.IDLogout(u.Session.ID); err != nil {
+		t.Errorf("pending session can't be logged out: %v", err)
+	}
+
+	if err = store.UserIDDisableTOTP(1); err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != nil || !u.LoggedIn {
+		t.Errorf("expected a password login, got %+v %v", u, err)
+	}
+	if len(key.Secret) != 32 {
+		t.Errorf("expected a 32 character secret, got %q", key.Secret)
+	}
+}
+
+// enrollTOTP registers alice with a confirmed TOTP secret and returns a
+// function for the code at the current step plus offset.
+func enrollTOTP(t *testing.T, store *Store) func(offset int64) string {
+	_, err := store.UserNameRegister("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.UserIDEnrollTOTP(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totpEncoding.DecodeString(key.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / totpPeriod
+	code := func(offset int64) string {
+		return totpCode(secret, step+offset)
+	}
+	if err = store.UserIDConfirmTOTP(1, code(-1)); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPThrottle(t *testing.T) {
+	store := NewMemoryStore(WithLoginThrottle(testLoginThrottle))
+	defer store.StopSessionGC()
+	code := enrollTOTP(t, store)
+	wrong := "000000"
+	if wrong == code(0) || wrong == code(1) {
+		wrong = "111111"
+	}
+
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != ErrSecondFactorRequired {
+		t.Fatalf("expected ErrSecondFactorRequired, got %v", err)
+	}
+	pending := u.Session.ID
+	for i := 0; i < testLoginThrottle.FreeAttempts+1; i++ {
+		if _, err = store.IDVerifyTOTP(pending, wrong); err != ErrTOTPInvalid {
+			t.Fatalf("attempt %d: expected ErrTOTPInvalid, got %v", i, err)
+		}
+	}
+	// after the limit even the right code is refused
+	_, err = store.IDVerifyTOTP(pending, code(0))
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+	// the counter is shared with password logins
+	_, err = store.IDLogin("", "alice", "secret")
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("expected ErrTooManyAttempts for the password, got %v", err)
+	}
+
+	if err = store.UnlockUser(1); err != nil {
+		t.Fatal(err)
+	}
+	// a password login doesn't reset the counter of the codes
+	if _, err = store.IDVerifyTOTP(pending, wrong); err != ErrTOTPInvalid {
+		t.Fatalf("expected ErrTOTPInvalid, got %v", err)
+	}
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != ErrSecondFactorRequired {
+		t.Fatalf("expected ErrSecondFactorRequired, got %v", err)
+	}
+	a, err := store.getAttempts(userAttemptsKey(1))
+	if err != nil || a.Failures != 1 {
+		t.Errorf("expected 1 failure, got %+v %v", a, err)
+	}
+	pending = u.Session.ID
+	u, err = store.IDVerifyTOTP(pending, code(0))
+	if err != nil || !u.LoggedIn {
+		t.Fatalf("expected a login after the unlock, got %+v %v", u, err)
+	}
+	// the success reset the counter
+	a, err = store.getAttempts(userAttemptsKey(1))
+	if err != nil || a.Failures != 0 {
+		t.Errorf("expected no failures, got %+v %v", a, err)
+	}
+}
+
+func TestTOTPThrottleDefault(t *testing.T) {
+	// codes are throttled without WithLoginThrottle
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+	code := enrollTOTP(t, store)
+	wrong := "000000"
+	if wrong == code(0) || wrong == code(1) {
+		wrong = "111111"
+	}
+	u, err := store.IDLogin("", "alice", "secret")
+	if err != ErrSecondFactorRequired {
+		t.Fatalf("expected ErrSecondFactorRequired, got %v", err)
+	}
+	for i := 0; i <= DefaultLoginThrottle.FreeAttempts; i++ {
+		if _, err = store.IDVerifyTOTP(u.Session.ID, wrong); err != ErrTOTPInvalid {
+			t.Fatalf("attempt %d: expected ErrTOTPInvalid, got %v", i, err)
+		}
+	}
+	if _, err = store.IDVerifyTOTP(u.Session.ID, wrong); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("expected ErrTooManyAttempts, got %v", err)
+	}
+}
+
+func TestClaimTOTPStep(t *testing.T) {
+	unique := NewMemoryStore(WithGCInterval(0))
+	mem := NewMemoryStore(WithGCInterval(0)).store
+	plain := NewStore(plainTokenStorer{mem, mem.(TokenStorer)}, WithGCInterval(0))
+	for _, store := range []*Store{unique, plain} {
+		step := time.Now().Unix() / totpPeriod
+		if err := store.claimTOTPStep(1, step); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.claimTOTPStep(1, step); err != ErrTOTPInvalid {
+			t.Errorf("expected ErrTOTPInvalid for a claimed step, got %v", err)
+		}
+		if err := store.claimTOTPStep(2, step); err != nil {
+			t.Errorf("step of another user: %v", err)
+		}
+	}
+}
+
+// plainTokenStorer is a TokenStorer without the optional UniqueTokenStorer.
+type plainTokenStorer struct {
+	Storer
+	TokenStorer
+}
@@ -14,21 +14,22 @@
 package crowd
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
-
-	"golang.org/x/crypto/scrypt"
 )
 
 const (
 	defaultSessionCookieName               = "id"
 	defaultSessionCookieExpirationLoggedin = time.Hour * 24 * 90
 	defaultSessionCookieExpiration         = time.Minute
+	defaultSessionGCInterval               = time.Minute
 )
 
 // ==================================================
@@ -100,68 +101,104 @@ type Storer interface {
 // users and sessions and provides all the relevant methods for working with
 // them.
 type Store struct {
-	store     Storer
-	stop      chan struct{}
-	gcRunning bool
+	store    Storer
+	sessions sessionStorer
+	hasher   PasswordHasher
+	onEvent  func(Event)
+	logger   Logger
+
+	gcMutex    sync.Mutex
+	gcCancel   context.CancelFunc
+	gcDone     chan struct{}
+	gcInterval time.Duration
+	gcJitter   time.Duration
+
+	cookieName     string
+	cookieSecure   bool
+	cookieSameSite http.SameSite
+	cookieDomain   string
+	cookiePath     string
+	cookieKeys     *Keyring
+	sessionKeys    *Keyring
+	noLegacyIDs    bool
+	revocations    RevocationList
+	loggedInTTL    time.Duration
+	anonymousTTL   time.Duration
+	loginURL       string
+
+	rolePermissions map[string][]string
+	totpIssuer      string
+	notifier        Notifier
+	resetTTL        time.Duration
+	verifyTTL       time.Duration
+	magicLinkTTL    time.Duration
+	refreshTTL      time.Duration
+	accessTTL       time.Duration
+	tokensMutex     sync.Mutex
+
+	throttle      *LoginThrottle
+	attemptsMutex sync.Mutex
+	clientKey     func(r *http.Request) string
+	dummyHash     []byte
+	dummyOnce     sync.Once
+
+	tokenSources []TokenSource
+	tokenHeader  string
+	tokenQuery   string
 }
 
 // NewStore creates a new store with a specified Storer backend. Only other
 // libraries should call this function. Use New[...]Store() functions such as
 // NewMemoryStore() instead. This function also starts a session GC that
-// regularly deletes expired sessions.
-func NewStore(s Storer) *Store {
+// regularly deletes expired sessions, unless it is disabled with
+// WithGCInterval(0). Call Close to stop it.
+func NewStore(s Storer, opts ...Option) *Store {
 	store := &Store{
-		store:     s,
-		stop:      make(chan struct{}, 1),
-		gcRunning: true,
-	}
-	go store.sessionGC(store.stop)
-	return store
-}
-
-func (s *Store) sessionGC(stop chan struct{}) {
-	for {
-		select {
-		case <-time.After(defaultSessionCookieExpiration):
-			count := 0
-			s.store.ForEachSession(func(s *StoredSession) (del bool) {
-				if time.Now().After(s.Expires) {
-					count++
-					return true
-				}
-				return false
-			})
-			if count > 0 {
-				log.Println("GCed", count, "sessions.")
-			}
-		case <-stop:
-			s.gcRunning = false
-			return
+		store:        s,
+		hasher:       defaultPasswordHasher,
+		logger:       log.Default(),
+		gcInterval:   defaultSessionGCInterval,
+		cookieName:   defaultSessionCookieName,
+		totpIssuer:   defaultTOTPIssuer,
+		resetTTL:     defaultPasswordResetTTL,
+		verifyTTL:    defaultEmailVerificationTTL,
+		magicLinkTTL: defaultMagicLinkTTL,
+		refreshTTL:   defaultRefreshTokenTTL,
+		accessTTL:    defaultAccessTokenTTL,
+		clientKey:    remoteIP,
+		tokenSources: []TokenSource{TokenCookie},
+		tokenHeader:  defaultTokenHeader,
+		tokenQuery:   defaultTokenQuery,
+		cookiePath:   "/",
+		loggedInTTL:  defaultSessionCookieExpirationLoggedin,
+		anonymousTTL: defaultSessionCookieExpiration,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	store.sessions = &hashedSessions{store: s, legacy: !store.noLegacyIDs}
+	if store.sessionKeys != nil {
+		if store.revocations == nil {
+			store.revocations = NewMemoryRevocationList()
+		}
+		maxTTL := store.loggedInTTL
+		if store.anonymousTTL > maxTTL {
+			maxTTL = store.anonymousTTL
+		}
+		if store.accessTTL > maxTTL {
+			maxTTL = store.accessTTL
+		}
+		store.sessions = &cookieSessions{
+			keys:       store.sessionKeys,
+			revoked:    store.revocations,
+			cookieName: store.cookieName,
+			maxTTL:     maxTTL,
 		}
 	}
-}
-
-// StartSessionGC starts the session GC that regularly deletes expired
-// sessions. It returns ErrSessionGCRunning if the GC is already running.
-// When a new Store is created the sessionGC is automatically started.
-func (s *Store) StartSessionGC() error {
-	if s.gcRunning {
-		return ErrSessionGCRunning
-	}
-	s.stop = make(chan struct{}, 1)
-	s.gcRunning = true
-	go s.sessionGC(s.stop)
-	return nil
-}
-
-// StopSessionGC stops the session GC that regularly deletes expired
-// sessions. It returns ErrSessionGCStopped if the GC is already stopped.
-func (s *Store) StopSessionGC() error {
-	if !s.gcRunning {
-		return ErrSessionGCStopped
+	if store.gcInterval > 0 {
+		store.StartSessionGC()
 	}
-	close(s.stop)
-	return nil
+	return store
 }
 
 // CountUsers returns the number of saved users
@@ -221,7 +258,7 @@ func (s *Store) getID(id string) (*StoredUser, bool, error) {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
 	if changed {
-		err = s.store.PutSession(sess)
+		err = s.sessions.PutSession(sess)
 		if err != nil {
 			return &StoredUser{StoredSession: sess}, changed, err
 		}
@@ -237,7 +274,7 @@ func (s *Store) getID(id string) (*StoredUser, bool, error) {
 		if user == nil {
 			user = &StoredUser{}
 		}
-		user.StoredSession, changed2, err = s.logoutID(sess.ID)
+		user.StoredSession, changed2, err = s.logout(sess)
 		return user, changed || changed2, err
 	}
 	user.StoredSession = sess
@@ -304,7 +341,7 @@ func (s *Store) saveDataID(id string, data interface{}) (*StoredUser, bool, erro
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
 	if changed {
-		err = s.store.PutSession(sess)
+		err = s.sessions.PutSession(sess)
 		if err != nil {
 			return &StoredUser{StoredSession: sess}, changed, err
 		}
@@ -320,73 +357,155 @@ func (s *Store) saveDataID(id string, data interface{}) (*StoredUser, bool, erro
 	return user, changed, nil
 }
 
+// getSessionID returns the session with the ID or a new session if it
+// doesn't exist or is expired. The empty ID of a missing or rejected
+// cookie never exists.
 func (s *Store) getSessionID(id string) (*StoredSession, bool, error) {
-	sess, err := s.store.GetSession(id)
+	if id == "" {
+		sess, err := s.makeSession()
+		return sess, true, err
+	}
+	sess, err := s.sessions.GetSession(id)
 	if err != nil {
 		if err == ErrSessionNotFound {
-			sess, err := makeSession()
+			sess, err := s.makeSession()
 			return sess, true, err
 		}
 		return nil, false, err
 	}
 	if time.Now().After(sess.Expires) {
-		sess, err = makeSession()
+		sess, err = s.makeSession()
 		return sess, true, err
 	}
 	sess.LastAccess = time.Now()
+	s.refreshExpiry(sess)
+	return sess, true, nil
+}
+
+// rotateSession saves a new session with the state of old and deletes old.
+// It is called on every privilege change, so that a session ID which was
+// known to somebody else before can't be used afterwards (session fixation).
+func (s *Store) rotateSession(old *StoredSession) (*StoredSession, error) {
+	sess, err := s.makeSession()
+	if err != nil {
+		return nil, err
+	}
+	sess.LoggedIn = old.LoggedIn
+	sess.UserID = old.UserID
+	sess.SecondFactorPending = old.SecondFactorPending
+	sess.FixedExpiry = old.FixedExpiry
+	if sess.FixedExpiry {
+		sess.Expires = old.Expires
+	}
+	s.refreshExpiry(sess)
+	err = s.sessions.PutSession(sess)
+	if err != nil {
+		return nil, err
+	}
+	if s.statelessSessions() != nil && !old.LoggedIn && !old.SecondFactorPending {
+		// a replayed anonymous cookie is still anonymous, so it doesn't
+		// need to fill up the revocation list
+		return sess, nil
+	}
+	err = s.sessions.DeleteSession(old.ID)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// refreshExpiry sets the expiration time of the session depending on
+// whether a user is logged in.
+func (s *Store) refreshExpiry(sess *StoredSession) {
+	if sess.FixedExpiry {
+		return
+	}
 	if sess.LoggedIn {
-		sess.Expires = time.Now().Add(defaultSessionCookieExpirationLoggedin)
+		sess.Expires = time.Now().Add(s.loggedInTTL)
 	} else {
-		sess.Expires = time.Now().Add(defaultSessionCookieExpiration)
+		sess.Expires = time.Now().Add(s.anonymousTTL)
 	}
-	return sess, true, nil
 }
 
 func (s *Store) getSession(r *http.Request) (*StoredSession, bool, error) {
-	cookie, err := r.Cookie(defaultSessionCookieName)
-	if err != nil {
-		if err == http.ErrNoCookie {
-			sess, err := makeSession()
-			return sess, true, err
-		}
-		return nil, false, err
+	id := s.getCookieID(r)
+	if id == "" {
+		sess, err := s.makeSession()
+		return sess, true, err
 	}
-	return s.getSessionID(cookie.Value)
+	return s.getSessionID(id)
 }
 
+// getCookieID returns the session ID of the session cookie.
 func (s *Store) getCookieID(r *http.Request) string {
-	cookie, err := r.Cookie(defaultSessionCookieName)
+	cookie, err := r.Cookie(s.cookieName)
 	if err != nil {
 		return ""
 	}
-	return cookie.Value
+	return s.parseToken(cookie.Value)
 }
 
-func (s *Store) saveSession(w http.ResponseWriter, sess *StoredSession) error {
-	cookie := http.Cookie{
-		Name:     defaultSessionCookieName,
-		Value:    sess.ID,
-		Path:     "/",
-		HttpOnly: true,
-		Expires:  sess.Expires,
+// parseToken returns the session ID of a session cookie value. If the
+// Store has a cookie Keyring, values without a valid signature are ignored
+// before the backend is asked for the session. With stateless sessions the
+// whole encrypted value is returned.
+func (s *Store) parseToken(value string) string {
+	if s.cookieKeys == nil || s.sessionKeys != nil {
+		return value
+	}
+	id, ok := s.cookieKeys.verify(cookieSigningPurpose, value)
+	if !ok {
+		return ""
 	}
-	http.SetCookie(w, &cookie)
-	return s.store.PutSession(sess)
+	return id
+}
+
+func (s *Store) saveSession(w http.ResponseWriter, sess *StoredSession) error {
+	http.SetCookie(w, s.cookie(sess))
+	return s.sessions.PutSession(sess)
 }
 
 func (s *Store) saveCookie(w http.ResponseWriter, sess *StoredSession) {
-	cookie := http.Cookie{
-		Name:     defaultSessionCookieName,
-		Value:    sess.ID,
-		Path:     "/",
-		HttpOnly: true,
+	http.SetCookie(w, s.cookie(sess))
+}
+
+// token returns the value that is sent to the client for sess, which is
+// the session ID like in User.Session.ID. With stateless sessions it is
+// the encrypted session.
+func (s *Store) token(sess *StoredSession) string {
+	c := s.statelessSessions()
+	if c == nil {
+		return sess.ID
+	}
+	value, err := c.encode(sess)
+	if err != nil {
+		s.logger.Printf("Session cookie error: %v", err)
+	}
+	return value
+}
+
+// cookie returns the session cookie for sess with the configured attributes.
+// The token is signed if the Store has a cookie Keyring.
+func (s *Store) cookie(sess *StoredSession) *http.Cookie {
+	value := s.token(sess)
+	if s.cookieKeys != nil && s.sessionKeys == nil {
+		value = s.cookieKeys.sign(cookieSigningPurpose, value)
+	}
+	return &http.Cookie{
+		Name:     s.cookieName,
+		Value:    value,
+		Path:     s.cookiePath,
+		Domain:   s.cookieDomain,
 		Expires:  sess.Expires,
+		Secure:   s.cookieSecure,
+		HttpOnly: true,
+		SameSite: s.cookieSameSite,
 	}
-	http.SetCookie(w, &cookie)
 }
 
 // CookieRegister registers a new user with a username and password. If the given
-// username already exists ErrUserExists is returned.
+// username already exists ErrUserExists is returned. The client gets a new
+// session cookie and the previous session is deleted.
 func (s *Store) CookieRegister(w http.ResponseWriter, r *http.Request, username, pass string) (*User, error) {
 	u, changed, err := s.registerID(s.getCookieID(r), username, pass)
 	if changed {
@@ -396,7 +515,8 @@ func (s *Store) CookieRegister(w http.ResponseWriter, r *http.Request, username,
 }
 
 // IDRegister registers a new user with a username and password. If the given
-// username already exists ErrUserExists is returned.
+// username already exists ErrUserExists is returned. The user is logged in
+// with a new session and the session with the passed ID is deleted.
 //
 // It is the callers responsibility to pass the session token (User.ID) back
 // to the client.
@@ -417,22 +537,12 @@ func (s *Store) UserNameRegister(username, pass string) (*User, error) {
 	}
 
 	var user = StoredUser{Name: username}
-
-	user.Salt = make([]byte, 32)
-	_, err = rand.Read(user.Salt)
-	if err != nil {
-		return nil, err
-	}
-
-	//start := time.Now()
-	user.Pass, err = scrypt.Key([]byte(pass), user.Salt, 16384, 8, 1, 32)
-	//log.Println("scrypt.Key Register took:", time.Now().Sub(start))
+	err = s.setUserPassword(&user, pass)
 	if err != nil {
 		return nil, err
 	}
 	uid, err := s.store.AddUser(&user)
 	user.ID = uid
-	user.UserID = uid
 	if err != nil {
 		return makeUser(&user), err
 	}
@@ -440,6 +550,12 @@ func (s *Store) UserNameRegister(username, pass string) (*User, error) {
 }
 
 func (s *Store) registerID(id string, user, pass string) (*StoredUser, bool, error) {
+	return s.registerUserID(id, &StoredUser{Name: user}, pass)
+}
+
+// registerUserID registers user, which has to have a name, and logs it in
+// with a new session.
+func (s *Store) registerUserID(id string, user *StoredUser, pass string) (*StoredUser, bool, error) {
 	sess, changed, err := s.getSessionID(id)
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
@@ -448,17 +564,17 @@ func (s *Store) registerID(id string, user, pass string) (*StoredUser, bool, err
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
-	u.StoredSession = sess
-	err = s.store.PutSession(sess)
+	next, err := s.rotateSession(sess)
 	changed = true
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
+	u.StoredSession = next
 	return u, changed, nil
 }
 
-func (s *Store) register(sess *StoredSession, name, pass string) (*StoredUser, error) {
-	_, err := s.store.GetUserID(name)
+func (s *Store) register(sess *StoredSession, user *StoredUser, pass string) (*StoredUser, error) {
+	_, err := s.store.GetUserID(user.Name)
 	if err == nil {
 		return nil, ErrUserExists
 	}
@@ -466,27 +582,18 @@ func (s *Store) register(sess *StoredSession, name, pass string) (*StoredUser, e
 		return nil, err
 	}
 
-	var user = StoredUser{Name: name}
-
-	user.Salt = make([]byte, 32)
-	_, err = rand.Read(user.Salt)
+	err = s.setUserPassword(user, pass)
 	if err != nil {
 		return nil, err
 	}
-
-	//start := time.Now()
-	user.Pass, err = scrypt.Key([]byte(pass), user.Salt, 16384, 8, 1, 32)
-	//log.Println("scrypt.Key Register took:", time.Now().Sub(start))
+	uid, err := s.store.AddUser(user)
 	if err != nil {
-		return nil, err
-	}
-	uid, err := s.store.AddUser(&user)
-	if err != nil {
-		return &user, err
+		return user, err
 	}
 	sess.LoggedIn = true
 	sess.UserID = uid
-	return &user, nil
+	s.refreshExpiry(sess)
+	return user, nil
 }
 
 // CookieSetUsername renames the current user to the new name. If the new
@@ -537,17 +644,11 @@ func (s *Store) UserIDSetUsername(id uint64, nextusername string) (*User, error)
 		return nil, err
 	}
 
-	user.Name = nextusername
-
-	err = s.store.DeleteUser(id)
-	if err != nil {
-		return makeUser(user), err
-	}
-
-	err = s.store.PutUser(user)
+	err = s.store.RenameUser(id, nextusername)
 	if err != nil {
 		return makeUser(user), err
 	}
+	user.Name = nextusername
 	return makeUser(user), nil
 }
 
@@ -561,7 +662,7 @@ func (s *Store) setNameID(id string, name string) (*StoredUser, bool, error) {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
 	u.StoredSession = sess
-	err = s.store.PutSession(sess)
+	err = s.sessions.PutSession(sess)
 	changed = true
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
@@ -590,11 +691,14 @@ func (s *Store) setName(sess *StoredSession, name string) (*StoredUser, error) {
 	if err != nil {
 		return user, err
 	}
+	user.Name = name
 	return user, nil
 }
 
 // CookieSetPassword sets the password of the current user to a new one. If
-// there is no current user logged in ErrNotLoggedIn is returned.
+// there is no current user logged in ErrNotLoggedIn is returned. The client
+// gets a new session cookie and the previous session is deleted. Refresh
+// tokens of the user are revoked, except the ones of the current login.
 func (s *Store) CookieSetPassword(w http.ResponseWriter, r *http.Request, pass string) (*User, error) {
 	u, changed, err := s.setPasswordID(s.getCookieID(r), pass)
 	if changed {
@@ -604,7 +708,10 @@ func (s *Store) CookieSetPassword(w http.ResponseWriter, r *http.Request, pass s
 }
 
 // IDSetPassword sets the password of the current user to a new one. If
-// there is no current user logged in ErrNotLoggedIn is returned.
+// there is no current user logged in ErrNotLoggedIn is returned. The user
+// stays logged in with a new session and the session with the passed ID
+// is deleted. Refresh tokens of the user are revoked, except the ones of
+// the current login.
 //
 // It is the callers responsibility to pass the session token (User.ID) back
 // to the client.
@@ -622,25 +729,25 @@ func (s *Store) UserNameSetPassword(username, pass string) (*User, error) {
 	return s.UserIDSetPassword(id, pass)
 }
 
-// UserIDSetPassword sets the password of the user to a new one.
+// UserIDSetPassword sets the password of the user to a new one. Like
+// ResetPassword, it revokes all sessions and refresh tokens of the user,
+// because there is no current session that could be kept.
 func (s *Store) UserIDSetPassword(id uint64, pass string) (*User, error) {
 	user, err := s.store.GetUser(id)
 	if err != nil {
 		return nil, err
 	}
 
-	user.Salt = make([]byte, 32)
-	_, err = rand.Read(user.Salt)
+	err = s.setUserPassword(user, pass)
 	if err != nil {
 		return nil, err
 	}
 
-	user.Pass, err = scrypt.Key([]byte(pass), user.Salt, 16384, 8, 1, 32)
+	err = s.store.PutUser(user)
 	if err != nil {
-		return nil, err
+		return makeUser(user), err
 	}
-
-	err = s.store.PutUser(user)
+	_, err = s.RevokeAllSessions(user.ID, "")
 	if err != nil {
 		return makeUser(user), err
 	}
@@ -656,12 +763,12 @@ func (s *Store) setPasswordID(id string, pass string) (*StoredUser, bool, error)
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
-	u.StoredSession = sess
-	err = s.store.PutSession(sess)
+	next, err := s.rotateSession(sess)
 	changed = true
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
+	u.StoredSession = next
 	return u, changed, nil
 }
 
@@ -674,92 +781,153 @@ func (s *Store) setPassword(sess *StoredSession, pass string) (*StoredUser, erro
 		return nil, err
 	}
 
-	user.Salt = make([]byte, 32)
-	_, err = rand.Read(user.Salt)
+	err = s.setUserPassword(user, pass)
 	if err != nil {
 		return nil, err
 	}
 
-	user.Pass, err = scrypt.Key([]byte(pass), user.Salt, 16384, 8, 1, 32)
+	err = s.store.PutUser(user)
 	if err != nil {
-		return nil, err
+		return user, err
 	}
-
-	err = s.store.PutUser(user)
+	// other devices need to log in with the new password when their
+	// refresh tokens run out
+	err = s.revokeUserRefreshTokens(user.ID, s.storedSessionID(sess.ID))
 	if err != nil {
 		return user, err
 	}
 	return user, nil
 }
 
-// CookieLogin logs a user in with a username and password. If the credentials for
-// the login are wrong, ErrLoginWrong is returned.
+// CookieLogin logs a user in with a username or email address and password.
+// If the credentials for the login are wrong, ErrLoginWrong is returned.
+// The client gets a new session cookie and the previous session is deleted.
+// If the user has two-factor authentication enabled,
+// ErrSecondFactorRequired is returned and the session stays in the
+// SecondFactorPending state until CookieVerifyTOTP succeeds.
+// With WithLoginThrottle, failed logins are throttled per username and
+// per client key and ErrTooManyAttempts is returned while they are.
 func (s *Store) CookieLogin(w http.ResponseWriter, r *http.Request, username, pass string) (*User, error) {
-	u, changed, err := s.loginID(s.getCookieID(r), username, pass)
+	u, changed, err := s.loginID(s.getCookieID(r), s.clientKey(r), username, pass)
 	if changed {
 		s.saveCookie(w, u.StoredSession)
 	}
 	return makeUser(u), err
 }
 
-// IDLogin logs a user in with a username and password. If the credentials for
-// the login are wrong, ErrLoginWrong is returned.
+// IDLogin logs a user in with a username or email address and password. If
+// the credentials for the login are wrong, ErrLoginWrong is returned. The
+// user is logged in with a new session and the session with the passed ID
+// is deleted. If the user has two-factor authentication enabled,
+// ErrSecondFactorRequired is returned together with the new session, which
+// needs to be completed with IDVerifyTOTP.
+// With WithLoginThrottle, failed logins are throttled per username, use
+// IDLoginClient to also throttle per client.
 //
 // It is the callers responsibility to pass the session token (User.ID) back
 // to the client.
 func (s *Store) IDLogin(id string, username, pass string) (*User, error) {
-	u, _, err := s.loginID(id, username, pass)
+	u, _, err := s.loginID(id, "", username, pass)
 	return makeUser(u), err
 }
 
-func (s *Store) loginID(id string, user, pass string) (*StoredUser, bool, error) {
+func (s *Store) loginID(id string, clientKey string, user, pass string) (*StoredUser, bool, error) {
+	return s.loginWithID(id, func(sess *StoredSession) (*StoredUser, error) {
+		return s.login(sess, clientKey, user, pass)
+	})
+}
+
+// loginWithID logs the session with the ID in with the login function,
+// which has to call loginSession on success, and rotates the session.
+func (s *Store) loginWithID(id string, login func(sess *StoredSession) (*StoredUser, error)) (*StoredUser, bool, error) {
 	sess, changed, err := s.getSessionID(id)
 	if err != nil {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
-	u, err := s.login(sess, user, pass)
-	if err != nil {
+	u, err := login(sess)
+	if err != nil && err != ErrSecondFactorRequired {
 		return &StoredUser{StoredSession: sess}, changed, err
 	}
-	u.StoredSession = sess
-	err = s.store.PutSession(sess)
+	next, rerr := s.rotateSession(sess)
 	changed = true
-	if err != nil {
-		return &StoredUser{StoredSession: sess}, changed, err
+	if rerr != nil {
+		return &StoredUser{StoredSession: sess}, changed, rerr
 	}
+	if err == ErrSecondFactorRequired {
+		return &StoredUser{StoredSession: next}, changed, err
+	}
+	u.StoredSession = next
 	return u, changed, nil
 }
 
-func (s *Store) login(sess *StoredSession, username, password string) (*StoredUser, error) {
-	uid, err := s.store.GetUserID(username)
-	if err != nil {
-		if err == ErrUserNotFound {
-			return nil, ErrLoginWrong
-		}
+// login checks the password of the user and logs sess in. Failed logins
+// are counted for the user and the clientKey, if it is not empty, when
+// the Store has a LoginThrottle.
+func (s *Store) login(sess *StoredSession, clientKey, username, password string) (*StoredUser, error) {
+	uid, err := s.loginUserID(username)
+	if err != nil && err != ErrUserNotFound {
 		return nil, err
 	}
-	user, err := s.store.GetUser(uid)
+	keys := attemptsKeys(uid, username, clientKey)
+	err = s.checkAttempts(s.throttle, keys)
 	if err != nil {
-		if err == ErrUserNotFound {
-			return nil, ErrLoginWrong
-		}
 		return nil, err
 	}
-	// start := time.Now()
-	dk, err := scrypt.Key([]byte(password), user.Salt, 16384, 8, 1, 32)
-	// log.Println("scrypt.Key Login took:", time.Now().Sub(start))
-	if err != nil {
-		return nil, err
+	var user *StoredUser
+	if uid != 0 {
+		user, err = s.store.GetUser(uid)
+		if err != nil && err != ErrUserNotFound {
+			return nil, err
+		}
 	}
-	if bytes.Equal(dk, user.Pass) {
-		sess.LoggedIn = true
-		sess.UserID = user.ID
-		return user, nil
+	ok := false
+	if user != nil {
+		ok, err = s.checkPassword(user, password)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.checkDummyPassword(password)
+	}
+	if ok {
+		// with two factors the counter is only reset by the second one,
+		// so that the password can't reset the failures of the codes
+		if user.TOTPSecret == nil {
+			err = s.resetAttempts(s.throttle, keys[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.upgradePassword(user, password)
+		return user, s.loginSession(sess, user)
 	}
 	sess.LoggedIn = false
+	sess.SecondFactorPending = false
+	err = s.failAttempt(s.throttle, keys, uid)
+	if err != nil {
+		return nil, err
+	}
 	return nil, ErrLoginWrong
 }
 
+// loginSession logs sess in as the authenticated user. If the user has
+// two-factor authentication enabled, the session only gets
+// SecondFactorPending and ErrSecondFactorRequired is returned.
+func (s *Store) loginSession(sess *StoredSession, user *StoredUser) error {
+	sess.UserID = user.ID
+	sess.FixedExpiry = false
+	if user.TOTPSecret != nil {
+		sess.LoggedIn = false
+		sess.SecondFactorPending = true
+		s.refreshExpiry(sess)
+		return ErrSecondFactorRequired
+	}
+	sess.LoggedIn = true
+	sess.SecondFactorPending = false
+	s.refreshExpiry(sess)
+	return nil
+}
+
 // CookieLogout logs the user that is associated with this client. It
 // returns ErrNotLoggedIn if no user is currently logged in.
 func (s *Store) CookieLogout(w http.ResponseWriter, r *http.Request) (*User, error) {
@@ -785,15 +953,41 @@ func (s *Store) logoutID(id string) (*StoredSession, bool, error) {
 	if err != nil {
 		return sess, changed, err
 	}
-	if sess.LoggedIn == false {
-		err = ErrNotLoggedIn
-	} else {
-		sess.LoggedIn = false
+	next, changed2, err := s.logout(sess)
+	return next, changed || changed2, err
+}
+
+// logout logs sess out and saves it. With stateless sessions it returns
+// a new session.
+func (s *Store) logout(sess *StoredSession) (*StoredSession, bool, error) {
+	changed := false
+	if sess.LoggedIn == false && !sess.SecondFactorPending {
+		return sess, changed, ErrNotLoggedIn
 	}
+	// the refresh tokens of the session would log the client in again
+	err := s.revokeSessionRefreshTokens(sess.UserID, s.storedSessionID(sess.ID))
 	if err != nil {
 		return sess, changed, err
 	}
-	err = s.store.PutSession(sess)
+	sess.LoggedIn = false
+	sess.SecondFactorPending = false
+	sess.FixedExpiry = false
+	s.refreshExpiry(sess)
+	if s.statelessSessions() != nil {
+		// the cookie of the logged in session stays valid until it is
+		// revoked, the client gets a new anonymous session
+		err = s.sessions.DeleteSession(sess.ID)
+		if err != nil {
+			return sess, changed, err
+		}
+		next, err := s.rotateSession(sess)
+		changed = true
+		if err != nil {
+			return sess, changed, err
+		}
+		return next, changed, nil
+	}
+	err = s.sessions.PutSession(sess)
 	changed = true
 	if err != nil {
 		return sess, changed, err
@@ -801,8 +995,9 @@ func (s *Store) logoutID(id string) (*StoredSession, bool, error) {
 	return sess, changed, nil
 }
 
-// CookieDelete deletes the user that is associated with this client. It
-// returns ErrNotLoggedIn if no user is currently logged in.
+// CookieDelete deletes the user that is associated with this client and all
+// of their other sessions. It returns ErrNotLoggedIn if no user is currently
+// logged in.
 func (s *Store) CookieDelete(w http.ResponseWriter, r *http.Request) (*User, error) {
 	sess, changed, err := s.deleteID(s.getCookieID(r))
 	if changed {
@@ -811,8 +1006,9 @@ func (s *Store) CookieDelete(w http.ResponseWriter, r *http.Request) (*User, err
 	return makeUser(&StoredUser{StoredSession: sess}), err
 }
 
-// IDDelete deltes the user that is associated with this session id. It
-// returns ErrNotLoggedIn if no user is currently logged in.
+// IDDelete deltes the user that is associated with this session id and all
+// of their other sessions. It returns ErrNotLoggedIn if no user is currently
+// logged in.
 //
 // It is the callers responsibility to pass the session token (User.ID) back
 // to the client.
@@ -821,15 +1017,17 @@ func (s *Store) IDDelete(id string) (*User, error) {
 	return makeUser(&StoredUser{StoredSession: sess}), err
 }
 
-// UserIDDelete deletes the user with the given user ID. It
-// returns ErrUserNotFound if there is no such user stored.
+// UserIDDelete deletes the user with the given user ID and all of
+// their sessions and group memberships. It returns ErrUserNotFound if
+// there is no such user stored.
 func (s *Store) UserIDDelete(id uint64) (*User, error) {
-	err := s.store.DeleteUser(id)
+	err := s.deleteUser(id, "")
 	return makeUser(nil), err
 }
 
-// UserNameDelete deletes the user with the given username. It
-// returns ErrUserNotFound if there is no such user stored.
+// UserNameDelete deletes the user with the given username and all of
+// their sessions and group memberships. It returns ErrUserNotFound if
+// there is no such user stored.
 func (s *Store) UserNameDelete(username string) (*User, error) {
 	id, err := s.store.GetUserID(username)
 	if err != nil {
@@ -838,6 +1036,33 @@ func (s *Store) UserNameDelete(username string) (*User, error) {
 	return s.UserIDDelete(id)
 }
 
+// deleteUser deletes the user and all sessions of the user except the one
+// with the ID keepSession, which the caller has to log out. The user is
+// deleted first, so that no new session can be logged in. Sessions that
+// still reference the deleted user are never returned as logged in,
+// because getID logs them out when the user is not found. The user is
+// also removed from all groups.
+func (s *Store) deleteUser(id uint64, keepSession string) error {
+	err := s.store.DeleteUser(id)
+	if err != nil {
+		return err
+	}
+	n, err := s.RevokeAllSessions(id, keepSession)
+	if err != nil {
+		return err
+	}
+	err = s.removeUserFromGroups(id)
+	if err != nil {
+		return err
+	}
+	s.emit(Event{
+		Type:   EventUserDeleted,
+		UserID: id,
+		Detail: fmt.Sprint(n, " sessions revoked"),
+	})
+	return nil
+}
+
 func (s *Store) deleteID(id string) (*StoredSession, bool, error) {
 	sess, changed, err := s.getSessionID(id)
 	if err != nil {
@@ -846,16 +1071,17 @@ func (s *Store) deleteID(id string) (*StoredSession, bool, error) {
 	if sess.LoggedIn == false {
 		err = ErrNotLoggedIn
 	} else {
-		err = s.store.DeleteUser(sess.UserID)
+		err = s.deleteUser(sess.UserID, sess.ID)
 		if err == nil {
 			sess.LoggedIn = false
 			sess.UserID = 0
+			s.refreshExpiry(sess)
 		}
 	}
 	if err != nil {
 		return sess, changed, err
 	}
-	err = s.store.PutSession(sess)
+	err = s.sessions.PutSession(sess)
 	changed = true
 	if err != nil {
 		return sess, changed, err
@@ -868,10 +1094,25 @@ func (s *Store) deleteID(id string) (*StoredSession, bool, error) {
 // ==================================================
 
 // User maybe will be retuned in the future to not leak unneeded information.
+// Roles and Permissions are the ones that were assigned to the user, use
+// Store.HasPermission to also check the permissions of the roles.
+//
+// SecondFactorPending is true after a correct password login of a user with
+// two-factor authentication, until the second factor is verified.
+//
+// Verified is true if Email was confirmed with VerifyEmail.
 type User struct {
-	LoggedIn bool
-	Name     string
-	Data     interface{}
+	LoggedIn            bool
+	SecondFactorPending bool
+	TOTPEnabled         bool
+	RecoveryCodesLeft   int
+	Name                string
+	Email               string
+	Verified            bool
+	Data                interface{}
+	Roles               []string
+	Permissions         []string
+	InvitedBy           uint64
 
 	Session struct {
 		ID         string
@@ -896,9 +1137,17 @@ func makeUser(user *StoredUser) *User {
 		}
 	}
 	return &User{
-		LoggedIn: s.LoggedIn,
-		Name:     u.Name,
-		Data:     u.Data,
+		LoggedIn:            s.LoggedIn,
+		SecondFactorPending: s.SecondFactorPending,
+		TOTPEnabled:         u.TOTPSecret != nil,
+		RecoveryCodesLeft:   len(u.RecoveryCodes),
+		Name:                u.Name,
+		Email:               u.Email,
+		Verified:            u.Verified,
+		Data:                u.Data,
+		Roles:               u.Roles,
+		Permissions:         u.Permissions,
+		InvitedBy:           u.InvitedBy,
 		Session: struct {
 			ID         string
 			Expires    time.Time
@@ -915,18 +1164,42 @@ func makeUser(user *StoredUser) *User {
 
 // StoredUser is the type that is retuned from most Store methods. It contains
 // the Name of the user, which is also the identification when it is stored.
-// Salt is randomly generated on registration and used to salt the password
-// hash which is then stored in Pass. The session that was used to retrieve
-// this user is also embedded into the struct.
+// Pass holds the encoded password hash created by the PasswordHasher of the
+// Store. Salt is only set for legacy scrypt hashes that were stored without
+// encoding. The session that was used to retrieve this user is also embedded
+// into the struct.
 //
 // The Data field can hold arbitrary application data which is saved using
 // the Store.Save() method. To work with it use a type assertion.
+//
+// Roles and Permissions hold the names that were assigned to the user.
+// The Store never modifies these slices in place, so backends may share
+// them between copies of a user. InvitedBy is the ID of the user whose
+// invite was used to register, or 0.
+//
+// TOTPSecret is the confirmed secret for two-factor authentication and
+// TOTPPending a secret whose enrollment isn't confirmed yet. TOTPLastStep
+// is the time step of the last accepted code, which can't be used again.
+// RecoveryCodes holds the SHA-256 hashes of the unused recovery codes.
+//
+// Email is the normalized email address of the user or empty. Like the
+// Name it is unique, backends that implement EmailStorer index it.
+// Verified is true if the current Email was confirmed.
 type StoredUser struct {
-	ID   uint64
-	Name string
-	Pass []byte
-	Salt []byte
-	Data interface{}
+	ID            uint64
+	Name          string
+	Email         string
+	Verified      bool
+	Pass          []byte
+	Salt          []byte
+	Data          interface{}
+	Roles         []string
+	Permissions   []string
+	InvitedBy     uint64
+	TOTPSecret    []byte
+	TOTPPending   []byte
+	TOTPLastStep  int64
+	RecoveryCodes [][]byte
 	*StoredSession
 }
 
@@ -934,27 +1207,38 @@ type StoredUser struct {
 // ID token which is base64 encoded. It also tracks expiration time and last
 // access time. If a user is logged in with this session, LoggedIn is true
 // and User holds a username. After a logout User still holds the username.
+// SecondFactorPending is true while the session waits for the second factor
+// of UserID, LoggedIn is false in this state. Sessions of refresh tokens
+// have FixedExpiry, their Expires is not extended on access.
 type StoredSession struct {
-	ID         string
-	Expires    time.Time
-	LastAccess time.Time
-	LoggedIn   bool
-	UserID     uint64
+	ID                  string
+	Expires             time.Time
+	LastAccess          time.Time
+	LoggedIn            bool
+	UserID              uint64
+	SecondFactorPending bool
+	FixedExpiry         bool
+
+	// issued is the creation time and sealed the last encrypted value of a
+	// stateless session, they are not kept by backends
+	issued time.Time
+	sealed sealedSession
 }
 
 // make a new session with 24 random bytes which results in 32 base64 bytes
-func makeSession() (*StoredSession, error) {
+func (s *Store) makeSession() (*StoredSession, error) {
 	buf := make([]byte, 24)
 	_, err := rand.Read(buf)
 	if err != nil {
 		return nil, err
 	}
 	str := base64.StdEncoding.EncodeToString(buf)
-	expiration := time.Now().Add(defaultSessionCookieExpiration)
-	s := StoredSession{
+	now := time.Now()
+	sess := StoredSession{
 		ID:         str,
-		Expires:    expiration,
-		LastAccess: time.Now(),
+		Expires:    now.Add(s.anonymousTTL),
+		LastAccess: now,
+		issued:     now,
 	}
-	return &s, nil
+	return &sess, nil
 }
@@ -0,0 +1,218 @@
+package crowd
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionRotation(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+
+	anon, err := store.IDGet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDRegister(anon.Session.ID, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRotated(t, store, anon.Session.ID, u)
+
+	old := u.Session.ID
+	u, err = store.IDSetPassword(old, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRotated(t, store, old, u)
+
+	old = u.Session.ID
+	_, err = store.IDLogout(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.IDLogin(old, "alice", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRotated(t, store, old, u)
+
+	// a failed login doesn't change the session
+	old = u.Session.ID
+	u, err = store.IDLogin(old, "alice", "wrong")
+	if err != ErrLoginWrong {
+		t.Fatalf("expected ErrLoginWrong, got %v", err)
+	}
+	if u.Session.ID != old {
+		t.Errorf("failed login changed the session ID")
+	}
+}
+
+func TestCookieSessionRotation(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+
+	w := httptest.NewRecorder()
+	_, err := store.CookieGet(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := w.Result().Cookies()[0]
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(before)
+	u, err := store.CookieRegister(w, r, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := w.Result().Cookies()[0]
+	if after.Value != u.Session.ID {
+		t.Errorf("cookie %q doesn't match the session %q", after.Value, u.Session.ID)
+	}
+	checkRotated(t, store, before.Value, u)
+}
+
+// checkRotated checks that u has a new logged in session and that the old
+// session was deleted from the backend.
+func checkRotated(t *testing.T, store *Store, old string, u *User) {
+	t.Helper()
+	if u.Session.ID == old {
+		t.Fatalf("session ID %q was not rotated", old)
+	}
+	if !u.LoggedIn {
+		t.Errorf("new session is not logged in")
+	}
+	if _, err := store.store.GetSession(hashSessionID(old)); err != ErrSessionNotFound {
+		t.Errorf("old session still exists: %v", err)
+	}
+	sess, err := store.store.GetSession(hashSessionID(u.Session.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.LoggedIn || sess.UserID != u.Session.UserID {
+		t.Errorf("new session has wrong state %+v", sess)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.StopSessionGC()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		var u *User
+		var err error
+		if i == 0 {
+			u, err = store.IDRegister("", "alice", "secret")
+		} else {
+			u, err = store.IDLogin("", "alice", "secret")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, u.Session.ID)
+	}
+	_, err := store.IDRegister("", "bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// logged out sessions are not listed
+	_, err = store.IDLogout(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.UserSessions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	err = store.RevokeSession(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.IDGet(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.LoggedIn || u.Session.ID == ids[0] {
+		t.Errorf("revoked session is still valid")
+	}
+
+	u, err = store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := store.RevokeAllSessions(1, u.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 revoked sessions, got %d", n)
+	}
+	sessions, err = store.UserSessions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != hashSessionID(u.Session.ID) {
+		t.Errorf("expected only the current session, got %v", sessions)
+	}
+	sessions, err = store.UserSessions(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("sessions of another user were revoked")
+	}
+}
+
+func TestDeleteUserSessions(t *testing.T) {
+	var events []Event
+	store := NewMemoryStore(WithEventHandler(func(e Event) { events = append(events, e) }))
+	defer store.StopSessionGC()
+
+	first, err := store.IDRegister("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := store.IDLogin("", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.IDDelete(first.Session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.LoggedIn || u.Session.ID != first.Session.ID {
+		t.Errorf("deleting session should stay and be logged out, got %+v", u)
+	}
+	for _, id := range []string{second.Session.ID, third.Session.ID} {
+		if _, err = store.store.GetSession(hashSessionID(id)); err != ErrSessionNotFound {
+			t.Errorf("session of deleted user still exists: %v", err)
+		}
+	}
+	if len(events) != 1 || events[0].Type != EventUserDeleted || events[0].Detail != "2 sessions revoked" {
+		t.Errorf("expected a UserDeleted event, got %v", events)
+	}
+
+	other, err := store.IDRegister("", "bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UserNameDelete("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.store.GetSession(hashSessionID(other.Session.ID)); err != ErrSessionNotFound {
+		t.Errorf("session of deleted user still exists: %v", err)
+	}
+}